@@ -0,0 +1,75 @@
+// gofaster-server serves an in memory htable.Table to Redis clients, optionally
+// journaling every change to a write ahead log that is replayed on startup.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/htable"
+	"github.com/zeebo/gofaster/server"
+	"github.com/zeebo/gofaster/wal"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "gofaster-server:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	addr := flag.String("addr", ":6379", "address to listen on")
+	bits := flag.Uint64("bits", 16, "log of the initial number of buckets")
+	walPath := flag.String("wal", "", "base path of a write ahead log to journal changes to")
+	maxConns := flag.Int("max-conns", 0, "most connections served at once (default 32)")
+	maxCommand := flag.Int("max-command-bytes", 0, "most bytes of arguments in a command (default 4MB)")
+	flag.Parse()
+
+	var opts []htable.Option
+	if *walPath != "" {
+		l, err := wal.Open(*walPath, wal.Config{})
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		opts = append(opts, htable.WithWAL(l))
+	}
+	table := htable.New(*bits, opts...)
+
+	h := epoch.AcquireHandle()
+	err := table.Replay(h)
+	epoch.ReleaseHandle(h)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := server.New(table, server.Config{MaxConns: *maxConns, MaxCommandBytes: *maxCommand})
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = srv.Close()
+	}()
+
+	fmt.Fprintln(os.Stderr, "gofaster-server: listening on", ln.Addr())
+	err = srv.Serve(ln)
+
+	// wait for every connection to finish before the log is closed.
+	_ = srv.Close()
+	if !errors.Is(err, server.ErrClosed) {
+		return err
+	}
+	return table.Sync()
+}
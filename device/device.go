@@ -0,0 +1,102 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+var (
+	// ErrUnaligned is passed to the callback when an address or length is not
+	// a multiple of the sector size.
+	ErrUnaligned = errors.New("device: unaligned request")
+
+	// ErrSegment is passed to the callback when a request spans segments.
+	ErrSegment = errors.New("device: request spans segments")
+
+	// ErrTruncated is passed to the callback when a read is from an address
+	// that has been truncated.
+	ErrTruncated = errors.New("device: address truncated")
+
+	// ErrClosed is passed to the callback when the device has been closed.
+	ErrClosed = errors.New("device: device closed")
+)
+
+// Config describes the layout of a device.
+type Config struct {
+	// SectorSize is the alignment of the addresses and lengths of requests.
+	// It must be a power of two, and the default is 512.
+	SectorSize int
+
+	// SegmentBits is the log of the size of a segment in bytes. The default is
+	// 30.
+	SegmentBits uint
+}
+
+// normalize fills in the defaults of the config and validates it.
+func (c Config) normalize() (Config, error) {
+	if c.SectorSize == 0 {
+		c.SectorSize = 512
+	}
+	if c.SegmentBits == 0 {
+		c.SegmentBits = 30
+	}
+
+	switch {
+	case c.SectorSize < 0 || c.SectorSize&(c.SectorSize-1) != 0:
+		return c, fmt.Errorf("device: invalid sector size: %d", c.SectorSize)
+	case 1<<c.SegmentBits < c.SectorSize || c.SegmentBits > 46:
+		return c, fmt.Errorf("device: invalid segment bits: %d", c.SegmentBits)
+	}
+	return c, nil
+}
+
+// Callback is called with a handle and the result of an asynchronous request.
+// The handle is protected while it runs.
+type Callback func(h epoch.Handle, err error)
+
+// Device stores bytes by logical address.
+type Device interface {
+	// SectorSize returns the alignment of the addresses and lengths of
+	// requests.
+	SectorSize() int
+
+	// SegmentSize returns the size of the units the device is stored in. No
+	// request may span two segments.
+	SegmentSize() int64
+
+	// ReadAsync reads len(buf) bytes at the address into buf, posting the
+	// callback to the queue when it is done. The buffer must not be used until
+	// the callback runs.
+	ReadAsync(q *Queue, addr uint64, buf []byte, cb Callback)
+
+	// WriteAsync writes buf to the address, posting the callback to the queue
+	// when it is done. The buffer must not be modified until the callback runs.
+	WriteAsync(q *Queue, addr uint64, buf []byte, cb Callback)
+
+	// Sync blocks until every completed write is durable.
+	Sync() error
+
+	// TruncateUntil discards every segment entirely before the address.
+	// Requests in flight on those segments complete normally, and requests
+	// issued after it fail with ErrTruncated.
+	TruncateUntil(addr uint64) error
+
+	// Close releases the resources of the device. Requests issued after it is
+	// closed fail with ErrClosed.
+	Close() error
+}
+
+// check returns an error if the request is not aligned or spans segments.
+func check(d Device, addr uint64, n int) error {
+	sector := uint64(d.SectorSize())
+	if addr%sector != 0 || uint64(n)%sector != 0 {
+		return fmt.Errorf("%w: addr:%d len:%d sector:%d", ErrUnaligned, addr, n, sector)
+	}
+	seg := uint64(d.SegmentSize())
+	if n > 0 && addr/seg != (addr+uint64(n)-1)/seg {
+		return fmt.Errorf("%w: addr:%d len:%d segment:%d", ErrSegment, addr, n, seg)
+	}
+	return nil
+}
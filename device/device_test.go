@@ -0,0 +1,282 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestDevice(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	cfg := Config{SectorSize: 64, SegmentBits: 10}
+
+	// wait issues a request and completes the queue, returning the error.
+	wait := func(issue func(q *Queue, cb Callback)) (err error) {
+		var q Queue
+		issue(&q, func(h epoch.Handle, e error) { err = e })
+		assert.Equal(t, q.Complete(h, true), 1)
+		assert.Equal(t, q.Pending(), 0)
+		return err
+	}
+
+	run := func(t *testing.T, d Device) {
+		defer func() { assert.NoError(t, d.Close()) }()
+
+		page := bytes.Repeat([]byte("0123456789abcdef"), 16)
+		buf := make([]byte, len(page))
+
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.WriteAsync(q, 1024, page, cb) }))
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 1024, buf, cb) }))
+		assert.Equal(t, string(buf), string(page))
+
+		// unwritten bytes read as zero
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 2048, buf, cb) }))
+		assert.DeepEqual(t, buf, make([]byte, len(buf)))
+
+		err := wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 1, buf, cb) })
+		assert.That(t, errors.Is(err, ErrUnaligned))
+		err = wait(func(q *Queue, cb Callback) { d.WriteAsync(q, 1024-64, buf, cb) })
+		assert.That(t, errors.Is(err, ErrSegment))
+
+		assert.NoError(t, d.Sync())
+		assert.NoError(t, d.TruncateUntil(1024+512))
+		err = wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 0, buf, cb) })
+		assert.That(t, errors.Is(err, ErrTruncated))
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 1024, buf, cb) }))
+		assert.Equal(t, string(buf), string(page))
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		d, err := NewMemory(cfg)
+		assert.NoError(t, err)
+		run(t, d)
+	})
+
+	t.Run("File", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "log")
+		d, err := OpenFile(base, cfg)
+		assert.NoError(t, err)
+		run(t, d)
+
+		// the truncated segment is gone, and the next device begins after it
+		_, err = os.Stat(base + ".0")
+		assert.That(t, errors.Is(err, os.ErrNotExist))
+		fi, err := os.Stat(base + ".1")
+		assert.NoError(t, err)
+		assert.Equal(t, fi.Size(), int64(1024))
+
+		d, err = OpenFile(base, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, d.Begin(), uint64(1024))
+		assert.NoError(t, d.Close())
+		assert.Equal(t, d.Close(), ErrClosed)
+	})
+
+	t.Run("FileInFlight", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "log")
+		d, err := OpenFile(base, cfg)
+		assert.NoError(t, err)
+		defer func() { assert.NoError(t, d.Close()) }()
+
+		page := bytes.Repeat([]byte("0123456789abcdef"), 16)
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.WriteAsync(q, 0, page, cb) }))
+
+		// a request in flight when its segment is truncated still completes,
+		// and the file is removed once it does.
+		seg, err := d.start(0, len(page))
+		assert.NoError(t, err)
+		assert.NoError(t, d.TruncateUntil(1024))
+		err = wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 0, page, cb) })
+		assert.That(t, errors.Is(err, ErrTruncated))
+
+		buf := make([]byte, len(page))
+		_, err = seg.fh.ReadAt(buf, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, string(buf), string(page))
+		_, err = os.Stat(base + ".0")
+		assert.NoError(t, err)
+
+		d.finish(seg)
+		_, err = os.Stat(base + ".0")
+		assert.That(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("Faulty", func(t *testing.T) {
+		d, err := NewFaulty(cfg, Faults{})
+		assert.NoError(t, err)
+		run(t, d)
+	})
+
+	t.Run("Null", func(t *testing.T) {
+		var d Null
+		buf := []byte{1, 2, 3}
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.WriteAsync(q, 0, buf, cb) }))
+		assert.NoError(t, wait(func(q *Queue, cb Callback) { d.ReadAsync(q, 0, buf, cb) }))
+		assert.DeepEqual(t, buf, []byte{0, 0, 0})
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		_, err := NewMemory(Config{SectorSize: 3})
+		assert.Error(t, err)
+		_, err = NewMemory(Config{SectorSize: 4096, SegmentBits: 10})
+		assert.Error(t, err)
+	})
+}
+
+func TestFaulty(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	cfg := Config{SectorSize: 64, SegmentBits: 16}
+
+	// do issues a request and completes the queue, returning the error.
+	do := func(issue func(q *Queue, cb Callback)) (err error) {
+		var q Queue
+		issue(&q, func(h epoch.Handle, e error) { err = e })
+		q.Complete(h, true)
+		return err
+	}
+	write := func(d Device, addr uint64, b byte) error {
+		return do(func(q *Queue, cb Callback) { d.WriteAsync(q, addr, bytes.Repeat([]byte{b}, 64), cb) })
+	}
+	read := func(d Device, addr uint64) []byte {
+		buf := make([]byte, 64)
+		assert.NoError(t, do(func(q *Queue, cb Callback) { d.ReadAsync(q, addr, buf, cb) }))
+		return buf
+	}
+
+	t.Run("Drop", func(t *testing.T) {
+		d, err := NewFaulty(cfg, Faults{})
+		assert.NoError(t, err)
+
+		assert.NoError(t, write(d, 0, 1))
+		assert.NoError(t, d.Sync())
+		assert.NoError(t, write(d, 0, 2))
+		assert.NoError(t, write(d, 64, 2))
+		assert.Equal(t, read(d, 0)[0], byte(2))
+
+		c := d.Crash()
+		assert.Equal(t, write(d, 0, 3), ErrClosed)
+		assert.Equal(t, read(c, 0)[0], byte(1))
+		assert.Equal(t, read(c, 64)[0], byte(0))
+	})
+
+	t.Run("Reorder", func(t *testing.T) {
+		d, err := NewFaulty(cfg, Faults{Reorder: true})
+		assert.NoError(t, err)
+
+		// over many crashes, some but not all of the writes survive, and not
+		// always a prefix of them.
+		var partial, gaps bool
+		for i := 0; i < 20; i++ {
+			for j := uint64(0); j < 8; j++ {
+				assert.NoError(t, write(d, j*64, byte(i+1)))
+			}
+			d = d.Crash()
+
+			kept, prefix := 0, true
+			for j := uint64(0); j < 8; j++ {
+				if read(d, j*64)[0] == byte(i+1) {
+					kept++
+					prefix = prefix && kept == int(j)+1
+				}
+			}
+			partial = partial || (kept > 0 && kept < 8)
+			gaps = gaps || !prefix
+		}
+		assert.That(t, partial && gaps)
+	})
+
+	t.Run("Tear", func(t *testing.T) {
+		d, err := NewFaulty(cfg, Faults{Tear: true, Rand: rand.New(rand.NewSource(2))})
+		assert.NoError(t, err)
+
+		assert.NoError(t, write(d, 0, 0xff))
+		buf := read(d.Crash(), 0)
+		n := bytes.IndexByte(buf, 0)
+		assert.That(t, n > 0 && n < len(buf))
+		assert.DeepEqual(t, buf[n:], make([]byte, len(buf)-n))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		fail := errors.New("injected")
+		d, err := NewFaulty(cfg, Faults{
+			WriteError: func(addr uint64, n int) error {
+				if addr >= 128 {
+					return fail
+				}
+				return nil
+			},
+			SyncError: func() error { return fail },
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, write(d, 0, 1))
+		assert.Equal(t, write(d, 128, 1), fail)
+		assert.Equal(t, d.Sync(), fail)
+	})
+}
+
+func TestQueue(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	d, err := OpenFile(filepath.Join(t.TempDir(), "log"), Config{SectorSize: 64, SegmentBits: 16})
+	assert.NoError(t, err)
+	defer d.Close()
+
+	const (
+		workers = 4
+		writes  = 64
+	)
+
+	// every worker issues writes with its own queue, and the callbacks run on
+	// the handle completing it, which is protected.
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			var q Queue
+			done := 0
+			for i := 0; i < writes; i++ {
+				buf := bytes.Repeat([]byte{byte(w)}, 64)
+				d.WriteAsync(&q, uint64(w*writes+i)*64, buf, func(ch epoch.Handle, err error) {
+					assert.NoError(t, err)
+					assert.Equal(t, ch, h)
+					done++
+				})
+				if i%8 == 0 {
+					q.Complete(h, false)
+				}
+			}
+			q.Complete(h, true)
+			assert.Equal(t, done, writes)
+			assert.Equal(t, q.Pending(), 0)
+		}(w)
+	}
+	wg.Wait()
+
+	var q Queue
+	buf := make([]byte, 64)
+	for w := 0; w < workers; w++ {
+		for i := 0; i < writes; i++ {
+			d.ReadAsync(&q, uint64(w*writes+i)*64, buf, nil)
+			q.Complete(h, true)
+			assert.DeepEqual(t, buf, bytes.Repeat([]byte{byte(w)}, 64))
+		}
+	}
+}
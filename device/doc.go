@@ -0,0 +1,5 @@
+// package device provides storage for the pages of a log, addressed by their
+// logical offset. Reads and writes are asynchronous: each one is issued with a
+// Queue and a callback, and the callback runs when a handle completes the
+// queue, so that it can safely touch memory protected by the epoch system.
+package device
@@ -0,0 +1,230 @@
+package device
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Faults describes the faults a Faulty device injects.
+type Faults struct {
+	// Rand chooses which faults happen during a crash. The default is seeded
+	// with 1, so that crashes are deterministic.
+	Rand *rand.Rand
+
+	// Reorder causes a crash to keep a random subset of the writes since the
+	// last sync, applied in a random order, instead of dropping all of them.
+	Reorder bool
+
+	// Tear causes a crash to keep a prefix of one of the writes since the last
+	// sync, of a random number of bytes.
+	Tear bool
+
+	// ReadError, WriteError and SyncError, if set, are called before every
+	// request, and a non-nil error fails it without performing it.
+	ReadError  func(addr uint64, n int) error
+	WriteError func(addr uint64, n int) error
+	SyncError  func() error
+}
+
+// write is a write that has not been synced.
+type write struct {
+	addr uint64
+	buf  []byte
+}
+
+// Faulty is a device for testing that keeps its segments in memory, and only
+// makes writes durable when it is synced. Crash simulates the process or
+// machine stopping, losing or damaging the writes that were not synced.
+type Faulty struct {
+	faults Faults
+	image  *Memory // the durable contents
+
+	mu      sync.Mutex
+	pending []write // unsynced writes, in the order they were issued
+	closed  bool
+}
+
+// NewFaulty constructs a faulty device with the configuration that injects the
+// faults.
+func NewFaulty(cfg Config, faults Faults) (*Faulty, error) {
+	image, err := NewMemory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if faults.Rand == nil {
+		faults.Rand = rand.New(rand.NewSource(1))
+	}
+	return &Faulty{faults: faults, image: image}, nil
+}
+
+// SectorSize returns the alignment of the addresses and lengths of requests.
+func (f *Faulty) SectorSize() int { return f.image.SectorSize() }
+
+// SegmentSize returns the size of a segment.
+func (f *Faulty) SegmentSize() int64 { return f.image.SegmentSize() }
+
+// ReadAsync reads len(buf) bytes at the address into buf, including writes
+// that have not been synced.
+func (f *Faulty) ReadAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	q.Post(cb, f.read(addr, buf))
+}
+
+// read copies the durable bytes at the address into buf, and then the bytes of
+// every overlapping unsynced write.
+func (f *Faulty) read(addr uint64, buf []byte) error {
+	if fn := f.faults.ReadError; fn != nil {
+		if err := fn(addr, len(buf)); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	if err := f.image.read(addr, buf); err != nil {
+		return err
+	}
+
+	end := addr + uint64(len(buf))
+	for _, w := range f.pending {
+		wend := w.addr + uint64(len(w.buf))
+		if w.addr >= end || wend <= addr {
+			continue
+		}
+		switch {
+		case w.addr >= addr:
+			copy(buf[w.addr-addr:], w.buf)
+		default:
+			copy(buf, w.buf[addr-w.addr:])
+		}
+	}
+	return nil
+}
+
+// WriteAsync records a copy of buf to be written to the address when the
+// device is synced.
+func (f *Faulty) WriteAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	q.Post(cb, f.write(addr, buf))
+}
+
+// write records a copy of buf as an unsynced write.
+func (f *Faulty) write(addr uint64, buf []byte) error {
+	if fn := f.faults.WriteError; fn != nil {
+		if err := fn(addr, len(buf)); err != nil {
+			return err
+		}
+	}
+	if err := check(f, addr, len(buf)); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	f.pending = append(f.pending, write{addr: addr, buf: append([]byte(nil), buf...)})
+	return nil
+}
+
+// Sync makes every write durable.
+func (f *Faulty) Sync() error {
+	if fn := f.faults.SyncError; fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	for _, w := range f.pending {
+		if err := f.image.write(w.addr, w.buf); err != nil {
+			return err
+		}
+	}
+	f.pending = nil
+	return nil
+}
+
+// TruncateUntil discards every segment entirely before the address, along
+// with any unsynced writes to them.
+func (f *Faulty) TruncateUntil(addr uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	if err := f.image.TruncateUntil(addr); err != nil {
+		return err
+	}
+
+	begin := addr >> f.image.cfg.SegmentBits << f.image.cfg.SegmentBits
+	pending := f.pending[:0]
+	for _, w := range f.pending {
+		if w.addr >= begin {
+			pending = append(pending, w)
+		}
+	}
+	f.pending = pending
+	return nil
+}
+
+// Close causes every later request to fail with ErrClosed.
+func (f *Faulty) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Crash closes the device as if the machine stopped, and returns a device with
+// the contents that survived it. Writes that were not synced are dropped,
+// unless the faults cause some of them to be kept or torn. Requests to the
+// crashed device fail with ErrClosed, so that anything still using it cannot
+// change the new one.
+func (f *Faulty) Crash() *Faulty {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending := f.pending
+	f.pending, f.closed = nil, true
+	rng := f.faults.Rand
+
+	var torn *write
+	if f.faults.Tear && len(pending) > 0 {
+		w := pending[rng.Intn(len(pending))]
+		torn = &w
+	}
+
+	if f.faults.Reorder {
+		rng.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+		for _, w := range pending[:rng.Intn(len(pending)+1)] {
+			_ = f.image.write(w.addr, w.buf)
+		}
+	}
+
+	// the torn write lands last, leaving the bytes it did not get to as they
+	// were.
+	if torn != nil {
+		buf := make([]byte, len(torn.buf))
+		if f.image.read(torn.addr, buf) == nil {
+			copy(buf, torn.buf[:rng.Intn(len(torn.buf)+1)])
+			_ = f.image.write(torn.addr, buf)
+		}
+	}
+
+	return &Faulty{faults: f.faults, image: f.image}
+}
@@ -0,0 +1,265 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// File is a device that stores each segment in its own preallocated file named
+// by the base path followed by a dot and the segment number. Requests are
+// performed on their own goroutine.
+type File struct {
+	cfg  Config
+	base string
+
+	mu       sync.Mutex
+	segments map[uint64]*segmentFile
+	begin    uint64
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// segmentFile is the open file of a segment along with the number of requests
+// in flight on it, so that truncating it waits for them to complete before
+// closing and removing the file.
+type segmentFile struct {
+	key     uint64
+	fh      *os.File
+	refs    int  // the number of requests in flight on the segment
+	dropped bool // the segment was truncated while requests were in flight
+}
+
+// OpenFile opens a file device with segments at the base path, creating them as
+// necessary. Segments left by an earlier device are reused, and the earliest
+// one determines the address the device begins at.
+func OpenFile(base string, cfg Config) (*File, error) {
+	cfg, err := cfg.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		cfg:      cfg,
+		base:     base,
+		segments: make(map[uint64]*segmentFile),
+	}
+
+	names, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return nil, err
+	}
+	first := true
+	for _, name := range names {
+		key, err := strconv.ParseUint(strings.TrimPrefix(name, base+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		if begin := key << cfg.SegmentBits; first || begin < f.begin {
+			f.begin, first = begin, false
+		}
+	}
+
+	return f, nil
+}
+
+// SectorSize returns the alignment of the addresses and lengths of requests.
+func (f *File) SectorSize() int { return f.cfg.SectorSize }
+
+// SegmentSize returns the size of a segment.
+func (f *File) SegmentSize() int64 { return 1 << f.cfg.SegmentBits }
+
+// Begin returns the address of the first segment that has not been truncated.
+func (f *File) Begin() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.begin
+}
+
+// name returns the file name of the segment with the key.
+func (f *File) name(key uint64) string {
+	return fmt.Sprintf("%s.%d", f.base, key)
+}
+
+// segment returns the open file for the segment holding the address, creating
+// and preallocating it if necessary. It is called with the mutex held.
+func (f *File) segment(addr uint64) (*segmentFile, error) {
+	switch {
+	case f.closed:
+		return nil, ErrClosed
+	case addr < f.begin:
+		return nil, ErrTruncated
+	}
+
+	key := addr >> f.cfg.SegmentBits
+	if seg, ok := f.segments[key]; ok {
+		return seg, nil
+	}
+
+	fh, err := os.OpenFile(f.name(key), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := fh.Stat(); err != nil {
+		_ = fh.Close()
+		return nil, err
+	} else if fi.Size() < f.SegmentSize() {
+		if err := preallocate(fh, f.SegmentSize()); err != nil {
+			_ = fh.Close()
+			return nil, err
+		}
+	}
+
+	seg := &segmentFile{key: key, fh: fh}
+	f.segments[key] = seg
+	return seg, nil
+}
+
+// start looks up the segment for a request and registers it as in flight so
+// that Close and TruncateUntil wait for it.
+func (f *File) start(addr uint64, n int) (*segmentFile, error) {
+	if err := check(f, addr, n); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seg, err := f.segment(addr)
+	if err != nil {
+		return nil, err
+	}
+	seg.refs++
+	f.inflight.Add(1)
+	return seg, nil
+}
+
+// finish unregisters a request started on the segment, closing and removing
+// its file if it was truncated while the request was in flight.
+func (f *File) finish(seg *segmentFile) {
+	f.mu.Lock()
+	seg.refs--
+	if seg.dropped && seg.refs == 0 {
+		// there is no one to report the error to, and opening the device
+		// again ignores segments before its begin.
+		_ = seg.fh.Close()
+		_ = os.Remove(f.name(seg.key))
+	}
+	f.mu.Unlock()
+	f.inflight.Done()
+}
+
+// ReadAsync reads len(buf) bytes at the address into buf.
+func (f *File) ReadAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	seg, err := f.start(addr, len(buf))
+	if err != nil {
+		q.Post(cb, err)
+		return
+	}
+
+	q.issue()
+	go func() {
+		defer f.finish(seg)
+
+		n, err := seg.fh.ReadAt(buf, int64(addr&uint64(f.SegmentSize()-1)))
+		if errors.Is(err, io.EOF) {
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			err = nil
+		}
+		q.done(cb, err)
+	}()
+}
+
+// WriteAsync writes buf to the address.
+func (f *File) WriteAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	seg, err := f.start(addr, len(buf))
+	if err != nil {
+		q.Post(cb, err)
+		return
+	}
+
+	q.issue()
+	go func() {
+		defer f.finish(seg)
+
+		_, err := seg.fh.WriteAt(buf, int64(addr&uint64(f.SegmentSize()-1)))
+		q.done(cb, err)
+	}()
+}
+
+// Sync flushes every open segment to stable storage.
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	for _, seg := range f.segments {
+		if err := seg.fh.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateUntil removes the file of every segment entirely before the address.
+// Requests in flight for those segments complete normally, and the files of
+// the segments they use are closed and removed once they do.
+func (f *File) TruncateUntil(addr uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+	end := addr >> f.cfg.SegmentBits
+	if end<<f.cfg.SegmentBits <= f.begin {
+		return nil
+	}
+
+	for key := f.begin >> f.cfg.SegmentBits; key < end; key++ {
+		if seg, ok := f.segments[key]; ok {
+			delete(f.segments, key)
+			if seg.refs > 0 {
+				seg.dropped = true
+				continue
+			}
+			_ = seg.fh.Close()
+		}
+		if err := os.Remove(f.name(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	f.begin = end << f.cfg.SegmentBits
+	return nil
+}
+
+// Close waits for requests in flight and closes every segment.
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrClosed
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	f.inflight.Wait()
+
+	var err error
+	for key, seg := range f.segments {
+		if cerr := seg.fh.Close(); err == nil {
+			err = cerr
+		}
+		delete(f.segments, key)
+	}
+	return err
+}
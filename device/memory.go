@@ -0,0 +1,136 @@
+package device
+
+import "sync"
+
+// Memory is a device that keeps its segments in memory, for tests. Requests
+// finish before they are issued, but their callbacks still run through the
+// queue.
+type Memory struct {
+	cfg Config
+
+	mu       sync.Mutex
+	segments map[uint64][]byte // grown to the end of the last write
+	begin    uint64
+	closed   bool
+}
+
+// NewMemory constructs a memory device with the configuration.
+func NewMemory(cfg Config) (*Memory, error) {
+	cfg, err := cfg.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return &Memory{
+		cfg:      cfg,
+		segments: make(map[uint64][]byte),
+	}, nil
+}
+
+// SectorSize returns the alignment of the addresses and lengths of requests.
+func (m *Memory) SectorSize() int { return m.cfg.SectorSize }
+
+// SegmentSize returns the size of a segment.
+func (m *Memory) SegmentSize() int64 { return 1 << m.cfg.SegmentBits }
+
+// ReadAsync reads len(buf) bytes at the address into buf. Bytes that were
+// never written are zero.
+func (m *Memory) ReadAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	q.Post(cb, m.read(addr, buf))
+}
+
+// read copies the bytes at the address into buf.
+func (m *Memory) read(addr uint64, buf []byte) error {
+	if err := check(m, addr, len(buf)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case m.closed:
+		return ErrClosed
+	case addr < m.begin:
+		return ErrTruncated
+	}
+
+	seg := m.segments[addr>>m.cfg.SegmentBits]
+	off := addr & uint64(m.SegmentSize()-1)
+	n := 0
+	if off < uint64(len(seg)) {
+		n = copy(buf, seg[off:])
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+// WriteAsync writes buf to the address.
+func (m *Memory) WriteAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	q.Post(cb, m.write(addr, buf))
+}
+
+// write copies buf to the address.
+func (m *Memory) write(addr uint64, buf []byte) error {
+	if err := check(m, addr, len(buf)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case m.closed:
+		return ErrClosed
+	case addr < m.begin:
+		return ErrTruncated
+	}
+
+	key := addr >> m.cfg.SegmentBits
+	seg := m.segments[key]
+	off := addr & uint64(m.SegmentSize()-1)
+	if end := off + uint64(len(buf)); end > uint64(len(seg)) {
+		seg = append(seg, make([]byte, end-uint64(len(seg)))...)
+		m.segments[key] = seg
+	}
+	copy(seg[off:], buf)
+	return nil
+}
+
+// Sync does nothing because memory is as durable as it gets.
+func (m *Memory) Sync() error { return nil }
+
+// TruncateUntil discards every segment entirely before the address.
+func (m *Memory) TruncateUntil(addr uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	addr = addr >> m.cfg.SegmentBits << m.cfg.SegmentBits
+	if addr <= m.begin {
+		return nil
+	}
+	for key := range m.segments {
+		if key < addr>>m.cfg.SegmentBits {
+			delete(m.segments, key)
+		}
+	}
+	m.begin = addr
+	return nil
+}
+
+// Close releases the memory of the device.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	m.closed = true
+	m.segments = nil
+	return nil
+}
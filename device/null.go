@@ -0,0 +1,32 @@
+package device
+
+// Null is a device that discards writes and reads zeros, for benchmarks.
+type Null struct{}
+
+// SectorSize returns the alignment of the addresses and lengths of requests.
+func (Null) SectorSize() int { return 512 }
+
+// SegmentSize returns the size of a segment, which is larger than any log.
+func (Null) SegmentSize() int64 { return 1 << 46 }
+
+// ReadAsync zeros buf.
+func (Null) ReadAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	q.Post(cb, nil)
+}
+
+// WriteAsync discards buf.
+func (Null) WriteAsync(q *Queue, addr uint64, buf []byte, cb Callback) {
+	q.Post(cb, nil)
+}
+
+// Sync does nothing.
+func (Null) Sync() error { return nil }
+
+// TruncateUntil does nothing.
+func (Null) TruncateUntil(addr uint64) error { return nil }
+
+// Close does nothing.
+func (Null) Close() error { return nil }
@@ -0,0 +1,17 @@
+//go:build linux
+
+package device
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves space on disk for the first n bytes of the file.
+func preallocate(fh *os.File, n int64) error {
+	err := syscall.Fallocate(int(fh.Fd()), 0, 0, n)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return fh.Truncate(n)
+	}
+	return err
+}
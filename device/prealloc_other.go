@@ -0,0 +1,10 @@
+//go:build !linux
+
+package device
+
+import "os"
+
+// preallocate extends the file to n bytes.
+func preallocate(fh *os.File, n int64) error {
+	return fh.Truncate(n)
+}
@@ -0,0 +1,97 @@
+package device
+
+import (
+	"sync"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// completion is a callback along with the result to call it with.
+type completion struct {
+	cb  Callback
+	err error
+}
+
+// Queue collects the callbacks of finished requests until a handle completes
+// them. The zero value is ready to use, and it is typical to have one queue per
+// handle so that callbacks run on the handle that issued the request.
+type Queue struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	issued  int // the number of requests that have not been completed
+	results []completion
+}
+
+// issue records that a request was issued.
+func (q *Queue) issue() {
+	q.mu.Lock()
+	q.issued++
+	q.mu.Unlock()
+}
+
+// Post issues a request that has already finished with the error, so that
+// devices wrapping others can report failures through the queue.
+func (q *Queue) Post(cb Callback, err error) {
+	q.issue()
+	q.done(cb, err)
+}
+
+// done records that a request finished, waking any waiting handle.
+func (q *Queue) done(cb Callback, err error) {
+	q.mu.Lock()
+	q.results = append(q.results, completion{cb: cb, err: err})
+	if q.cond.L == nil {
+		q.cond.L = &q.mu
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Pending returns the number of requests that have not been completed.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.issued
+}
+
+// Complete runs the callbacks of every finished request with the handle
+// protected, and returns the number it ran. If wait is true, it blocks until
+// every issued request has been completed, including requests issued by the
+// callbacks. If the handle is already protected, it remains protected, and
+// wait should be false so that the epoch is not held while blocking.
+func (q *Queue) Complete(h epoch.Handle, wait bool) int {
+	protected := epoch.IsProtected(h)
+
+	n := 0
+	for {
+		q.mu.Lock()
+		if q.cond.L == nil {
+			q.cond.L = &q.mu
+		}
+		for wait && q.issued > 0 && len(q.results) == 0 {
+			q.cond.Wait()
+		}
+		results := q.results
+		q.results = nil
+		q.issued -= len(results)
+		q.mu.Unlock()
+
+		if len(results) == 0 {
+			return n
+		}
+
+		if !protected {
+			epoch.Protect(h)
+		}
+		for _, res := range results {
+			if res.cb != nil {
+				res.cb(h, res.err)
+			}
+		}
+		if !protected {
+			epoch.Unprotect(h)
+		}
+
+		n += len(results)
+	}
+}
@@ -24,14 +24,25 @@ func (h Handle) String() string { return fmt.Sprintf("{id:%d}", h.Id()) }
 // Id returns a numeric id that uniquely identifies the handle.
 func (h Handle) Id() uint32 { return h.id }
 
-// AcquireHandle acquires a unique Handle for the thread.
+// AcquireHandle acquires a unique Handle for the thread. It panics if every
+// handle is in use.
 func AcquireHandle() Handle {
+	h, ok := TryAcquireHandle()
+	if !ok {
+		panic("too many thread handles")
+	}
+	return h
+}
+
+// TryAcquireHandle is like AcquireHandle, but returns false instead of
+// panicking if every handle is in use.
+func TryAcquireHandle() (Handle, bool) {
 	start := atomic.AddUint32(&handleData.next, 1)
 	end := start + machine.MaxThreads*2
 
 retry:
 	if start == end {
-		panic("too many thread handles")
+		return Handle{}, false
 	}
 	id := start % machine.MaxThreads
 
@@ -40,7 +51,7 @@ retry:
 		goto retry
 	}
 
-	return Handle{id: id}
+	return Handle{id: id}, true
 }
 
 // ReleaseHandle releases the handle for the thread, letting it be used by other threads.
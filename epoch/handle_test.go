@@ -2,8 +2,33 @@ package epoch
 
 import (
 	"testing"
+
+	"github.com/zeebo/gofaster/internal/assert"
+	"github.com/zeebo/gofaster/internal/machine"
 )
 
+func TestHandle(t *testing.T) {
+	// take every free handle, after which no more can be acquired.
+	var hs []Handle
+	for {
+		h, ok := TryAcquireHandle()
+		if !ok {
+			break
+		}
+		hs = append(hs, h)
+	}
+	assert.That(t, len(hs) > 0 && len(hs) <= machine.MaxThreads)
+
+	ReleaseHandle(hs[0])
+	h, ok := TryAcquireHandle()
+	assert.That(t, ok)
+	assert.Equal(t, h, hs[0])
+
+	for _, h := range hs {
+		ReleaseHandle(h)
+	}
+}
+
 func BenchmarkHandle(b *testing.B) {
 	b.ReportAllocs()
 
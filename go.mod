@@ -1,5 +1,7 @@
 module github.com/zeebo/gofaster
 
+go 1.18
+
 require (
 	github.com/OneOfOne/xxhash v1.2.2 // indirect
 	github.com/cespare/xxhash v1.0.0
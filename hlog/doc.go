@@ -0,0 +1,15 @@
+// package hlog provides a hybrid log: an append-only log of records addressed
+// by their logical offset, where the most recent pages live in a circular
+// buffer of memory. The log is split into regions by offsets that only move
+// forward:
+//
+//	begin <= head <= read only <= tail
+//
+// Records at or after the read only offset are mutable and may be updated in
+// place. Records between head and read only are immutable, so updating them
+// requires appending a new copy. Records before head are no longer in memory,
+// and records before begin have been discarded from the device.
+// Offsets are advanced with the epoch system so that every handle that could
+// have observed an old offset has left its protected region before the memory
+// it protects is reused.
+package hlog
@@ -0,0 +1,122 @@
+package hlog
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// Flushed returns the address before which every page has been written to the
+// device.
+func (l *Log) Flushed() Address { return Address(atomic.LoadUint64(&l.flushed)) }
+
+// failure wraps an error so that it can be stored in an atomic.Value.
+type failure struct{ err error }
+
+// err returns the first error writing a page, if any.
+func (l *Log) err() error {
+	if f, ok := l.failed.Load().(failure); ok {
+		return f.err
+	}
+	return nil
+}
+
+// flush issues writes for every whole page before the address that has not had
+// one issued. Every handle must have observed the pages as read only.
+func (l *Log) flush(addr uint64) {
+	if l.device == nil {
+		return
+	}
+
+	end := addr >> l.pageBits
+	start := atomic.LoadUint64(&l.flushing)
+	for {
+		if start >= end {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&l.flushing, start, end) {
+			break
+		}
+		start = atomic.LoadUint64(&l.flushing)
+	}
+
+	for page := start; page < end; page++ {
+		page := page
+		frame := l.frames[page&uint64(len(l.frames)-1)]
+		l.device.WriteAsync(&l.queue, page<<l.pageBits, frame, func(h epoch.Handle, err error) {
+			l.wrote(page, err)
+		})
+	}
+}
+
+// wrote records that the page was written, advancing the flushed address past
+// every page that has been written in order.
+func (l *Log) wrote(page uint64, err error) {
+	if err != nil {
+		l.failed.CompareAndSwap(nil, failure{err})
+		return
+	}
+
+	mask := uint64(len(l.frames) - 1)
+	atomic.StoreUint64(&l.written[page&mask], page+1)
+
+	for {
+		flushed := atomic.LoadUint64(&l.flushed)
+		next := flushed >> l.pageBits
+		if atomic.LoadUint64(&l.written[next&mask]) != next+1 {
+			return
+		}
+		atomic.CompareAndSwapUint64(&l.flushed, flushed, flushed+l.pageSize)
+	}
+}
+
+// pad moves the tail to the start of the next page, leaving the rest of the
+// current page as padding, and returns the new tail.
+func (l *Log) pad() uint64 {
+	for {
+		tail := atomic.LoadUint64(&l.tail)
+		if tail&(l.pageSize-1) == 0 {
+			return tail
+		}
+		next := (tail>>l.pageBits + 1) << l.pageBits
+		if atomic.CompareAndSwapUint64(&l.tail, tail, next) {
+			return next
+		}
+	}
+}
+
+// Flush makes every record allocated before it was called read only, and waits
+// until they have been written to the device and synced. The rest of the page at
+// the tail is left as padding so that only whole pages are written. It returns
+// the address before which every record is durable. For a log opened by
+// OpenMapped, the frames are synced to its file instead, and the address is
+// recorded in its header. The handle must not be protected, and Flush waits for
+// every other handle to refresh its epoch.
+func (l *Log) Flush(h epoch.Handle) (Address, error) {
+	if l.mapping != nil {
+		return l.flushMapped(h)
+	}
+	if l.device == nil {
+		return 0, ErrNoDevice
+	}
+
+	epoch.Protect(h)
+	tail := l.pad()
+	l.ShiftReadOnly(h, Address(tail))
+	epoch.Unprotect(h)
+
+	for {
+		epoch.ProtectAndDrain(h)
+		l.queue.Complete(h, false)
+		epoch.Unprotect(h)
+
+		if err := l.err(); err != nil {
+			return 0, err
+		}
+		if l.Flushed() >= Address(tail) {
+			return Address(tail), l.device.Sync()
+		}
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,131 @@
+package hlog
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/risky"
+)
+
+// Iterator reads the valid records of a log in address order, from its device
+// or from memory.
+type Iterator struct {
+	l    *Log
+	h    epoch.Handle
+	next uint64 // the address of the next header
+	end  uint64
+
+	page uint64 // 1 + the page held in buf
+	buf  []byte
+	addr Address
+	rec  []byte
+	err  error
+}
+
+// Iterate returns an iterator over the records between the offsets, which must
+// be before the safe read only offset so that they are no longer changing. The
+// begin offset must be where a record was allocated, such as the tail or the
+// begin of the log at some point. Pages before the head are read from the
+// device, and the rest are copied from memory. The handle is used to wait for
+// reads and to protect pages while copying them, and must not be protected
+// while calling Next.
+func (l *Log) Iterate(h epoch.Handle, begin, end Address) *Iterator {
+	return &Iterator{l: l, h: h, next: uint64(begin), end: uint64(end)}
+}
+
+// Next advances the iterator to the next valid record, and returns false when
+// there are no more records or there was an error.
+func (it *Iterator) Next() bool {
+	l := it.l
+	for it.err == nil && it.next+headerSize < it.end {
+		page, off := it.next>>l.pageBits, it.next&(l.pageSize-1)
+		if off+headerSize > l.pageSize {
+			it.next = (page + 1) << l.pageBits
+			continue
+		}
+		if it.page != page+1 && !it.read(page) {
+			return false
+		}
+
+		hdr := *(*uint64)(unsafe.Pointer(&it.buf[off]))
+		size := uint64(uint32(hdr))
+		if size == 0 {
+			it.next = (page + 1) << l.pageBits
+			continue
+		}
+		if off+headerSize+size > l.pageSize {
+			it.err = ErrInvalid
+			return false
+		}
+
+		it.addr = Address(it.next + headerSize)
+		it.rec = it.buf[off+headerSize : off+headerSize+size]
+		it.next += headerSize + size
+		if hdr&flagInvalid == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// read loads the page from memory if it is still there, or from the device.
+func (it *Iterator) read(page uint64) bool {
+	l := it.l
+	if it.buf == nil {
+		it.buf = risky.Alloc8(int(l.pageSize))
+	}
+
+	// the frame is not reused until every handle that observed the page after
+	// the head has left its protected region. only the part before the end is
+	// copied, as the rest may still be changing.
+	start := page << l.pageBits
+	epoch.Protect(it.h)
+	if start >= atomic.LoadUint64(&l.head) {
+		n := copy(it.buf, l.frames[page&uint64(len(l.frames)-1)][:it.limit(start)])
+		epoch.Unprotect(it.h)
+		for i := n; i < len(it.buf); i++ {
+			it.buf[i] = 0
+		}
+		it.page = page + 1
+		return true
+	}
+	epoch.Unprotect(it.h)
+
+	if l.device == nil {
+		it.err = ErrNoDevice
+		return false
+	}
+
+	var q device.Queue
+	l.device.ReadAsync(&q, start, it.buf, func(h epoch.Handle, err error) {
+		it.err = err
+	})
+	q.Complete(it.h, true)
+
+	if it.err != nil {
+		return false
+	}
+	it.page = page + 1
+	return true
+}
+
+// limit returns how many bytes of the page starting at the address are before
+// the end of the iterator.
+func (it *Iterator) limit(start uint64) uint64 {
+	if it.end-start < it.l.pageSize {
+		return it.end - start
+	}
+	return it.l.pageSize
+}
+
+// Address returns the address of the current record.
+func (it *Iterator) Address() Address { return it.addr }
+
+// Record returns the current record, which is 8 byte aligned and only valid
+// until the next call to Next.
+func (it *Iterator) Record() []byte { return it.rec }
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error { return it.err }
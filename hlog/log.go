@@ -0,0 +1,388 @@
+package hlog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/risky"
+)
+
+// Address is the logical offset of a record in the log. Addresses are always
+// positive, so the zero Address is invalid.
+type Address uint64
+
+// InvalidAddress is never returned by Allocate.
+const InvalidAddress Address = 0
+
+// every allocation is preceded by a header containing the size of the record
+// and some flags. a header of zero is padding until the end of the page.
+const (
+	headerSize  = 8
+	flagInvalid = 1 << 32
+)
+
+var (
+	// ErrAgain is returned by Allocate when the tail is moving to a page that
+	// is not yet available. The handle should leave its protected region, or
+	// refresh it, before retrying.
+	ErrAgain = errors.New("hlog: tail is waiting for a page")
+
+	// ErrFull is returned by Allocate when there is no memory for a new page
+	// and older pages cannot be evicted.
+	ErrFull = errors.New("hlog: log is full")
+
+	// ErrTooLarge is returned by Allocate when the record cannot fit in a page.
+	ErrTooLarge = errors.New("hlog: record larger than a page")
+)
+
+// Config describes the shape of a log.
+type Config struct {
+	// PageBits is the log of the size of a page in bytes. The default is 20.
+	PageBits uint
+
+	// MemoryPages is the number of pages kept in memory, which must be a power
+	// of two. The default is 16.
+	MemoryPages int
+
+	// MutablePages is the number of pages at the tail of the log that are
+	// mutable. It must be less than MemoryPages, and the default is half of
+	// MemoryPages.
+	MutablePages int
+
+	// Device is where pages are written once they are read only. If it is
+	// set, the head is shifted automatically once pages are written, and
+	// records before it can be read with ReadAsync. Otherwise, allocations fail
+	// with ErrFull once every page is in use. Pages must be a multiple of its
+	// sector size, and its segments a multiple of the page size.
+	Device device.Device
+}
+
+// Log is a hybrid log.
+type Log struct {
+	pageBits uint
+	pageSize uint64
+	frames   [][]byte
+	mutable  uint64
+	closing  sync.Mutex // serializes the reuse of frames
+
+	device   device.Device
+	queue    device.Queue // completes the writes of pages
+	written  []uint64     // 1 + the page most recently written from each frame
+	flushing uint64       // the page after the last one a write was issued for
+	flushed  uint64       // the address before which every page is written
+	failed   atomic.Value // the first error writing a page
+	mapping  *mapping     // the file holding the frames, if any
+
+	begin        uint64
+	head         uint64
+	safeHead     uint64
+	readOnly     uint64
+	safeReadOnly uint64
+	tail         uint64
+}
+
+// New constructs a log with the configuration, allocating all of its memory.
+func New(cfg Config) (*Log, error) {
+	l, err := newLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for i := range l.frames {
+		l.frames[i] = risky.Alloc8(int(l.pageSize))
+	}
+	return l, nil
+}
+
+// newLog constructs a log with the configuration without any memory for its
+// frames.
+func newLog(cfg Config) (*Log, error) {
+	if cfg.PageBits == 0 {
+		cfg.PageBits = 20
+	}
+	if cfg.MemoryPages == 0 {
+		cfg.MemoryPages = 16
+	}
+	if cfg.MutablePages == 0 {
+		cfg.MutablePages = cfg.MemoryPages / 2
+	}
+
+	switch {
+	case cfg.PageBits < 6 || cfg.PageBits > 30:
+		return nil, fmt.Errorf("hlog: invalid page bits: %d", cfg.PageBits)
+	case cfg.MemoryPages < 2 || cfg.MemoryPages&(cfg.MemoryPages-1) != 0:
+		return nil, fmt.Errorf("hlog: invalid memory pages: %d", cfg.MemoryPages)
+	case cfg.MutablePages < 1 || cfg.MutablePages >= cfg.MemoryPages:
+		return nil, fmt.Errorf("hlog: invalid mutable pages: %d", cfg.MutablePages)
+	case cfg.Device != nil && (1<<cfg.PageBits)%cfg.Device.SectorSize() != 0:
+		return nil, fmt.Errorf("hlog: page size not a multiple of sector size: %d", cfg.Device.SectorSize())
+	case cfg.Device != nil && cfg.Device.SegmentSize()%(1<<cfg.PageBits) != 0:
+		return nil, fmt.Errorf("hlog: segment size not a multiple of page size: %d", cfg.Device.SegmentSize())
+	}
+
+	l := &Log{
+		pageBits: cfg.PageBits,
+		pageSize: 1 << cfg.PageBits,
+		frames:   make([][]byte, cfg.MemoryPages),
+		mutable:  uint64(cfg.MutablePages),
+		device:   cfg.Device,
+		written:  make([]uint64, cfg.MemoryPages),
+	}
+	return l, nil
+}
+
+// Open is like New, but continues a log whose records between begin and tail
+// are already on the device, such as one that was flushed before the process
+// restarted. The tail must be at the start of a page, and new records are
+// allocated after it.
+func Open(cfg Config, begin, tail Address) (*Log, error) {
+	l, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case l.device == nil:
+		return nil, ErrNoDevice
+	case uint64(tail)&(l.pageSize-1) != 0 || begin > tail:
+		return nil, fmt.Errorf("hlog: invalid tail: %d", tail)
+	}
+
+	l.begin = uint64(begin)
+	l.head, l.safeHead = uint64(tail), uint64(tail)
+	l.readOnly, l.safeReadOnly = uint64(tail), uint64(tail)
+	l.tail, l.flushed = uint64(tail), uint64(tail)
+	l.flushing = uint64(tail) >> l.pageBits
+	return l, nil
+}
+
+// PageSize returns the number of bytes in a page.
+func (l *Log) PageSize() int { return int(l.pageSize) }
+
+// MaxSize returns the number of bytes in the largest record that fits in a page.
+func (l *Log) MaxSize() int { return int(l.pageSize - headerSize) }
+
+// Begin returns the address of the start of the log.
+func (l *Log) Begin() Address { return Address(atomic.LoadUint64(&l.begin)) }
+
+// Head returns the address of the first record in memory.
+func (l *Log) Head() Address { return Address(atomic.LoadUint64(&l.head)) }
+
+// SafeHead returns the head that every handle has observed.
+func (l *Log) SafeHead() Address { return Address(atomic.LoadUint64(&l.safeHead)) }
+
+// ReadOnly returns the address of the first mutable record.
+func (l *Log) ReadOnly() Address { return Address(atomic.LoadUint64(&l.readOnly)) }
+
+// SafeReadOnly returns the read only offset that every handle has observed.
+// No handle is modifying records before it.
+func (l *Log) SafeReadOnly() Address { return Address(atomic.LoadUint64(&l.safeReadOnly)) }
+
+// Tail returns the address where the next record will be allocated.
+func (l *Log) Tail() Address { return Address(atomic.LoadUint64(&l.tail)) }
+
+// Mutable returns true if the record at the address may be modified in place.
+// If it returns true, the record remains mutable until the handle leaves its
+// protected region.
+func (l *Log) Mutable(addr Address) bool {
+	return uint64(addr) >= atomic.LoadUint64(&l.readOnly)
+}
+
+// InMemory returns true if the record at the address is in memory. If it
+// returns true, the record remains in memory until the handle leaves its
+// protected region.
+func (l *Log) InMemory(addr Address) bool {
+	return uint64(addr) >= atomic.LoadUint64(&l.head)
+}
+
+// pointer returns a pointer to the memory at the address. The page holding
+// it must be in memory.
+func (l *Log) pointer(addr uint64) unsafe.Pointer {
+	frame := l.frames[(addr>>l.pageBits)&uint64(len(l.frames)-1)]
+	return unsafe.Pointer(&frame[addr&(l.pageSize-1)])
+}
+
+// header returns a pointer to the header for the record at the address.
+func (l *Log) header(addr Address) *uint64 {
+	return (*uint64)(l.pointer(uint64(addr) - headerSize))
+}
+
+// Get returns a pointer to the record at the address. The address must have
+// been returned by Allocate and be at least Head, and the pointer is only
+// valid while the handle remains protected.
+func (l *Log) Get(addr Address) unsafe.Pointer {
+	return l.pointer(uint64(addr))
+}
+
+// Size returns the size of the record at the address, rounded up to a
+// multiple of 8 bytes.
+func (l *Log) Size(addr Address) int {
+	return int(uint32(atomic.LoadUint64(l.header(addr))))
+}
+
+// Invalidate marks the record at the address as invalid, for records that were
+// allocated but never used.
+func (l *Log) Invalidate(addr Address) {
+	hdr := l.header(addr)
+	for {
+		old := atomic.LoadUint64(hdr)
+		if atomic.CompareAndSwapUint64(hdr, old, old|flagInvalid) {
+			return
+		}
+	}
+}
+
+// Valid returns true if the record at the address has not been invalidated.
+func (l *Log) Valid(addr Address) bool {
+	return atomic.LoadUint64(l.header(addr))&flagInvalid == 0
+}
+
+// Allocate reserves space for a record of n bytes at the tail of the log and
+// returns its address. The memory is zeroed and 8 byte aligned. The handle must
+// be protected, and the record must be written before the handle leaves its
+// protected region.
+func (l *Log) Allocate(h epoch.Handle, n int) (Address, error) {
+	size := headerSize + (uint64(n)+7)&^7
+	if n < 0 || size > l.pageSize {
+		return 0, ErrTooLarge
+	}
+
+	for {
+		tail := atomic.LoadUint64(&l.tail)
+		off := tail & (l.pageSize - 1)
+
+		if off == 0 {
+			if err := l.ready(h, tail>>l.pageBits); err != nil {
+				return 0, err
+			}
+		}
+
+		// if the record doesn't fit, leave the rest of the page zero, which
+		// marks it as padding, and move on to the next page.
+		if off+size > l.pageSize {
+			next := (tail>>l.pageBits + 1) << l.pageBits
+			atomic.CompareAndSwapUint64(&l.tail, tail, next)
+			continue
+		}
+
+		if atomic.CompareAndSwapUint64(&l.tail, tail, tail+size) {
+			atomic.StoreUint64((*uint64)(l.pointer(tail)), size-headerSize)
+			return Address(tail + headerSize), nil
+		}
+	}
+}
+
+// ready checks if the frame for the page is available to be allocated into,
+// shifting the read only offset so that only the configured number of pages
+// at the tail are mutable.
+func (l *Log) ready(h epoch.Handle, page uint64) error {
+	if page > l.mutable {
+		l.ShiftReadOnly(h, Address((page-l.mutable)<<l.pageBits))
+	}
+
+	// the frame was last used by the page len(frames) earlier, which must have
+	// been evicted.
+	frames := uint64(len(l.frames))
+	if page < frames {
+		return nil
+	}
+	need := (page - frames + 1) << l.pageBits
+	switch {
+	case need <= atomic.LoadUint64(&l.safeHead):
+		return nil
+	case need <= atomic.LoadUint64(&l.head):
+		return ErrAgain
+	case l.device == nil:
+		return ErrFull
+	}
+
+	// evict the page once it has been written, which happens after every
+	// handle has observed it as read only.
+	l.queue.Complete(h, false)
+	if err := l.err(); err != nil {
+		return err
+	}
+	l.ShiftHead(h, Address(need))
+	return ErrAgain
+}
+
+// ShiftReadOnly makes every record before the address immutable. Once every
+// handle has observed the new offset, the safe read only offset is advanced.
+func (l *Log) ShiftReadOnly(h epoch.Handle, addr Address) {
+	if atomicMax(&l.readOnly, uint64(addr)) {
+		epoch.BumpWith(h, func(epoch.Handle) {
+			atomicMax(&l.safeReadOnly, uint64(addr))
+			l.flush(uint64(addr))
+		})
+	}
+}
+
+// ShiftHead evicts every record before the address from memory, limited to
+// the safe read only offset so that no handle is modifying them, and to the
+// pages written to the device if there is one. Once every
+// handle has observed the new head, the memory for pages before it is zeroed
+// and reused for new pages at the tail.
+func (l *Log) ShiftHead(h epoch.Handle, addr Address) {
+	if ro := l.SafeReadOnly(); addr > ro {
+		addr = ro
+	}
+	if fl := l.Flushed(); l.device != nil && addr > fl {
+		addr = fl
+	}
+	if atomicMax(&l.head, uint64(addr)) {
+		epoch.BumpWith(h, func(epoch.Handle) { l.close(uint64(addr)) })
+	}
+}
+
+// ShiftBegin discards every record before the address, limited to the head so
+// that none of them are in memory. Once every handle has observed the new begin,
+// the segments of the device entirely before it are truncated, and an error
+// doing so is returned by the next Flush.
+func (l *Log) ShiftBegin(h epoch.Handle, addr Address) {
+	if hd := l.Head(); addr > hd {
+		addr = hd
+	}
+	if atomicMax(&l.begin, uint64(addr)) && l.device != nil {
+		epoch.BumpWith(h, func(epoch.Handle) {
+			if err := l.device.TruncateUntil(uint64(addr)); err != nil {
+				l.failed.CompareAndSwap(nil, failure{err})
+			}
+		})
+	}
+}
+
+// close zeros the frames of every page before the address and advances the safe
+// head so that they can be reused.
+func (l *Log) close(addr uint64) {
+	l.closing.Lock()
+	defer l.closing.Unlock()
+
+	old := atomic.LoadUint64(&l.safeHead)
+	if addr <= old {
+		return
+	}
+	for page := old >> l.pageBits; page < addr>>l.pageBits; page++ {
+		frame := l.frames[page&uint64(len(l.frames)-1)]
+		for i := range frame {
+			frame[i] = 0
+		}
+	}
+	atomic.StoreUint64(&l.safeHead, addr)
+}
+
+// atomicMax atomically sets the value at addr to v if it is larger, and returns
+// true if it did.
+func atomicMax(addr *uint64, v uint64) bool {
+	for {
+		old := atomic.LoadUint64(addr)
+		if v <= old {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(addr, old, v) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package hlog
+
+import (
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestLog(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	newLog := func(t *testing.T) *Log {
+		l, err := New(Config{PageBits: 8, MemoryPages: 4, MutablePages: 2})
+		assert.NoError(t, err)
+		return l
+	}
+
+	t.Run("Config", func(t *testing.T) {
+		_, err := New(Config{MemoryPages: 3})
+		assert.Error(t, err)
+		_, err = New(Config{MemoryPages: 4, MutablePages: 4})
+		assert.Error(t, err)
+		_, err = New(Config{PageBits: 40})
+		assert.Error(t, err)
+	})
+
+	t.Run("Allocate", func(t *testing.T) {
+		l := newLog(t)
+		epoch.Protect(h)
+		defer epoch.Unprotect(h)
+
+		addr, err := l.Allocate(h, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, addr, Address(headerSize))
+		assert.Equal(t, l.Size(addr), 8)
+		assert.Equal(t, l.Tail(), Address(16))
+		assert.That(t, l.Valid(addr))
+		assert.That(t, l.Mutable(addr))
+		assert.That(t, l.InMemory(addr))
+
+		*(*uint64)(l.Get(addr)) = 10
+		l.Invalidate(addr)
+		assert.That(t, !l.Valid(addr))
+		assert.Equal(t, l.Size(addr), 8)
+		assert.Equal(t, *(*uint64)(l.Get(addr)), uint64(10))
+
+		_, err = l.Allocate(h, 256)
+		assert.Equal(t, err, ErrTooLarge)
+
+		// records that don't fit move to the next page
+		addr, err = l.Allocate(h, 240)
+		assert.NoError(t, err)
+		assert.Equal(t, addr, Address(256+headerSize))
+	})
+
+	t.Run("Regions", func(t *testing.T) {
+		l := newLog(t)
+		epoch.Protect(h)
+
+		// fill all four pages with one record each
+		var addrs []Address
+		for i := 0; i < 4; i++ {
+			addr, err := l.Allocate(h, 200)
+			assert.NoError(t, err)
+			addrs = append(addrs, addr)
+		}
+
+		// only the last two pages are mutable
+		assert.Equal(t, l.ReadOnly(), Address(256))
+		assert.That(t, !l.Mutable(addrs[0]))
+		assert.That(t, l.Mutable(addrs[2]))
+
+		// there is no room for a fifth page until the head moves
+		_, err := l.Allocate(h, 200)
+		assert.Equal(t, err, ErrFull)
+
+		// the head is limited to the safe read only offset, which waits for
+		// the handle to leave.
+		l.ShiftHead(h, 512)
+		assert.Equal(t, l.Head(), Address(0))
+		epoch.Unprotect(h)
+		epoch.ProtectAndDrain(h)
+		assert.Equal(t, l.SafeReadOnly(), Address(512))
+
+		l.ShiftHead(h, 512)
+		assert.Equal(t, l.Head(), Address(512))
+		assert.That(t, !l.InMemory(addrs[1]))
+		assert.That(t, l.InMemory(addrs[2]))
+
+		// the memory is reused after the handle leaves
+		_, err = l.Allocate(h, 200)
+		assert.Equal(t, err, ErrAgain)
+		epoch.Unprotect(h)
+		epoch.ProtectAndDrain(h)
+		assert.Equal(t, l.SafeHead(), Address(512))
+
+		addr, err := l.Allocate(h, 200)
+		assert.NoError(t, err)
+		assert.Equal(t, addr, Address(1024+headerSize))
+		assert.Equal(t, *(*[200]byte)(l.Get(addr)), [200]byte{})
+		epoch.Unprotect(h)
+	})
+
+	t.Run("Device", func(t *testing.T) {
+		d, err := device.NewMemory(device.Config{SegmentBits: 12})
+		assert.NoError(t, err)
+		l, err := New(Config{PageBits: 9, MemoryPages: 4, MutablePages: 2, Device: d})
+		assert.NoError(t, err)
+
+		// allocating past the memory pages evicts pages once they are written.
+		// some records are too large to be read at once.
+		size := func(i int) int { return 100 + i%4*100 }
+
+		var addrs []Address
+		epoch.Protect(h)
+		for i := 0; i < 64; i++ {
+			addr, err := l.Allocate(h, size(i))
+			for err == ErrAgain {
+				epoch.Unprotect(h)
+				epoch.ProtectAndDrain(h)
+				addr, err = l.Allocate(h, size(i))
+			}
+			assert.NoError(t, err)
+			*(*uint64)(l.Get(addr)) = uint64(i)
+			addrs = append(addrs, addr)
+		}
+		epoch.Unprotect(h)
+
+		assert.That(t, l.Head() > 0)
+		assert.That(t, l.Head() <= l.Flushed())
+		assert.That(t, !l.InMemory(addrs[0]))
+
+		var q device.Queue
+		for i, addr := range addrs {
+			if l.InMemory(addr) {
+				break
+			}
+			l.ReadAsync(&q, addr, func(h epoch.Handle, rec []byte, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, len(rec), (size(i)+7)&^7)
+				assert.Equal(t, *(*uint64)(unsafe.Pointer(&rec[0])), uint64(i))
+			})
+			assert.Equal(t, q.Complete(h, true), 1)
+		}
+
+		// iterating reads the pages before the head from the device and copies
+		// the rest from memory.
+		var n int
+		it := l.Iterate(h, 0, l.SafeReadOnly())
+		for it.Next() {
+			assert.Equal(t, it.Address(), addrs[n])
+			assert.Equal(t, *(*uint64)(unsafe.Pointer(&it.Record()[0])), uint64(n))
+			n++
+		}
+		assert.NoError(t, it.Err())
+		assert.That(t, l.InMemory(addrs[n-1]))
+
+		// shifting the begin is limited to the head, and truncates the device
+		// once every handle has observed it.
+		epoch.Protect(h)
+		l.ShiftBegin(h, l.Tail())
+		epoch.Unprotect(h)
+		epoch.ProtectAndDrain(h)
+		epoch.Unprotect(h)
+		assert.Equal(t, l.Begin(), l.Head())
+
+		l.ReadAsync(&q, addrs[0], func(h epoch.Handle, rec []byte, err error) {
+			assert.Equal(t, err, device.ErrTruncated)
+		})
+		assert.Equal(t, q.Complete(h, true), 1)
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		d, err := device.NewMemory(device.Config{SegmentBits: 12})
+		assert.NoError(t, err)
+		cfg := Config{PageBits: 9, MemoryPages: 4, Device: d}
+		l, err := New(cfg)
+		assert.NoError(t, err)
+
+		epoch.Protect(h)
+		var addrs []Address
+		for i := 0; i < 10; i++ {
+			addr, err := l.Allocate(h, 100)
+			assert.NoError(t, err)
+			*(*uint64)(l.Get(addr)) = uint64(i)
+			addrs = append(addrs, addr)
+		}
+		l.Invalidate(addrs[3])
+		epoch.Unprotect(h)
+
+		tail, err := l.Flush(h)
+		assert.NoError(t, err)
+		assert.Equal(t, tail, Address(1536))
+		assert.Equal(t, l.Tail(), tail)
+		assert.Equal(t, l.Flushed(), tail)
+
+		// a log opened from the device continues after the tail, and iterating
+		// it finds every valid record.
+		l, err = Open(cfg, 0, tail)
+		assert.NoError(t, err)
+
+		var got []Address
+		it := l.Iterate(h, 0, tail)
+		for it.Next() {
+			want := len(got)
+			if want >= 3 {
+				want++
+			}
+			assert.Equal(t, len(it.Record()), 104)
+			assert.Equal(t, *(*uint64)(unsafe.Pointer(&it.Record()[0])), uint64(want))
+			got = append(got, it.Address())
+		}
+		assert.NoError(t, it.Err())
+		assert.DeepEqual(t, got, append(addrs[:3:3], addrs[4:]...))
+
+		epoch.Protect(h)
+		addr, err := l.Allocate(h, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, addr, tail+headerSize)
+		epoch.Unprotect(h)
+	})
+
+	t.Run("Mapped", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("mapped logs are only supported on linux")
+		}
+
+		path := filepath.Join(t.TempDir(), "log")
+		cfg := Config{PageBits: 9, MemoryPages: 4}
+		l, err := OpenMapped(path, cfg)
+		assert.NoError(t, err)
+
+		epoch.Protect(h)
+		for i := 0; i < 10; i++ {
+			addr, err := l.Allocate(h, 100)
+			assert.NoError(t, err)
+			*(*uint64)(l.Get(addr)) = uint64(i)
+		}
+		epoch.Unprotect(h)
+
+		tail, err := l.Flush(h)
+		assert.NoError(t, err)
+		assert.Equal(t, tail, l.Tail())
+
+		// records allocated after the flush are discarded on restart.
+		epoch.Protect(h)
+		addr, err := l.Allocate(h, 100)
+		assert.NoError(t, err)
+		*(*uint64)(l.Get(addr)) = 10
+		epoch.Unprotect(h)
+		assert.NoError(t, l.Close())
+		assert.Equal(t, l.Close(), ErrClosed)
+
+		_, err = OpenMapped(path, Config{PageBits: 10, MemoryPages: 4})
+		assert.Error(t, err)
+
+		l, err = OpenMapped(path, cfg)
+		assert.NoError(t, err)
+		defer func() { assert.NoError(t, l.Close()) }()
+		assert.Equal(t, l.Tail(), tail)
+		assert.Equal(t, l.Begin(), Address(0))
+
+		var n int
+		it := l.Iterate(h, 0, tail)
+		for it.Next() {
+			assert.Equal(t, *(*uint64)(unsafe.Pointer(&it.Record()[0])), uint64(n))
+			n++
+		}
+		assert.NoError(t, it.Err())
+		assert.Equal(t, n, 10)
+
+		epoch.Protect(h)
+		again, err := l.Allocate(h, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, again, addr)
+		assert.Equal(t, *(*uint64)(l.Get(again)), uint64(0))
+		epoch.Unprotect(h)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		l, err := New(Config{PageBits: 12, MemoryPages: 64})
+		assert.NoError(t, err)
+
+		const (
+			workers = 8
+			iters   = 1000
+		)
+
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			addrs = make(map[Address]uint64)
+		)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for i := 0; i < iters; i++ {
+					epoch.Protect(h)
+					addr, err := l.Allocate(h, 8+w)
+					assert.NoError(t, err)
+					val := uint64(w*iters + i)
+					*(*uint64)(l.Get(addr)) = val
+					epoch.Unprotect(h)
+
+					mu.Lock()
+					addrs[addr] = val
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		assert.Equal(t, len(addrs), workers*iters)
+		for addr, val := range addrs {
+			assert.Equal(t, *(*uint64)(l.Get(addr)), val)
+			assert.That(t, uintptr(l.Get(addr))%unsafe.Alignof(val) == 0)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package hlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// ErrClosed is returned when flushing a mapped log that has been closed.
+var ErrClosed = errors.New("hlog: log closed")
+
+// a mapped log is a file holding a header followed by every frame in order. the
+// header is padded to the size of an operating system page so that the frames
+// are aligned.
+const (
+	mappedMagic      = 0x676f6c6670616d68 // "hmapflog"
+	mappedVersion    = 1
+	mappedHeaderSize = 4096
+)
+
+// mappedHeader is at the start of a mapped log, in native byte order.
+type mappedHeader struct {
+	Magic    uint64
+	Version  uint64
+	PageBits uint64
+	Pages    uint64 // the number of frames
+	Begin    uint64
+	Head     uint64
+	Tail     uint64 // every record before Tail was flushed
+}
+
+// mapping is the memory map of the file holding the frames of a log.
+type mapping struct {
+	mu   sync.Mutex // serializes flushing and closing
+	file *os.File
+	data []byte
+}
+
+// header returns the header at the start of the mapping.
+func (m *mapping) header() *mappedHeader {
+	return (*mappedHeader)(unsafe.Pointer(&m.data[0]))
+}
+
+// OpenMapped is like New, but places the frames of the log in a memory map of
+// the file at the path, which is created if it does not exist. A log opened from
+// an existing file continues after the tail recorded by its last Flush, and the
+// records before it remain in memory. The configuration must have no device,
+// and must have the same page bits and memory pages the file was created with.
+// Allocate returns ErrFull once every frame is in use. It is only supported on
+// linux.
+func OpenMapped(path string, cfg Config) (*Log, error) {
+	if cfg.Device != nil {
+		return nil, errors.New("hlog: mapped log with a device")
+	}
+	l, err := newLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m, err := l.open(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+	l.mapping = m
+	return l, nil
+}
+
+// open maps the file, initializing it if it is empty, and restores the offsets
+// of the log from its header.
+func (l *Log) open(fh *os.File) (*mapping, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int64(mappedHeaderSize) + int64(len(l.frames))*int64(l.pageSize)
+	fresh := fi.Size() == 0
+
+	switch {
+	case fresh:
+		if err := fh.Truncate(size); err != nil {
+			return nil, err
+		}
+	case fi.Size() != size:
+		return nil, fmt.Errorf("hlog: mapped log has size %d, expected %d", fi.Size(), size)
+	}
+
+	data, err := mmap(fh, int(size))
+	if err != nil {
+		return nil, err
+	}
+	m := &mapping{file: fh, data: data}
+	hdr := m.header()
+
+	if fresh {
+		*hdr = mappedHeader{
+			Magic:    mappedMagic,
+			Version:  mappedVersion,
+			PageBits: uint64(l.pageBits),
+			Pages:    uint64(len(l.frames)),
+		}
+		err = msync(data[:mappedHeaderSize])
+	} else {
+		err = l.check(hdr)
+	}
+	if err != nil {
+		_ = munmap(data)
+		return nil, err
+	}
+
+	for i := range l.frames {
+		off := mappedHeaderSize + uint64(i)*l.pageSize
+		l.frames[i] = data[off : off+l.pageSize : off+l.pageSize]
+	}
+
+	l.begin = hdr.Begin
+	l.head, l.safeHead = hdr.Head, hdr.Head
+	l.readOnly, l.safeReadOnly = hdr.Tail, hdr.Tail
+	l.tail = hdr.Tail
+
+	// records allocated after the last flush are discarded, and every frame
+	// not holding a page between the head and the tail must be zero.
+	mask := uint64(len(l.frames) - 1)
+	end := hdr.Head>>l.pageBits + uint64(len(l.frames))
+	for page := hdr.Tail >> l.pageBits; page < end; page++ {
+		frame := l.frames[page&mask]
+		start := uint64(0)
+		if page == hdr.Tail>>l.pageBits {
+			start = hdr.Tail & (l.pageSize - 1)
+		}
+		for i := start; i < l.pageSize; i++ {
+			frame[i] = 0
+		}
+	}
+
+	return m, nil
+}
+
+// check returns an error if the header is not for a log with the same shape.
+func (l *Log) check(hdr *mappedHeader) error {
+	switch {
+	case hdr.Magic != mappedMagic || hdr.Version != mappedVersion:
+		return errors.New("hlog: invalid mapped log header")
+	case hdr.PageBits != uint64(l.pageBits) || hdr.Pages != uint64(len(l.frames)):
+		return fmt.Errorf("hlog: mapped log has page bits %d and %d pages", hdr.PageBits, hdr.Pages)
+	case hdr.Begin > hdr.Head || hdr.Head > hdr.Tail ||
+		hdr.Tail-hdr.Head>>l.pageBits<<l.pageBits > uint64(len(l.frames))<<l.pageBits:
+		return errors.New("hlog: invalid mapped log offsets")
+	}
+	return nil
+}
+
+// flushMapped is Flush for a mapped log: once every record before the tail is
+// read only, it syncs the frames and then records the tail in the header.
+func (l *Log) flushMapped(h epoch.Handle) (Address, error) {
+	m := l.mapping
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		return 0, ErrClosed
+	}
+
+	epoch.Protect(h)
+	tail := l.Tail()
+	l.ShiftReadOnly(h, tail)
+	epoch.Unprotect(h)
+
+	for l.SafeReadOnly() < tail {
+		runtime.Gosched()
+		epoch.ProtectAndDrain(h)
+		epoch.Unprotect(h)
+	}
+
+	if err := msync(m.data); err != nil {
+		return 0, err
+	}
+
+	hdr := m.header()
+	hdr.Begin = uint64(l.Begin())
+	hdr.Head = uint64(l.Head())
+	hdr.Tail = uint64(tail)
+	if err := msync(m.data[:mappedHeaderSize]); err != nil {
+		return 0, err
+	}
+	return tail, nil
+}
+
+// Close unmaps a log opened by OpenMapped and closes its file. Records
+// allocated after the last Flush are discarded when it is opened again. The log
+// must not be used after it is closed. It does nothing for other logs.
+func (l *Log) Close() error {
+	m := l.mapping
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data == nil {
+		return ErrClosed
+	}
+	err := munmap(m.data)
+	m.data = nil
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package hlog
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmap maps the first size bytes of the file into memory, shared with it.
+func mmap(fh *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(fh.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmap unmaps memory returned by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync writes the changes to the mapped memory back to the file and waits for
+// them to be durable.
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
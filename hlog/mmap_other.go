@@ -0,0 +1,20 @@
+//go:build !linux
+
+package hlog
+
+import (
+	"errors"
+	"os"
+)
+
+// errNoMmap is returned when opening a mapped log where it is not supported.
+var errNoMmap = errors.New("hlog: mapped logs are only supported on linux")
+
+// mmap returns an error because mapped logs are not supported.
+func mmap(fh *os.File, size int) ([]byte, error) { return nil, errNoMmap }
+
+// munmap returns an error because mapped logs are not supported.
+func munmap(data []byte) error { return errNoMmap }
+
+// msync returns an error because mapped logs are not supported.
+func msync(data []byte) error { return errNoMmap }
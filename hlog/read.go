@@ -0,0 +1,65 @@
+package hlog
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/risky"
+)
+
+var (
+	// ErrNoDevice is passed to the callback of ReadAsync when the log has no
+	// device.
+	ErrNoDevice = errors.New("hlog: log has no device")
+
+	// ErrInvalid is passed to the callback of ReadAsync when the address does
+	// not hold a record.
+	ErrInvalid = errors.New("hlog: no record at address")
+)
+
+// readAhead is the number of bytes read past the header of a record in the
+// hope that the whole record is read at once.
+const readAhead = 256
+
+// ReadAsync reads the record at the address from the device, and posts the
+// callback to the queue with the record, which is 8 byte aligned and owned by
+// the callback. The address must be before the flushed address.
+func (l *Log) ReadAsync(q *device.Queue, addr Address, cb func(h epoch.Handle, rec []byte, err error)) {
+	if l.device == nil {
+		q.Post(func(h epoch.Handle, err error) { cb(h, nil, err) }, ErrNoDevice)
+		return
+	}
+	l.read(q, uint64(addr), headerSize+readAhead, cb)
+}
+
+// read reads at least n bytes starting from the header of the record at the
+// address, reading again if the record turns out to be larger.
+func (l *Log) read(q *device.Queue, addr uint64, n uint64, cb func(h epoch.Handle, rec []byte, err error)) {
+	sector := uint64(l.device.SectorSize())
+	start := (addr - headerSize) &^ (sector - 1)
+	end := (addr - headerSize + n + sector - 1) &^ (sector - 1)
+	if page := (addr>>l.pageBits + 1) << l.pageBits; end > page {
+		end = page
+	}
+
+	buf := risky.Alloc8(int(end - start))
+	l.device.ReadAsync(q, start, buf, func(h epoch.Handle, err error) {
+		if err != nil {
+			cb(h, nil, err)
+			return
+		}
+
+		off := addr - start
+		size := uint64(uint32(*(*uint64)(unsafe.Pointer(&buf[off-headerSize]))))
+		switch {
+		case size == 0 || addr&(l.pageSize-1)+size > l.pageSize:
+			cb(h, nil, ErrInvalid)
+		case off+size > uint64(len(buf)):
+			l.read(q, addr, headerSize+size, cb)
+		default:
+			cb(h, buf[off:off+size], nil)
+		}
+	})
+}
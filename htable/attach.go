@@ -0,0 +1,68 @@
+package htable
+
+import (
+	"errors"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// Attach constructs a table over the records already in the log, such as one
+// opened by hlog.OpenMapped from a file that a table flushed before it was
+// stopped. The index is rebuilt by linking the records again in the order they
+// were appended, so it does not need to have the same bits or seed as before.
+// Every record of the log must be in memory and read only, and the log must not
+// be used by anything else until Attach returns. The options are applied as in
+// New. The handle must not be protected.
+func Attach(h epoch.Handle, l *hlog.Log, bits uint64, opts ...Option) (*Table, error) {
+	switch {
+	case l.Head() > l.Begin():
+		return nil, errors.New("htable: log records are not in memory")
+	case l.SafeReadOnly() < l.Tail():
+		return nil, errors.New("htable: log records are not read only")
+	}
+
+	t := New(bits, append(opts, WithLog(l))...)
+	ix := t.load().cur
+
+	// every record is put in front of the chain for its entry, keeping the
+	// flags that delete it.
+	it := l.Iterate(h, l.Begin(), l.Tail())
+	for it.Next() {
+		addr := it.Address()
+		rec := (*record)(l.Get(addr))
+		rec.hash = t.hash(rec.Key())
+		ex, i := ix.split(rec.hash)
+
+		flags := uint16(tag(pin.LoadLocation(&rec.next).Extra()) & (tagDeleteBit | tagReplaceBit))
+		loc := pin.Address(uint64(addr)).WithExtra(ex)
+		if slot := ix.slot(ex, i); slot != nil {
+			pin.StoreLocation(&rec.next, pin.LoadLocation(slot).WithExtra(flags))
+			pin.StoreLocation(slot, loc)
+		} else {
+			pin.StoreLocation(&rec.next, pin.Location{}.WithExtra(flags))
+			ix.put(i, loc)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	// count the records that are the newest for their key and still live.
+	it = l.Iterate(h, l.Begin(), l.Tail())
+	for it.Next() {
+		rec := (*record)(l.Get(it.Address()))
+		ex, i := ix.split(rec.hash)
+		slot := ix.slot(ex, i)
+		_, _, cur := t.search(slot, pin.LoadLocation(slot), rec.Key())
+		if cur == rec && !dead(pin.LoadLocation(&rec.next)) && !t.expired(rec) {
+			t.added(h, ix, rec)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
@@ -0,0 +1,89 @@
+package htable
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestAttach(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mapped logs are only supported on linux")
+	}
+
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 500
+
+	path := filepath.Join(t.TempDir(), "log")
+	cfg := hlog.Config{PageBits: 12, MemoryPages: 32}
+
+	l, err := hlog.OpenMapped(path, cfg)
+	assert.NoError(t, err)
+	table := New(6, WithLog(l))
+
+	// replace the even keys and delete some of the odd ones, some of them
+	// while they are still mutable.
+	for i := 0; i < max; i++ {
+		table.Insert(h, []byte(fmt.Sprint("key-", i)), []byte(fmt.Sprint("val-", i)))
+	}
+	for i := 0; i < max; i++ {
+		key := []byte(fmt.Sprint("key-", i))
+		switch {
+		case i%2 == 0:
+			table.Insert(h, key, []byte(fmt.Sprint("new-", i)))
+		case i%10 == 5:
+			assert.That(t, must(table.Delete(h, key)))
+		}
+	}
+	_, err = l.Flush(h)
+	assert.NoError(t, err)
+
+	// changes after the flush are lost.
+	table.Insert(h, []byte("lost"), []byte("lost"))
+	assert.NoError(t, l.Close())
+
+	check := func(table *Table) {
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			switch {
+			case i%2 == 0:
+				assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("new-", i))
+			case i%10 == 5:
+				assert.That(t, table.Lookup(h, key) == nil)
+			default:
+				assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+			}
+		}
+		assert.That(t, table.Lookup(h, []byte("lost")) == nil)
+		assert.Equal(t, table.count(), int64(max-max/10))
+	}
+
+	// the index is rebuilt with fewer bits and a different seed.
+	l, err = hlog.OpenMapped(path, cfg)
+	assert.NoError(t, err)
+	table, err = Attach(h, l, 2)
+	assert.NoError(t, err)
+	check(table)
+
+	// the attached table keeps working, and can be attached again.
+	table.Insert(h, []byte("more"), []byte("more"))
+	_, err = l.Flush(h)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+
+	l, err = hlog.OpenMapped(path, cfg)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, l.Close()) }()
+	table, err = Attach(h, l, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, string(table.Lookup(h, []byte("more"))), "more")
+	table.Delete(h, []byte("more"))
+	check(table)
+}
@@ -0,0 +1,115 @@
+package htable
+
+import (
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// batchSize is the number of keys hashed and touched at once by the batch
+// operations. It bounds the number of outstanding cache misses and lets the
+// hashes live on the stack.
+const batchSize = 16
+
+// Result is the outcome of looking up a key in a batch.
+type Result struct {
+	Val   []byte // the value copied into the existing buffer, if found
+	Found bool
+	Err   error // set if the record cannot be read from the log's device
+}
+
+// touch loads the first cache line of the bucket the hash is in so that the
+// misses for a batch of keys overlap before any of them are probed. The handle
+// must be protected.
+func (t *Table) touch(h epoch.Handle, hash uint64) {
+	ix := t.acquire(h, hash)
+	_, i := ix.split(hash)
+	pin.LoadLocation(&ix.bucket(i).entries[0])
+}
+
+// MultiLookup looks up every key, copying the values into the buffers of the
+// corresponding results while protected. It enters the protected region once
+// for the whole batch, and results must be at least as long as keys.
+func (t *Table) MultiLookup(h epoch.Handle, keys [][]byte, results []Result) {
+	results = results[:len(keys)]
+	t.protect(h)
+
+	var hashes [batchSize]uint64
+	for off := 0; off < len(keys); off += batchSize {
+		batch := keys[off:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+
+		// refresh the protected epoch so that records retired during earlier
+		// batches can be reclaimed. no records are held across batches.
+		if off > 0 {
+			epoch.ProtectAndDrain(h)
+		}
+
+		for j, key := range batch {
+			hashes[j] = t.hash(key)
+			t.touch(h, hashes[j])
+		}
+
+		for j, key := range batch {
+			res := &results[off+j]
+			rec, err := t.lookup(h, hashes[j], key)
+			res.Err = err
+			if res.Found = rec != nil; res.Found {
+				res.Val = append(res.Val[:0], rec.Val()...)
+			}
+		}
+	}
+
+	t.unprotect(h)
+}
+
+// MultiInsert adds every key with the corresponding value to the table,
+// replacing any existing values. It enters the protected region once for the
+// whole batch, and vals must be at least as long as keys. If replaced is not
+// nil, it must also be at least as long as keys, and is set to whether each key
+// already existed. If a record cannot be stored, it stops and returns the
+// error, and the keys before it have been inserted.
+func (t *Table) MultiInsert(h epoch.Handle, keys, vals [][]byte, replaced []bool) error {
+	vals = vals[:len(keys)]
+	if replaced != nil {
+		replaced = replaced[:len(keys)]
+	}
+	for i, key := range keys {
+		if err := t.fits(key, vals[i]); err != nil {
+			return err
+		}
+	}
+	t.protect(h)
+
+	var hashes [batchSize]uint64
+	for off := 0; off < len(keys); off += batchSize {
+		batch := keys[off:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+
+		for j, key := range batch {
+			hashes[j] = t.hash(key)
+			t.touch(h, hashes[j])
+		}
+
+		for j, key := range batch {
+			cur, err := t.store(h, hashes[j], key, newRecord(hashes[j], key, vals[off+j]))
+			if err != nil {
+				t.unprotect(h)
+				return err
+			}
+			if replaced != nil {
+				replaced[off+j] = cur != nil
+			}
+
+			// refresh the protected epoch so that the record retired by the
+			// replacement can be reclaimed by the next one.
+			epoch.Protect(h)
+		}
+	}
+
+	t.unprotect(h)
+	return nil
+}
@@ -0,0 +1,96 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestBatch(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 100
+
+	keys := make([][]byte, max)
+	vals := make([][]byte, max)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint(i))
+		vals[i] = []byte(fmt.Sprint(i * 2))
+	}
+
+	table := New(2)
+	table.Insert(h, keys[3], keys[3])
+
+	replaced := make([]bool, max/2)
+	table.MultiInsert(h, keys[:max/2], vals[:max/2], replaced)
+	for i, ok := range replaced {
+		assert.Equal(t, ok, i == 3)
+	}
+	table.MultiInsert(h, keys[max/2:], vals[max/2:], nil)
+
+	results := make([]Result, max+1)
+	results[max].Val = []byte("stale")
+	table.MultiLookup(h, append(keys, []byte("missing")), results)
+	for i := 0; i < max; i++ {
+		assert.That(t, results[i].Found)
+		assert.Equal(t, string(results[i].Val), string(vals[i]))
+	}
+	assert.That(t, !results[max].Found)
+
+	// the buffers in the results are reused
+	buf := results[0].Val
+	table.MultiLookup(h, keys[:1], results)
+	assert.Equal(t, &buf[0], &results[0].Val[0])
+}
+
+func BenchmarkBatch(b *testing.B) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const (
+		size  = 1 << 16
+		batch = 32
+	)
+
+	keys := make([][]byte, size)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprint(i))
+	}
+
+	table := New(14)
+	table.MultiInsert(h, keys, keys, nil)
+	results := make([]Result, batch)
+
+	b.Run("MultiLookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += batch {
+			j := i % size
+			table.MultiLookup(h, keys[j:j+batch], results)
+		}
+	})
+
+	b.Run("LookupInto", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			results[0].Val, results[0].Found, results[0].Err = table.LookupInto(h, keys[i%size], results[0].Val)
+		}
+	})
+
+	b.Run("MultiInsert", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += batch {
+			j := i % size
+			table.MultiInsert(h, keys[j:j+batch], keys[j:j+batch], nil)
+		}
+	})
+
+	b.Run("Insert", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table.Insert(h, keys[i%size], keys[i%size])
+		}
+	})
+}
@@ -2,9 +2,9 @@ package htable
 
 import (
 	"bytes"
+	"sync/atomic"
 	"unsafe"
 
-	"github.com/zeebo/gofaster/epoch"
 	"github.com/zeebo/gofaster/internal/machine"
 	"github.com/zeebo/gofaster/pin"
 )
@@ -23,133 +23,63 @@ type ( // ensure the bucket is sized to a cache line
 	_ [machine.CacheLine - bucketSize]byte
 )
 
-// Delete removes the key from the bucket, using the tag to avoid comparing keys.
-// It returns false if the key does not exist.
-func (b *bucket) Delete(h epoch.Handle, ex uint16, key []byte) (bool, bool) {
-	for i := range &b.entries {
-		addr := &b.entries[i]
-		loc := pin.LoadLocation(addr)
-		t := tag(loc.Extra())
-
-		// check if the tag is appropriate
-		if loc.Nil() || t.Hash() != ex || t.Tentative() {
-			continue
-		}
-
-		// the key must exist in this bucket entry if it exists
-	retry:
-		caddr := addr
-
-		for {
-			cloc := pin.LoadLocation(caddr)
-			if cloc.Nil() {
-				break
-			}
-
-			rec := (*record)(pin.Read(cloc))
-			if !bytes.Equal(rec.Key(), key) {
-				caddr = &rec.next
-				continue
-			}
-
-			// grab the original next pointer
-			rloc := pin.LoadLocation(&rec.next)
-			rtag := tag(rloc.Extra())
-
-			{ // flag the pointer on the record as logically deleted
-				nloc := rloc.WithExtra(uint16(rtag.WithDelete()))
-				if !pin.CompareAndSwapLocation(&rec.next, rloc, nloc) {
-					goto retry
-				}
-			}
-
-			{ // clear out any possible delete flag and go from cloc => rec.next
-				nloc := rloc.WithExtra(uint16(rtag.WithoutDelete()))
-				if !pin.CompareAndSwapLocation(caddr, cloc, nloc) {
-					pin.StoreLocation(&rec.next, rloc)
-					goto retry
-				}
-			}
+// next atomically loads the overflow bucket.
+func (b *bucket) next() *bucket {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&b.overflow))
+	return (*bucket)(atomic.LoadPointer(ptr))
+}
 
-			// we use the epoch system to unpin the deleted location which ensures
-			// no other handles are reading.
-			epoch.BumpWith(h, func(h epoch.Handle) { pin.Unpin(h, cloc) })
+// grow atomically allocates an overflow bucket if one does not exist, and
+// returns the overflow bucket.
+func (b *bucket) grow() *bucket {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&b.overflow))
+	atomic.CompareAndSwapPointer(ptr, nil, unsafe.Pointer(new(bucket)))
+	return b.next()
+}
 
-			return true, true
+// slot returns the address of the entry with the extra hash bits, or nil if
+// there is no finalized entry for them. Entries never have the delete bit set,
+// so the extra data is compared directly.
+func (b *bucket) slot(ex uint16) *pin.Location {
+	for i := range &b.entries {
+		addr := &b.entries[i]
+		if loc := pin.LoadLocation(addr); !loc.Nil() && loc.Extra() == ex {
+			return addr
 		}
-
-		// we failed to delete
-		return true, false
 	}
-
-	return false, false
+	return nil
 }
 
-// Lookup returns the value for the key, using the tag to avoid comparing keys.
-// It returns nil if the key does not exist.
-func (b *bucket) Lookup(h epoch.Handle, ex uint16, key []byte) (bool, []byte) {
+// contains returns true if any entry other than skip has the extra hash bits,
+// including tentative entries.
+func (b *bucket) contains(ex uint16, skip *pin.Location) bool {
 	for i := range &b.entries {
 		addr := &b.entries[i]
-		loc := pin.LoadLocation(addr)
-		t := tag(loc.Extra())
-
-		// check if the tag is appropriate
-		if loc.Nil() || t.Hash() != ex || t.Tentative() {
+		if addr == skip {
 			continue
 		}
-
-		// check the linked list of records for the matching key
-		for !loc.Nil() {
-			rec := (*record)(pin.Read(loc))
-			if bytes.Equal(rec.Key(), key) {
-				return true, rec.Val()
-			}
-			loc = pin.LoadLocation(&rec.next)
+		if loc := pin.LoadLocation(addr); !loc.Nil() && tag(loc.Extra()).Hash() == ex {
+			return true
 		}
-
-		return true, nil
 	}
-
-	return false, nil
+	return false
 }
 
-// Insert adds the location to the bucket using the extra hash to find the correct index location.
-func (b *bucket) Insert(h epoch.Handle, loc pin.Location, key []byte) bool {
-	ex := tag(loc.Extra()).Hash()
-
-retry:
-	for i := range &b.entries {
-		caddr := &b.entries[i]
-		cloc := pin.LoadLocation(caddr)
-		ctag := tag(cloc.Extra())
-
-		if cloc.Nil() || ctag.Hash() != ex || ctag.Tentative() {
-			continue
-		}
-
-		// walk the records to see if we already have the key
-		for !cloc.Nil() {
-			rec := (*record)(pin.Read(cloc))
-			if bytes.Equal(rec.Key(), key) {
-				// TODO(jeff): update this record to be the right one? this is weird
-				return true
-			}
-			cloc = pin.LoadLocation(&rec.next)
+// search walks the linked list of records starting at the location loaded from
+// addr, looking for the key. It returns the address that points at the record,
+// the location loaded from that address, and the record. The record is nil if
+// the key does not exist.
+func (t *Table) search(addr *pin.Location, loc pin.Location, key []byte) (*pin.Location, pin.Location, *record) {
+	for !loc.Nil() {
+		rec := t.record(loc)
+		if rec == nil {
+			break
 		}
-
-		// read the record, and update next to point at the loaded location
-		rec := (*record)(pin.Read(loc))
-		pin.StoreLocation(&rec.next, cloc)
-
-		// attempt to append our record to the start of the linked list. if we
-		// fail, retry everything.
-		if !pin.CompareAndSwapLocation(caddr, cloc, loc) {
-			goto retry
+		if bytes.Equal(rec.Key(), key) {
+			return addr, loc, rec
 		}
-
-		// the insert is complete
-		return true
+		addr = &rec.next
+		loc = pin.LoadLocation(addr)
 	}
-
-	return false
+	return addr, loc, nil
 }
@@ -0,0 +1,100 @@
+package htable
+
+import (
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// WithMaxBytes causes the table to evict records whenever the bytes used by
+// records, including their metadata, exceeds the budget. Records are chosen
+// with the CLOCK algorithm: a hand sweeps the buckets in scan order, evicting
+// expired records and records that have not been read since the hand last
+// passed, and clearing the reference of the rest. The budget is checked after
+// every change, so it may be briefly exceeded while handles are evicting. The
+// default of zero means there is no budget.
+func WithMaxBytes(n int64) Option {
+	return func(t *Table) { t.maxBytes = n }
+}
+
+// WithEvict causes the table to call fn with the key and value of every record
+// it evicts to stay under its byte budget. It is called by the handle that
+// evicted the record after it has been removed, and the key and value must not
+// be modified or retained after it returns.
+func WithEvict(fn func(key, val []byte)) Option {
+	return func(t *Table) { t.onEvict = fn }
+}
+
+// referenced records a lookup by the handle that found the record, or missed if
+// it is nil, marking the record as recently used when there is a byte budget.
+func (t *Table) referenced(h epoch.Handle, rec *record) {
+	c := t.counter(h)
+	if rec == nil {
+		atomic.AddInt64(&c.misses, 1)
+		return
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	if t.maxBytes > 0 && atomic.LoadUint64(&rec.ref) == 0 {
+		atomic.StoreUint64(&rec.ref, 1)
+	}
+}
+
+// advanceHand moves the clock hand past a bucket and returns the records in it
+// that should be evicted. The handle must not be protected.
+func (t *Table) advanceHand(h epoch.Handle) (victims []*record) {
+	epoch.Protect(h)
+	defer epoch.Unprotect(h)
+
+	for {
+		cursor := atomic.LoadUint64(&t.hand)
+		ix := t.acquire(h, cursor<<tagHashBits)
+		if !atomic.CompareAndSwapUint64(&t.hand, cursor, advance(cursor, ix.mask)) {
+			continue
+		}
+
+		t.visit(ix, cursor&ix.mask, func(rec *record) bool {
+			if t.expired(rec) || atomic.LoadUint64(&rec.ref) == 0 {
+				victims = append(victims, rec)
+			} else {
+				atomic.StoreUint64(&rec.ref, 0)
+			}
+			return true
+		})
+		return victims
+	}
+}
+
+// evict removes records until the table is within its byte budget. The handle
+// must not be protected.
+func (t *Table) evict(h epoch.Handle) {
+	c := t.counter(h)
+
+	for t.bytes() > t.maxBytes {
+		// the victims remain allocated while we refer to them, so they can be
+		// compared to the current record and passed to the callback after the
+		// protected region is left.
+		for _, victim := range t.advanceHand(h) {
+			t.protect(h)
+
+			// tables storing their records in a log have no byte budget, so
+			// removing the victim cannot fail.
+			key := victim.Key()
+			_, act, _ := t.modify(h, victim.hash, key, func(cur *record) (action, *record) {
+				if cur != nil && cur != victim {
+					return actionKeep, nil
+				}
+				return actionDelete, nil
+			})
+
+			epoch.Unprotect(h)
+
+			if act == actionDelete {
+				atomic.AddInt64(&c.evictions, 1)
+				if t.onEvict != nil {
+					t.onEvict(key, victim.Val())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestCache(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	size := func(key, val string) int64 {
+		return int64(recordSize) + int64(len(key)+len(val))
+	}
+
+	t.Run("Accounting", func(t *testing.T) {
+		table := New(2)
+		table.Insert(h, []byte("a"), []byte("1"))
+		table.Insert(h, []byte("b"), []byte("22"))
+		assert.Equal(t, table.bytes(), size("a", "1")+size("b", "22"))
+
+		table.Insert(h, []byte("a"), []byte("333"))
+		assert.Equal(t, table.bytes(), size("a", "333")+size("b", "22"))
+
+		table.Delete(h, []byte("b"))
+		assert.Equal(t, table.bytes(), size("a", "333"))
+		assert.Equal(t, int64(table.Stats(h).Bytes), table.bytes())
+	})
+
+	t.Run("Evict", func(t *testing.T) {
+		const (
+			max  = 100
+			keep = 10
+		)
+
+		evicted := make(map[string]string)
+		table := New(2,
+			WithMaxBytes(keep*size("00", "00")),
+			WithEvict(func(key, val []byte) { evicted[string(key)] = string(val) }),
+		)
+
+		// the first keys are read after every insert so that the clock keeps
+		// giving them a second chance.
+		hot := []byte("00")
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprintf("%02d", i))
+			table.Insert(h, data, data)
+			table.Lookup(h, hot)
+
+			assert.That(t, table.bytes() <= table.maxBytes)
+		}
+
+		assert.Equal(t, string(table.Lookup(h, hot)), "00")
+		for key, val := range evicted {
+			assert.Equal(t, key, val)
+			assert.That(t, table.Lookup(h, []byte(key)) == nil)
+		}
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, max-len(evicted))
+		assert.Equal(t, st.Evictions, len(evicted))
+		assert.That(t, st.Records <= keep)
+		assert.That(t, st.Hits >= max)
+		assert.That(t, st.Misses == len(evicted))
+	})
+}
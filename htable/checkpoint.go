@@ -0,0 +1,359 @@
+package htable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/pin"
+)
+
+var (
+	// ErrNotLogged is returned when checkpointing a table that does not store
+	// its records in a log.
+	ErrNotLogged = errors.New("htable: records not stored in a log")
+
+	// ErrCorrupt is returned when restoring from a checkpoint that is invalid.
+	ErrCorrupt = errors.New("htable: corrupt checkpoint")
+)
+
+// an index checkpoint is a header, the entries of every bucket, a trailer, and
+// the serial numbers of every named session, all little endian, followed by the
+// crc of everything before it.
+const (
+	checkpointMagic   = 0x7470636b78646967 // "gidxckpt"
+	checkpointVersion = 3
+
+	// checkpointMaxBits bounds the size of the index a checkpoint can
+	// describe, so that a corrupt one cannot make restoring allocate an
+	// enormous index.
+	checkpointMaxBits = 32
+)
+
+// checkpointHeader is written before the buckets.
+type checkpointHeader struct {
+	Magic   uint64
+	Version uint64
+	Seed    uint64
+	Bits    uint64 // the index has 2^Bits buckets
+	Begin   uint64 // the begin of the log
+	Start   uint64 // the records before Start are all checkpointed
+	Cut     uint64 // the records before Cut written in Table are checkpointed
+	Table   uint64 // the version of the table that was checkpointed
+	Records int64
+	Bytes   int64
+}
+
+// checkpointTrailer is written after the buckets.
+type checkpointTrailer struct {
+	Bits uint64 // the bits of the index once the log was flushed
+	End  uint64 // every record before End is durable
+}
+
+// quiesce waits until every handle that was protected when it was called has
+// left its protected region. The handle must not be protected.
+func quiesce(h epoch.Handle) {
+	var done uint32
+
+	epoch.Protect(h)
+	epoch.BumpWith(h, func(epoch.Handle) { atomic.StoreUint32(&done, 1) })
+	epoch.Unprotect(h)
+
+	for atomic.LoadUint32(&done) == 0 {
+		runtime.Gosched()
+		epoch.ProtectAndDrain(h)
+		epoch.Unprotect(h)
+	}
+}
+
+// settle returns the index of the table once any growth in progress has
+// finished, helping to migrate it. The index is never freed, so its entries can
+// be read without being protected. The handle must not be protected.
+func (t *Table) settle(h epoch.Handle) *index {
+	for {
+		epoch.ProtectAndDrain(h)
+		st := t.load()
+		switch atomic.LoadUint32(&st.phase) {
+		case phaseStable:
+			epoch.Unprotect(h)
+			return st.cur
+
+		case phaseMigrate:
+			for i := range st.chunks {
+				if st.help(h, uint64(i)<<chunkBits) {
+					t.finish(st)
+				}
+			}
+		}
+		epoch.Unprotect(h)
+		runtime.Gosched()
+	}
+}
+
+// CheckpointIndex writes the index of a table that stores its records in a log
+// with a device to w, along with the serial numbers of its named sessions, and
+// flushes the log. The checkpoint is a consistent cut: it contains every change
+// by a session up to the serial number it records for the session, and none
+// after, as if every session stopped at that point.
+//
+// The cut does not pause other handles. The checkpoint advances the version of
+// the table, and each handle records the serial number of its last change when
+// it observes the new version at the start of its next change. Changes in the
+// new version only seal records from the earlier one instead of changing them
+// in place, and restoring skips the records written in it. It must not run
+// concurrently with Clear. The handle must not be protected.
+func (t *Table) CheckpointIndex(h epoch.Handle, w io.Writer) error {
+	if t.log == nil {
+		return ErrNotLogged
+	}
+	if t.isClosed() {
+		return ErrClosed
+	}
+
+	t.cpr.Lock()
+	defer t.cpr.Unlock()
+
+	// every record written in the new version is after the start. once every
+	// handle has left the protected region it was in when the version
+	// advanced, every change in the earlier version has finished, so its
+	// records are before the tail. making them read only keeps them from
+	// being changed in place once they are flushed.
+	epoch.Protect(h)
+	start := t.log.Tail()
+	version := atomic.AddUint64(&t.version, 1)
+	epoch.Unprotect(h)
+	quiesce(h)
+
+	epoch.Protect(h)
+	cut := t.log.Tail()
+	t.log.ShiftReadOnly(h, cut)
+	epoch.Unprotect(h)
+
+	serials, records, bytes := t.cut(version)
+	hdr := checkpointHeader{
+		Magic:   checkpointMagic,
+		Version: checkpointVersion,
+		Seed:    t.seed,
+		Begin:   uint64(t.log.Begin()),
+		Start:   uint64(start),
+		Cut:     uint64(cut),
+		Table:   version - 1,
+		Records: records,
+		Bytes:   bytes,
+	}
+
+	// entries may link to records after the cut, and restoring follows their
+	// chains back before it.
+	ix := t.settle(h)
+	hdr.Bits = ix.bits
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	if err := binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+
+	var entries []uint64
+	for i := range ix.buckets {
+		entries = entries[:0]
+		for bucket := ix.bucket(uint64(i)); bucket != nil; bucket = bucket.next() {
+			for j := range &bucket.entries {
+				loc := pin.LoadLocation(&bucket.entries[j])
+				if loc.Nil() || tag(loc.Extra()).Tentative() {
+					continue
+				}
+				entries = append(entries, loc.Address(), uint64(loc.Extra()))
+			}
+		}
+
+		if err := binary.Write(bw, binary.LittleEndian, uint32(len(entries)/2)); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, entries); err != nil {
+			return err
+		}
+	}
+
+	end, err := t.log.Flush(h)
+	if err != nil {
+		return err
+	}
+
+	epoch.Protect(h)
+	bits := t.acquire(h, 0).bits
+	epoch.Unprotect(h)
+
+	err = binary.Write(bw, binary.LittleEndian, &checkpointTrailer{Bits: bits, End: uint64(end)})
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, uint32(len(serials))); err != nil {
+		return err
+	}
+	for id, serial := range serials {
+		if err := binary.Write(bw, binary.LittleEndian, uint32(len(id))); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(id); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, serial); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// Restore is like Recover, but discards the serial numbers of the sessions.
+func Restore(h epoch.Handle, r io.Reader, cfg hlog.Config, opts ...Option) (*Table, error) {
+	t, _, err := Recover(h, r, cfg, opts...)
+	return t, err
+}
+
+// Recover constructs a table from an index checkpoint written by
+// CheckpointIndex, opening its log from the device in the configuration, and
+// returns the serial number of the last change of every named session that the
+// table contains. The options are applied as in New, except that the seed is
+// always the one the table was checkpointed with. The handle must not be
+// protected.
+func Recover(h epoch.Handle, r io.Reader, cfg hlog.Config, opts ...Option) (*Table, map[string]uint64, error) {
+	crc := crc32.NewIEEE()
+	br := io.TeeReader(bufio.NewReader(r), crc)
+
+	var hdr checkpointHeader
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Magic != checkpointMagic || hdr.Version != checkpointVersion || hdr.Bits > checkpointMaxBits ||
+		hdr.Start > hdr.Cut {
+		return nil, nil, fmt.Errorf("%w: invalid header", ErrCorrupt)
+	}
+
+	type entry struct{ i, addr, ex uint64 }
+	var entries []entry
+	for i := uint64(0); i < 1<<hdr.Bits; i++ {
+		var n uint32
+		if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+			return nil, nil, err
+		}
+		// entries are read one at a time so that a corrupt count fails
+		// at the end of the input instead of allocating for all of them.
+		for ; n > 0; n-- {
+			var buf [2]uint64
+			if err := binary.Read(br, binary.LittleEndian, &buf); err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, entry{i: i, addr: buf[0], ex: buf[1]})
+		}
+	}
+
+	var tr checkpointTrailer
+	if err := binary.Read(br, binary.LittleEndian, &tr); err != nil {
+		return nil, nil, err
+	}
+	if tr.Bits < hdr.Bits || tr.Bits > checkpointMaxBits || tr.End < hdr.Cut {
+		return nil, nil, fmt.Errorf("%w: invalid trailer", ErrCorrupt)
+	}
+
+	var n uint32
+	if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+		return nil, nil, err
+	}
+	serials := make(map[string]uint64)
+	for ; n > 0; n-- {
+		var size uint32
+		if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+			return nil, nil, err
+		}
+		if size > 1<<16 {
+			return nil, nil, fmt.Errorf("%w: invalid session", ErrCorrupt)
+		}
+		id := make([]byte, size)
+		if _, err := io.ReadFull(br, id); err != nil {
+			return nil, nil, err
+		}
+		var serial uint64
+		if err := binary.Read(br, binary.LittleEndian, &serial); err != nil {
+			return nil, nil, err
+		}
+		serials[string(id)] = serial
+	}
+
+	sum := crc.Sum32()
+	var got uint32
+	if err := binary.Read(br, binary.LittleEndian, &got); err != nil {
+		return nil, nil, err
+	}
+	if got != sum {
+		return nil, nil, fmt.Errorf("%w: invalid checksum", ErrCorrupt)
+	}
+
+	l, err := hlog.Open(cfg, hlog.Address(hdr.Begin), hlog.Address(tr.End))
+	if err != nil {
+		return nil, nil, err
+	}
+	t := New(tr.Bits, append(opts, WithLog(l), WithSeed(hdr.Seed))...)
+	ix := t.load().cur
+
+	// records after the cut, and records after the start written in a later
+	// version, are not part of the checkpoint. they were linked in front of
+	// the records that are, and entries may link to them, so remember where
+	// their chains continue.
+	next := make(map[uint64]uint64)
+	it := l.Iterate(h, hlog.Address(hdr.Start), hlog.Address(tr.End))
+	for it.Next() {
+		rec := recordAt(it.Record())
+		if rec == nil {
+			return nil, nil, hlog.ErrInvalid
+		}
+		if addr := uint64(it.Address()); addr >= hdr.Cut || rec.ref > hdr.Table {
+			next[addr] = pin.LoadLocation(&rec.next).Address()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// the index may have grown while it was written, in which case every
+	// entry is shared by the buckets it was split into, like a migration.
+	for _, e := range entries {
+		addr := e.addr
+		for addr != 0 {
+			n, ok := next[addr]
+			if !ok && addr < hdr.Cut {
+				break
+			}
+			addr = n
+		}
+		if addr == 0 {
+			continue
+		}
+
+		loc := pin.Address(addr).WithExtra(uint16(e.ex))
+		for k := uint64(0); k < 1<<(tr.Bits-hdr.Bits); k++ {
+			ix.put(e.i+k<<hdr.Bits, loc)
+		}
+	}
+
+	// records written in the next version are not linked from the index, so
+	// the version continues after it.
+	t.version = hdr.Table + 2
+
+	c := t.counter(h)
+	atomic.StoreInt64(&c.records, hdr.Records)
+	atomic.StoreInt64(&c.bytes, hdr.Bytes)
+	return t, serials, nil
+}
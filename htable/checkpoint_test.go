@@ -0,0 +1,171 @@
+package htable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	// open returns a log configuration using a file device at the path, which
+	// is closed when the test finishes.
+	open := func(t *testing.T, path string) hlog.Config {
+		d, err := device.OpenFile(path, device.Config{SegmentBits: 20})
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = d.Close() })
+		return hlog.Config{PageBits: 12, MemoryPages: 8, Device: d}
+	}
+
+	newTable := func(t *testing.T, path string, opts ...Option) *Table {
+		l, err := hlog.New(open(t, path))
+		assert.NoError(t, err)
+		return New(2, append(opts, WithLog(l))...)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log")
+		table := newTable(t, path)
+
+		const max = 1000
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		for i := 0; i < max; i += 3 {
+			assert.That(t, must(table.Delete(h, []byte(fmt.Sprint(i)))))
+		}
+		for i := 1; i < max; i += 3 {
+			table.Insert(h, []byte(fmt.Sprint(i)), []byte("new"))
+		}
+
+		var buf bytes.Buffer
+		assert.NoError(t, table.CheckpointIndex(h, &buf))
+
+		restored, err := Restore(h, bytes.NewReader(buf.Bytes()), open(t, path))
+		assert.NoError(t, err)
+		assert.Equal(t, restored.Buckets(), table.Buckets())
+		assert.Equal(t, restored.Hash([]byte("a")), table.Hash([]byte("a")))
+		assert.Equal(t, restored.count(), table.count())
+
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			switch i % 3 {
+			case 0:
+				assert.That(t, restored.Lookup(h, data) == nil)
+			case 1:
+				assert.Equal(t, string(restored.Lookup(h, data)), "new")
+			case 2:
+				assert.Equal(t, string(restored.Lookup(h, data)), string(data))
+			}
+		}
+
+		// the restored table keeps working, appending after the old records
+		restored.Insert(h, []byte("0"), []byte("back"))
+		assert.Equal(t, string(restored.Lookup(h, []byte("0"))), "back")
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log")
+		table := newTable(t, path, WithLoadFactor(1))
+
+		const (
+			workers = 4
+			keys    = 64
+		)
+
+		// every worker counts up the values of its own keys, publishing how
+		// many rounds it has completed.
+		var (
+			wg     sync.WaitGroup
+			stop   uint32
+			rounds [workers]uint64
+		)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for r := 1; atomic.LoadUint32(&stop) == 0; r++ {
+					for k := 0; k < keys; k++ {
+						table.Insert(h, []byte(fmt.Sprint(w, "-", k)), []byte(fmt.Sprint(r)))
+					}
+					atomic.StoreUint64(&rounds[w], uint64(r))
+				}
+			}(w)
+		}
+
+		for atomic.LoadUint64(&rounds[workers-1]) < 2 {
+			runtime.Gosched()
+		}
+		var before [workers]uint64
+		for w := range before {
+			before[w] = atomic.LoadUint64(&rounds[w])
+		}
+
+		var buf bytes.Buffer
+		assert.NoError(t, table.CheckpointIndex(h, &buf))
+		atomic.StoreUint32(&stop, 1)
+		wg.Wait()
+
+		restored, err := Restore(h, bytes.NewReader(buf.Bytes()), open(t, path))
+		assert.NoError(t, err)
+
+		for w := 0; w < workers; w++ {
+			for k := 0; k < keys; k++ {
+				r := atoi(restored.Lookup(h, []byte(fmt.Sprint(w, "-", k))))
+				assert.That(t, uint64(r) >= before[w])
+				assert.That(t, uint64(r) <= atomic.LoadUint64(&rounds[w])+1)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, New(2).CheckpointIndex(h, new(bytes.Buffer)), ErrNotLogged)
+
+		path := filepath.Join(t.TempDir(), "log")
+		table := newTable(t, path)
+		table.Insert(h, []byte("a"), []byte("a"))
+
+		var buf bytes.Buffer
+		assert.NoError(t, table.CheckpointIndex(h, &buf))
+
+		data := buf.Bytes()
+		data[len(data)-10] ^= 1
+		_, err := Restore(h, bytes.NewReader(data), open(t, path))
+		assert.That(t, errors.Is(err, ErrCorrupt))
+
+		// an index too large to restore is rejected before reading it.
+		var big bytes.Buffer
+		hdr := checkpointHeader{Magic: checkpointMagic, Version: checkpointVersion, Bits: checkpointMaxBits + 1}
+		assert.NoError(t, binary.Write(&big, binary.LittleEndian, &hdr))
+		_, err = Restore(h, bytes.NewReader(big.Bytes()), open(t, path))
+		assert.That(t, errors.Is(err, ErrCorrupt))
+
+		// a bucket claiming more entries than the input holds fails at its
+		// end.
+		var short bytes.Buffer
+		hdr.Bits = 0
+		assert.NoError(t, binary.Write(&short, binary.LittleEndian, &hdr))
+		assert.NoError(t, binary.Write(&short, binary.LittleEndian, ^uint32(0)))
+		_, err = Restore(h, bytes.NewReader(short.Bytes()), open(t, path))
+		assert.Equal(t, err, io.EOF)
+	})
+}
@@ -0,0 +1,153 @@
+package htable
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// Codec encodes and decodes values of type T to and from bytes.
+type Codec[T any] interface {
+	// Append appends the encoding of the value to dst and returns the result.
+	Append(dst []byte, v T) ([]byte, error)
+
+	// Decode returns the value encoded in the data. The data must not be
+	// retained after Decode returns.
+	Decode(data []byte) (T, error)
+}
+
+// Integer is the set of integer types handled by IntCodec.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntCodec encodes integers as little endian bytes of the width of the type.
+type IntCodec[T Integer] struct{}
+
+// Append appends the little endian encoding of the integer.
+func (IntCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	for i := uintptr(0); i < unsafe.Sizeof(v); i++ {
+		dst = append(dst, byte(uint64(v)>>(8*i)))
+	}
+	return dst, nil
+}
+
+// Decode decodes the little endian encoding of the integer.
+func (IntCodec[T]) Decode(data []byte) (v T, err error) {
+	if uintptr(len(data)) != unsafe.Sizeof(v) {
+		return v, decodeError(data, v)
+	}
+	var x uint64
+	for i := range data {
+		x |= uint64(data[i]) << (8 * uint(i))
+	}
+	return T(x), nil
+}
+
+// StringCodec encodes strings as their bytes.
+type StringCodec struct{}
+
+// Append appends the bytes of the string.
+func (StringCodec) Append(dst []byte, v string) ([]byte, error) {
+	return append(dst, v...), nil
+}
+
+// Decode returns the data as a string.
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// BytesCodec encodes byte slices as themselves.
+type BytesCodec struct{}
+
+// Append appends the bytes.
+func (BytesCodec) Append(dst []byte, v []byte) ([]byte, error) {
+	return append(dst, v...), nil
+}
+
+// Decode returns a copy of the data.
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return append([]byte(nil), data...), nil
+}
+
+// BinaryCodec encodes values using their MarshalBinary and UnmarshalBinary
+// methods, where the pointer type implements the unmarshaling.
+type BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+// Append appends the result of MarshalBinary.
+func (BinaryCodec[T, PT]) Append(dst []byte, v T) ([]byte, error) {
+	data, err := PT(&v).MarshalBinary()
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+// Decode calls UnmarshalBinary on a new value.
+func (BinaryCodec[T, PT]) Decode(data []byte) (v T, err error) {
+	err = PT(&v).UnmarshalBinary(data)
+	return v, err
+}
+
+// FixedCodec encodes fixed size values that contain no pointers as their
+// in-memory representation, so the encoding depends on the architecture.
+type FixedCodec[T any] struct{}
+
+// NewFixedCodec returns a FixedCodec for the type, and panics if the type
+// contains pointers.
+func NewFixedCodec[T any]() FixedCodec[T] {
+	var v T
+	if !pointerFree(reflect.TypeOf(&v).Elem()) {
+		panic(fmt.Sprintf("htable: %T contains pointers", v))
+	}
+	return FixedCodec[T]{}
+}
+
+// Append appends the memory of the value.
+func (FixedCodec[T]) Append(dst []byte, v T) ([]byte, error) {
+	return append(dst, unsafe.Slice((*byte)(unsafe.Pointer(&v)), unsafe.Sizeof(v))...), nil
+}
+
+// Decode copies the data into the memory of a new value.
+func (FixedCodec[T]) Decode(data []byte) (v T, err error) {
+	if uintptr(len(data)) != unsafe.Sizeof(v) {
+		return v, decodeError(data, v)
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&v)), unsafe.Sizeof(v)), data)
+	return v, nil
+}
+
+// pointerFree returns true if values of the type contain no pointers.
+func pointerFree(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64,
+		reflect.Complex64, reflect.Complex128:
+
+		return true
+
+	case reflect.Array:
+		return pointerFree(typ.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if !pointerFree(typ.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// decodeError returns an error for data that has the wrong size for the value.
+func decodeError(data []byte, v interface{}) error {
+	return fmt.Errorf("htable: invalid %d byte encoding for %T", len(data), v)
+}
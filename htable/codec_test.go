@@ -0,0 +1,80 @@
+package htable
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+type point struct {
+	X, Y int32
+	Z    [2]uint8
+}
+
+type version struct{ major, minor byte }
+
+func (v version) MarshalBinary() ([]byte, error) {
+	return []byte{v.major, v.minor}, nil
+}
+
+func (v *version) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return errors.New("bad version")
+	}
+	v.major, v.minor = data[0], data[1]
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	t.Run("Int", func(t *testing.T) {
+		data, err := IntCodec[int16]{}.Append(nil, -2)
+		assert.NoError(t, err)
+		assert.DeepEqual(t, data, []byte{0xfe, 0xff})
+
+		v, err := IntCodec[int16]{}.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, v, int16(-2))
+
+		_, err = IntCodec[uint64]{}.Decode(data)
+		assert.Error(t, err)
+	})
+
+	t.Run("String", func(t *testing.T) {
+		data, err := StringCodec{}.Append([]byte("a"), "bc")
+		assert.NoError(t, err)
+		v, err := StringCodec{}.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, v, "abc")
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		codec := BinaryCodec[version, *version]{}
+
+		data, err := codec.Append(nil, version{1, 2})
+		assert.NoError(t, err)
+		v, err := codec.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, v, version{1, 2})
+
+		_, err = codec.Decode(nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Fixed", func(t *testing.T) {
+		codec := NewFixedCodec[point]()
+
+		data, err := codec.Append(nil, point{X: 1, Y: -1, Z: [2]uint8{3, 4}})
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), 12)
+		v, err := codec.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, v, point{X: 1, Y: -1, Z: [2]uint8{3, 4}})
+
+		_, err = codec.Decode(data[1:])
+		assert.Error(t, err)
+
+		defer func() { assert.NotNil(t, recover()) }()
+		NewFixedCodec[struct{ p *int }]()
+	})
+}
@@ -0,0 +1,194 @@
+package htable
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+)
+
+// Compact copies every live record before the address that is still the newest
+// for its key to the tail of the log, and then discards everything before the
+// address, truncating the log's device. The address is limited to the head of
+// the log and rounded down to a page. Deleted and expired records are dropped.
+// It returns the new begin of the log. Index checkpoints taken before the
+// compaction can no longer be restored, as the records they refer to are gone.
+// Other handles may keep using the table. The handle must not be protected.
+func (t *Table) Compact(h epoch.Handle, until hlog.Address) (hlog.Address, error) {
+	if t.log == nil {
+		return 0, ErrNotLogged
+	}
+	if t.isClosed() {
+		return 0, ErrClosed
+	}
+
+	t.cpr.Lock()
+	defer t.cpr.Unlock()
+
+	begin := t.log.Begin()
+	if hd := t.log.Head(); until > hd {
+		until = hd
+	}
+	until &^= hlog.Address(t.log.PageSize() - 1)
+	if until <= begin {
+		return begin, nil
+	}
+
+	var key []byte
+	it := t.log.Iterate(h, begin, until)
+	for it.Next() {
+		rec := recordAt(it.Record())
+		if rec == nil {
+			return begin, hlog.ErrInvalid
+		}
+		key = append(key[:0], rec.Key()...)
+		if err := t.relocate(h, rec.hash, key, until); err != nil {
+			return begin, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return begin, err
+	}
+
+	epoch.Protect(h)
+	t.log.ShiftBegin(h, until)
+	epoch.Unprotect(h)
+	return t.log.Begin(), nil
+}
+
+// relocate copies the live record for the key to the tail of the log if it is
+// before the address. The handle must not be protected.
+func (t *Table) relocate(h epoch.Handle, hash uint64, key []byte, until hlog.Address) error {
+	t.protect(h)
+	defer t.unprotect(h)
+
+	var at hlog.Address
+	_, _, err := t.append(h, hash, key, false, &at, func(cur *record) (action, *record) {
+		if cur == nil || at >= until {
+			return actionKeep, nil
+		}
+		return actionStore, cur
+	})
+	return err
+}
+
+// CompactConfig controls a Compactor.
+type CompactConfig struct {
+	// Size is how many bytes of the log to keep before compacting it.
+	Size int64
+
+	// Chunk is how many bytes of the log to compact at a time. The default is
+	// 1MB.
+	Chunk int64
+
+	// Rate limits how many bytes of the log are compacted per second. The
+	// default is no limit.
+	Rate int64
+
+	// Interval is how often to check the size of the log. The default is
+	// 100ms.
+	Interval time.Duration
+}
+
+// Compactor compacts the log of a table in the background.
+type Compactor struct {
+	t   *Table
+	cfg CompactConfig
+
+	once sync.Once
+	stop chan struct{} // closed to stop the compactor
+	done chan struct{} // closed when the compactor exits
+	err  error         // the error that stopped the compactor, if any
+}
+
+// StartCompactor starts compacting the oldest chunk of the table's log
+// whenever it is larger than the configured size, until Stop is called or an
+// error happens.
+func (t *Table) StartCompactor(cfg CompactConfig) (*Compactor, error) {
+	if t.log == nil {
+		return nil, ErrNotLogged
+	}
+	if cfg.Chunk <= 0 {
+		cfg.Chunk = 1 << 20
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 100 * time.Millisecond
+	}
+
+	c := &Compactor{
+		t:    t,
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Stop stops the compactor, waiting for any compaction in progress, and returns
+// the error that stopped it, if any.
+func (c *Compactor) Stop() error {
+	c.once.Do(func() { close(c.stop) })
+	<-c.done
+	return c.err
+}
+
+// run compacts the log whenever the interval passes until it is stopped.
+func (c *Compactor) run() {
+	defer close(c.done)
+
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.compact(h) {
+			return
+		}
+	}
+}
+
+// compact compacts chunks of the log until it is no larger than the configured
+// size, sleeping between them to limit the rate. It returns false if the
+// compactor should exit.
+func (c *Compactor) compact(h epoch.Handle) bool {
+	l := c.t.log
+	for int64(l.Tail()-l.Begin()) > c.cfg.Size {
+		select {
+		case <-c.stop:
+			return false
+		default:
+		}
+
+		begin := l.Begin()
+		next, err := c.t.Compact(h, begin+hlog.Address(c.cfg.Chunk))
+		if err == ErrClosed {
+			return false
+		} else if err != nil {
+			c.err = err
+			return false
+		}
+		if next <= begin {
+			return true
+		}
+
+		if c.cfg.Rate > 0 {
+			pause := time.Duration(int64(next-begin) * int64(time.Second) / c.cfg.Rate)
+			select {
+			case <-c.stop:
+				return false
+			case <-time.After(pause):
+			}
+		}
+	}
+	return true
+}
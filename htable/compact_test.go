@@ -0,0 +1,189 @@
+package htable
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestCompact(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 1000
+
+	newTable := func(t *testing.T) (*Table, *hlog.Log) {
+		d, err := device.NewMemory(device.Config{SegmentBits: 12})
+		assert.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, d.Close()) })
+
+		l, err := hlog.New(hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2, Device: d})
+		assert.NoError(t, err)
+
+		table := New(4, WithLog(l))
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			table.Insert(h, key, []byte(fmt.Sprint("val-", i)))
+		}
+		return table, l
+	}
+
+	t.Run("Basic", func(t *testing.T) {
+		table, l := newTable(t)
+
+		// delete a third of the keys and replace another third.
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			switch i % 3 {
+			case 0:
+				assert.That(t, must(table.Delete(h, key)))
+			case 1:
+				table.Insert(h, key, []byte(fmt.Sprint("new-", i)))
+			}
+		}
+
+		until := l.Head()
+		begin, err := table.Compact(h, until)
+		assert.NoError(t, err)
+		assert.Equal(t, begin, l.Begin())
+		assert.Equal(t, begin, until&^hlog.Address(l.PageSize()-1))
+		assert.That(t, begin > 0)
+
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			switch i % 3 {
+			case 0:
+				assert.That(t, table.Lookup(h, key) == nil)
+			case 1:
+				assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("new-", i))
+			case 2:
+				assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+			}
+		}
+
+		// compacting again before the head does nothing.
+		again, err := table.Compact(h, begin)
+		assert.NoError(t, err)
+		assert.Equal(t, again, begin)
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		table, l := newTable(t)
+
+		c, err := table.StartCompactor(CompactConfig{
+			Size:     16 << 10,
+			Chunk:    4 << 10,
+			Interval: time.Millisecond,
+		})
+		assert.NoError(t, err)
+
+		const (
+			workers = 4
+			iters   = 2000
+		)
+
+		// every worker changes and reads keys of its own while the log is
+		// compacted underneath them.
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint("key-", (i+j*workers)%max))
+					val := []byte(fmt.Sprint("val-", i, "-", j))
+					table.Insert(h, key, val)
+					assert.Equal(t, string(table.Lookup(h, key)), string(val))
+
+					other := []byte(fmt.Sprint("key-", (i+j*workers+workers*7)%max))
+					assert.That(t, table.Lookup(h, other) != nil)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		assert.NoError(t, c.Stop())
+		assert.That(t, l.Begin() > 0)
+
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.That(t, table.Lookup(h, key) != nil)
+		}
+	})
+
+	t.Run("ColdLookups", func(t *testing.T) {
+		d, err := device.OpenFile(filepath.Join(t.TempDir(), "log"), device.Config{SegmentBits: 12})
+		assert.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, d.Close()) })
+
+		l, err := hlog.New(hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2, Device: d})
+		assert.NoError(t, err)
+
+		table := New(4, WithLog(l))
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.NoError(t, table.Insert(h, key, []byte(fmt.Sprint("val-", i))))
+		}
+
+		const (
+			workers = 4
+			iters   = 2000
+		)
+
+		// the log is compacted repeatedly while the workers read records
+		// from the device, so the segments holding them are truncated
+		// underneath the reads, which never fail.
+		var done uint32
+		compacted := make(chan struct{})
+		go func() {
+			defer close(compacted)
+
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			for atomic.LoadUint32(&done) == 0 {
+				_, err := table.Compact(h, l.Head())
+				assert.NoError(t, err)
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				var val []byte
+				for j := 0; j < iters; j++ {
+					k := (i + j*workers) % max
+					var ok bool
+					var err error
+					val, ok, err = table.LookupInto(h, []byte(fmt.Sprint("key-", k)), val)
+					assert.NoError(t, err)
+					assert.That(t, ok)
+					assert.Equal(t, string(val), fmt.Sprint("val-", k))
+				}
+			}(i)
+		}
+		wg.Wait()
+		atomic.StoreUint32(&done, 1)
+		<-compacted
+
+		assert.That(t, l.Begin() > 0)
+	})
+}
@@ -0,0 +1,143 @@
+package htable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+// TestCrash runs random workloads against tables whose logs are on a faulty
+// device, checkpointing and crashing at random points, and checks that the
+// table recovered from the last checkpoint matches a model of it.
+func TestCrash(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const keys = 64
+
+	for seed := int64(0); seed < 20; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+
+			// writes fail while failing is set, which only happens right before
+			// a checkpoint, so the checkpoint fails and the table crashes.
+			var failing uint32
+			injected := errors.New("injected")
+			d, err := device.NewFaulty(device.Config{SegmentBits: 20}, device.Faults{
+				Rand:    rand.New(rand.NewSource(seed)),
+				Reorder: true,
+				Tear:    true,
+				WriteError: func(addr uint64, n int) error {
+					if atomic.LoadUint32(&failing) != 0 {
+						return injected
+					}
+					return nil
+				},
+			})
+			assert.NoError(t, err)
+
+			cfg := hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2}
+			cfg.Device = d
+			l, err := hlog.New(cfg)
+			assert.NoError(t, err)
+			table := New(2, WithLog(l))
+
+			var (
+				model  = make(map[string]string) // the state of the table
+				serial uint64                    // the serial of the last change
+
+				ckpt       []byte            // the last durable checkpoint
+				ckptModel  map[string]string // the state it contains
+				ckptSerial uint64            // the serial of its last change
+			)
+
+			for cycle := 0; cycle < 4; cycle++ {
+				table.StartSession(h, "crash", serial)
+
+				for ops := rng.Intn(2000); ops > 0; ops-- {
+					serial++
+					table.Serial(h, serial)
+
+					key := fmt.Sprint("key-", rng.Intn(keys))
+					val := fmt.Sprint("val-", serial)
+					cur, ok := model[key]
+
+					switch rng.Intn(4) {
+					case 0:
+						assert.Equal(t, must(table.Delete(h, []byte(key))), ok)
+						delete(model, key)
+
+					case 1:
+						swapped := must(table.CompareAndSwap(h, []byte(key), []byte(cur), []byte(val)))
+						assert.Equal(t, swapped, ok)
+						if ok {
+							model[key] = val
+						}
+
+					default:
+						table.Insert(h, []byte(key), []byte(val))
+						model[key] = val
+					}
+
+					if rng.Intn(200) != 0 {
+						continue
+					}
+
+					var buf bytes.Buffer
+					if rng.Intn(10) == 0 {
+						atomic.StoreUint32(&failing, 1)
+					}
+					if err := table.CheckpointIndex(h, &buf); err != nil {
+						assert.That(t, errors.Is(err, injected))
+						break
+					}
+
+					ckpt, ckptSerial = buf.Bytes(), serial
+					ckptModel = make(map[string]string, len(model))
+					for k, v := range model {
+						ckptModel[k] = v
+					}
+				}
+
+				// crash and recover from the last checkpoint, if any.
+				atomic.StoreUint32(&failing, 0)
+				d = d.Crash()
+				cfg.Device = d
+
+				if ckpt == nil {
+					l, err := hlog.New(cfg)
+					assert.NoError(t, err)
+					table = New(2, WithLog(l))
+					model, serial = make(map[string]string), 0
+					continue
+				}
+
+				restored, serials, err := Recover(h, bytes.NewReader(ckpt), cfg)
+				assert.NoError(t, err)
+				assert.Equal(t, serials["crash"], ckptSerial)
+
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprint("key-", i)
+					want, ok := ckptModel[key]
+					got := restored.Lookup(h, []byte(key))
+					assert.Equal(t, got != nil, ok)
+					assert.Equal(t, string(got), want)
+				}
+
+				table, serial = restored, ckptSerial
+				model = make(map[string]string, len(ckptModel))
+				for k, v := range ckptModel {
+					model[k] = v
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package htable
+
+import (
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// WithClock causes the table to use the function to get the current time when
+// setting and checking expirations. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(t *Table) { t.clock = now }
+}
+
+// expired returns true if the record has an expiration that has passed.
+func (t *Table) expired(rec *record) bool {
+	return rec.expires != 0 && rec.expires <= t.clock().UnixNano()
+}
+
+// InsertTTL adds the key and value to the table, replacing any existing value,
+// such that it expires after the ttl has elapsed. A non-positive ttl means the
+// record never expires, like Insert. Expired records are treated as absent by
+// every operation, and are removed by Sweep or by being replaced. It returns
+// the same errors as Insert.
+func (t *Table) InsertTTL(h epoch.Handle, key, value []byte, ttl time.Duration) error {
+	if err := t.fits(key, value); err != nil {
+		return err
+	}
+	t.protect(h)
+
+	hash := t.hash(key)
+	rec := newRecord(hash, key, value)
+	if ttl > 0 {
+		rec.expires = t.clock().Add(ttl).UnixNano()
+	}
+	_, err := t.store(h, hash, key, rec)
+
+	t.unprotect(h)
+	return err
+}
+
+// Sweep removes expired records from the buckets starting at the cursor, which
+// should be zero to start a new sweep. Like Scan, it visits whole buckets until
+// at least count records have been visited, and returns the cursor to pass to
+// the next call, or zero if the sweep is complete. It also returns the number of
+// records removed. Calling it periodically with a small count sweeps the table
+// incrementally. If the records are stored in a log and a removal cannot be
+// stored, it stops and returns the error along with the same cursor. It returns
+// ErrClosed if the table is closed.
+func (t *Table) Sweep(h epoch.Handle, cursor uint64, count int) (uint64, int, error) {
+	if t.isClosed() {
+		return cursor, 0, ErrClosed
+	}
+
+	type expired struct {
+		hash uint64
+		key  []byte
+	}
+
+	// the records are removed after the scan because updating may leave the
+	// protected region while the index is growing.
+	var found []expired
+	next, _ := t.scan(h, cursor, count, func(rec *record) bool {
+		if t.expired(rec) {
+			found = append(found, expired{
+				hash: rec.hash,
+				key:  append([]byte(nil), rec.Key()...),
+			})
+		}
+		return true
+	})
+
+	removed := 0
+	for _, ex := range found {
+		t.protect(h)
+
+		// only remove the record if it is still expired and was not replaced.
+		_, act, err := t.modify(h, ex.hash, ex.key, func(cur *record) (action, *record) {
+			if cur != nil {
+				return actionKeep, nil
+			}
+			return actionDelete, nil
+		})
+		if act == actionDelete {
+			removed++
+		}
+
+		t.unprotect(h)
+		if err != nil {
+			return cursor, removed, err
+		}
+	}
+
+	return next, removed, nil
+}
@@ -0,0 +1,80 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestExpire(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	t.Run("Lookup", func(t *testing.T) {
+		table := New(2, WithClock(clock))
+		table.InsertTTL(h, []byte("a"), []byte("1"), time.Second)
+		table.InsertTTL(h, []byte("b"), []byte("2"), 0)
+
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "1")
+		now = now.Add(time.Second)
+
+		_, ok, err := table.LookupInto(h, []byte("a"), nil)
+		assert.NoError(t, err)
+		assert.That(t, !ok)
+		assert.Equal(t, string(table.Lookup(h, []byte("b"))), "2")
+
+		// expired records behave as if they are absent
+		assert.That(t, !must(table.Delete(h, []byte("a"))))
+		_, loaded, err := table.LoadOrStore(h, []byte("a"), []byte("3"))
+		assert.NoError(t, err)
+		assert.That(t, !loaded)
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "3")
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, 2)
+		assert.Equal(t, st.Expired, 0)
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		const max = 100
+
+		table := New(2, WithClock(clock), WithLoadFactor(0))
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.InsertTTL(h, data, data, time.Duration(1+i%2)*time.Second)
+		}
+		now = now.Add(time.Second)
+
+		seen := 0
+		table.Range(h, func(key, val []byte) bool {
+			seen++
+			return true
+		})
+		assert.Equal(t, seen, max/2)
+		assert.Equal(t, table.Stats(h).Expired, max/2)
+
+		removed := 0
+		for cursor := uint64(0); ; {
+			var n int
+			var err error
+			cursor, n, err = table.Sweep(h, cursor, 10)
+			assert.NoError(t, err)
+			removed += n
+			if cursor == 0 {
+				break
+			}
+		}
+		assert.Equal(t, removed, max/2)
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, max/2)
+		assert.Equal(t, st.Expired, 0)
+		assert.Equal(t, table.count(), int64(max/2))
+	})
+}
@@ -0,0 +1,60 @@
+package htable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/zeebo/gofaster/internal/xxh64"
+)
+
+// Hasher computes hashes of keys for a Table.
+type Hasher interface {
+	// Hash returns the hash of the key mixed with the seed. Keys that are not
+	// equal should be unlikely to have equal hashes for a random seed.
+	Hash(seed uint64, key []byte) uint64
+}
+
+// HasherFunc adapts a function into a Hasher.
+type HasherFunc func(seed uint64, key []byte) uint64
+
+// Hash calls the function.
+func (fn HasherFunc) Hash(seed uint64, key []byte) uint64 { return fn(seed, key) }
+
+// xxHasher is the default Hasher using a seeded xxHash.
+type xxHasher struct{}
+
+// Hash returns the seeded xxHash of the key.
+func (xxHasher) Hash(seed uint64, key []byte) uint64 { return xxh64.Sum64(seed, key) }
+
+// WithHasher causes the table to use the Hasher to hash keys. The default is a
+// seeded xxHash.
+func WithHasher(hasher Hasher) Option {
+	return func(t *Table) { t.hasher = hasher }
+}
+
+// WithSeed causes the table to use the seed for hashing keys. The default is a
+// random seed chosen for every table, which makes it hard to choose keys that
+// collide.
+func WithSeed(seed uint64) Option {
+	return func(t *Table) { t.seed = seed }
+}
+
+// randomSeed returns a random seed from the operating system.
+func randomSeed() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// hash returns the hash of the key for the table.
+func (t *Table) hash(key []byte) uint64 {
+	return t.hasher.Hash(t.seed, key)
+}
+
+// Hash returns the hash the table uses for the key, which can be passed to the
+// methods that accept a hash provided by the caller.
+func (t *Table) Hash(key []byte) uint64 {
+	return t.hash(key)
+}
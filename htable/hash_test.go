@@ -0,0 +1,63 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+	"github.com/zeebo/gofaster/internal/xxh64"
+)
+
+func TestHash(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	key := []byte("key")
+
+	t.Run("Seeds", func(t *testing.T) {
+		assert.That(t, New(0).Hash(key) != New(0).Hash(key))
+		assert.Equal(t, New(0, WithSeed(5)).Hash(key), xxh64.Sum64(5, key))
+	})
+
+	t.Run("Hasher", func(t *testing.T) {
+		// every key collides, so everything is in one record chain.
+		table := New(0, WithHasher(HasherFunc(func(seed uint64, key []byte) uint64 {
+			return seed
+		})))
+
+		for i := 0; i < 100; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		table.Grow(h)
+
+		for i := 0; i < 100; i++ {
+			data := []byte(fmt.Sprint(i))
+			assert.Equal(t, string(table.Lookup(h, data)), string(data))
+			assert.That(t, must(table.Delete(h, data)))
+		}
+	})
+
+	t.Run("Hashed", func(t *testing.T) {
+		table := New(0, WithLoadFactor(0))
+
+		for i := 0; i < 100; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.InsertHashed(h, uint64(i)<<tagHashBits|uint64(i), data, data)
+		}
+
+		// growing has to use the provided hashes to split buckets
+		for i := 0; i < 4; i++ {
+			table.Grow(h)
+		}
+
+		for i := 0; i < 100; i++ {
+			data := []byte(fmt.Sprint(i))
+			hash := uint64(i)<<tagHashBits | uint64(i)
+			assert.Equal(t, string(table.LookupHashed(h, hash, data)), string(data))
+			assert.That(t, must(table.DeleteHashed(h, hash, data)))
+			assert.Nil(t, table.LookupHashed(h, hash, data))
+		}
+	})
+}
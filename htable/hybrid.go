@@ -0,0 +1,348 @@
+package htable
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// WithLog causes the table to store its records in the log instead of
+// allocating them individually. Records in the mutable region are deleted in
+// place, and updated in place when the new value is no larger and expires at
+// the same time. Every other change appends a new record to the tail of the
+// log.
+// Records before the head of the log are read from its device when necessary,
+// and are not visited by Scan, Range, Sweep or Stats. Values returned by the
+// table are copied out of the log, and WithMaxBytes has no effect.
+func WithLog(l *hlog.Log) Option {
+	return func(t *Table) { t.log = l }
+}
+
+// fits returns ErrTooLarge if the records are stored in a log and the record
+// for the key and value cannot fit in one of its pages.
+func (t *Table) fits(key, val []byte) error {
+	if t.log != nil && int(recordSize)+len(key)+len(val) > t.log.MaxSize() {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// record returns the record at the location, or nil if it is stored in a log
+// and is no longer in memory. The handle must be protected.
+func (t *Table) record(loc pin.Location) *record {
+	if t.log == nil {
+		return (*record)(pin.Read(loc))
+	}
+	addr := hlog.Address(loc.Address())
+	if !t.log.InMemory(addr) {
+		return nil
+	}
+	return (*record)(t.log.Get(addr))
+}
+
+// dead returns true if a record stored in a log with the location loaded from
+// its next pointer has been deleted.
+func dead(next pin.Location) bool {
+	tg := tag(next.Extra())
+	return tg.Deleting() && !tg.Replacing()
+}
+
+// sealed returns true if the record at the location, with the location loaded
+// from its next pointer, is sealed by a handle changing it. Records are only
+// sealed in the mutable region, so a seal on one that every handle has observed
+// as read only was abandoned, or was left by a change after a checkpoint that
+// the table was recovered from.
+func (t *Table) sealed(loc, next pin.Location) bool {
+	return tag(next.Extra()).Replacing() && hlog.Address(loc.Address()) >= t.log.SafeReadOnly()
+}
+
+// updating returns true if the record at the location is sealed while its
+// value is changed in place, so it must not be read until the handle has left
+// its protected region.
+func (t *Table) updating(loc, next pin.Location) bool {
+	return tag(next.Extra()).Updating() && t.sealed(loc, next)
+}
+
+// exclude waits until every handle that was protected when it was called has
+// left its protected region or entered it again. The handle must be protected,
+// and it is protected again while waiting.
+func exclude(h epoch.Handle) {
+	bumped := epoch.Bump(h)
+	for epoch.ComputeSafe(epoch.ProtectAndDrain(h)) < bumped-1 {
+		runtime.Gosched()
+	}
+}
+
+// refresh leaves and enters the protected region for the handle so that the
+// log can make progress. No records may be held across it.
+func refresh(h epoch.Handle) {
+	epoch.Unprotect(h)
+	runtime.Gosched()
+	epoch.ProtectAndDrain(h)
+}
+
+// write allocates space in the log for a copy of the record, or a tombstone
+// for the key if it is nil, written in the version of the table, and returns
+// its location and the copy.
+func (t *Table) write(h epoch.Handle, hash uint64, key []byte, rec *record, version uint64) (pin.Location, *record, error) {
+	size := int(recordSize) + len(key)
+	if rec != nil {
+		size = int(rec.size())
+	}
+
+	addr, err := t.log.Allocate(h, size)
+	if err != nil {
+		return pin.Location{}, nil, err
+	}
+	lrec := (*record)(t.log.Get(addr))
+	lrec.ref = version
+
+	if rec != nil {
+		lrec.hash = rec.hash
+		lrec.expires = rec.expires
+		lrec.key = rec.key
+		lrec.val = rec.val
+		copy(lrec.slice(recordSize, size-int(recordSize)), rec.slice(recordSize, size-int(recordSize)))
+	} else {
+		lrec.hash = hash
+		lrec.key = uint64(len(key))
+		copy(lrec.Key(), key)
+	}
+
+	return pin.Address(uint64(addr)), lrec, nil
+}
+
+// append is like modify for tables that store their records in a log. Records
+// are never relinked, so every version of a key is kept in the chain with the
+// newest first. Replacing or deleting a record in the mutable region first
+// seals it by flagging its next pointer as being replaced, which ensures only
+// one handle changes it, and deleting it flags it as deleted in place. A value
+// that fits in a record in the mutable region is copied over it once every
+// handle that may be reading it has left its protected region. Records in the
+// read only region are never changed, so a tombstone is appended to delete
+// them, and the entry serializes changes. If the chain continues on the
+// device, the record for the key is read from it unless blind is true, in which
+// case fn is called with nil. If at is not nil, it is set to the address of the
+// record before each call to fn. The handle must be protected, and it may be
+// unprotected and protected again while waiting for the log or the device.
+func (t *Table) append(h epoch.Handle, hash uint64, key []byte, blind bool, at *hlog.Address,
+	fn func(cur *record) (action, *record)) (*record, action, error) {
+
+	var (
+		dloc  pin.Location // the location the chain continued on the device
+		daddr hlog.Address // the address of the record read from the device
+		drec  *record      // the record read from the device for the key
+	)
+
+retry:
+	ix := t.acquire(h, hash)
+	if t.isClosed() {
+		return nil, actionKeep, ErrClosed
+	}
+
+	ex, i := ix.split(hash)
+
+	var (
+		head pin.Location // the location loaded from the entry
+		cloc pin.Location // the location of the current record
+		cur  *record      // the current record
+		rloc pin.Location // the location loaded from the current record
+	)
+
+	begin := t.log.Begin()
+	addr := ix.slot(ex, i)
+	if addr != nil {
+		head = pin.LoadLocation(addr)
+		_, cloc, cur = t.search(addr, head, key)
+	}
+
+	// a checkpoint cuts the changes of each handle where it observes the
+	// version advance. if it has not advanced since the entry was loaded,
+	// every record in the chain is from our version, so ours may be linked in
+	// front of them.
+	version := t.observe(h)
+	if at != nil {
+		*at = hlog.Address(cloc.Address())
+	}
+
+	// records on the device never change, so the record read for the key can be
+	// used for as long as the chain continues at the same location.
+	if cur == nil && !cloc.Nil() && !blind {
+		if cloc != dloc {
+			epoch.Unprotect(h)
+			raddr, rec, err := t.fetchWait(h, hlog.Address(cloc.Address()), begin, key)
+			epoch.Protect(h)
+			if errors.Is(err, device.ErrTruncated) {
+				goto retry
+			} else if err != nil {
+				return nil, actionKeep, err
+			}
+			dloc, daddr, drec = cloc, raddr, rec
+			goto retry
+		}
+		cur = drec
+		if at != nil {
+			*at = daddr
+		}
+	}
+
+	live := cur
+	if cur != nil {
+		rloc = pin.LoadLocation(&cur.next)
+
+		// if the record is sealed, someone else is replacing, removing or
+		// updating it. they may be waiting for us to leave the protected
+		// region, so refresh.
+		if t.sealed(cloc, rloc) {
+			refresh(h)
+			goto retry
+		}
+		if dead(rloc) {
+			cur, live = nil, nil
+		} else if t.expired(live) {
+			live = nil
+		}
+	}
+
+	act, rec := fn(live)
+
+	switch {
+	case act == actionKeep:
+		return live, act, nil
+
+	case act == actionDelete && cur == nil:
+		return live, actionKeep, nil
+	}
+
+	// records between the safe read only offset and the read only offset may
+	// still be changed in place by handles that have not observed them as read
+	// only, so wait for them to.
+	mutable := cur != nil && t.log.Mutable(hlog.Address(cloc.Address()))
+	if cur != nil && !mutable && hlog.Address(cloc.Address()) >= t.log.SafeReadOnly() {
+		refresh(h)
+		goto retry
+	}
+
+	// records from an earlier version may be part of a checkpoint that has
+	// not cut the log yet, so they are only sealed while being replaced.
+	inPlace := mutable && cur.ref == version
+
+	switch {
+	case act == actionDelete && inPlace:
+		// no handle can have observed the record as immutable, so it is safe
+		// to flag it in place.
+		mloc := rloc.WithExtra(uint16(tag(rloc.Extra()).WithDelete()))
+		if !pin.CompareAndSwapLocation(&cur.next, rloc, mloc) {
+			goto retry
+		}
+		t.removed(h, cur)
+		return live, act, nil
+
+	case act == actionStore && inPlace && rec != cur && rec.expires == cur.expires && rec.val <= cur.val:
+		// seal the record as being updated, and wait for every handle that
+		// may have read it before it was sealed.
+		uloc := rloc.WithExtra(uint16(tag(rloc.Extra()).WithReplace()))
+		if !pin.CompareAndSwapLocation(&cur.next, rloc, uloc) {
+			goto retry
+		}
+		exclude(h)
+
+		// the record may have become read only while we waited, in which case
+		// it may be being flushed, so the seal is abandoned and it must be
+		// replaced instead. otherwise no handle can have observed it as read
+		// only since we checked, so it can be changed until we leave the
+		// protected region, unless a checkpoint has advanced the version.
+		if !t.log.Mutable(hlog.Address(cloc.Address())) {
+			refresh(h)
+			goto retry
+		}
+		if atomic.LoadUint64(&t.version) != version {
+			pin.StoreLocation(&cur.next, rloc)
+			goto retry
+		}
+
+		size := cur.size()
+		copy(cur.slice(recordSize+uintptr(cur.key), int(rec.val)), rec.Val())
+		cur.val = rec.val
+		t.account(h, cur.size()-size)
+
+		pin.StoreLocation(&cur.next, rloc)
+		return live, act, nil
+	}
+
+	if act != actionStore {
+		rec = nil
+	}
+	nloc, nrec, err := t.write(h, hash, key, rec, version)
+	if err == hlog.ErrAgain {
+		refresh(h)
+		goto retry
+	} else if err != nil {
+		return live, actionKeep, err
+	}
+	naddr := hlog.Address(nloc.Address())
+
+	// allocating may protect the handle again at a later epoch, so the version
+	// may have advanced since we observed it.
+	if atomic.LoadUint64(&t.version) != version {
+		t.log.Invalidate(naddr)
+		goto retry
+	}
+
+	if cur == nil && addr == nil {
+		// there is no entry for the hash bits, so claim a new one.
+		if !ix.claim(ex, i, nloc) {
+			t.log.Invalidate(naddr)
+			runtime.Gosched()
+			goto retry
+		}
+		t.added(h, ix, nrec)
+		return live, act, nil
+	}
+
+	// the entry may have been emptied or reused since we found it, so check
+	// the tag is the same.
+	if head.Nil() || head.Extra() != ex {
+		t.log.Invalidate(naddr)
+		goto retry
+	}
+
+	// seal the current record so that no other handle changes it while our
+	// record is linked in front of it.
+	if mutable {
+		mloc := rloc.WithExtra(uint16(tag(rloc.Extra()).WithDelete().WithReplace()))
+		if !pin.CompareAndSwapLocation(&cur.next, rloc, mloc) {
+			t.log.Invalidate(naddr)
+			goto retry
+		}
+	}
+
+	next := head
+	if rec == nil {
+		next = head.WithExtra(uint16(tag(head.Extra()).WithDelete()))
+	}
+	pin.StoreLocation(&nrec.next, next)
+
+	if !pin.CompareAndSwapLocation(addr, head, nloc.WithExtra(ex)) {
+		if mutable {
+			pin.StoreLocation(&cur.next, rloc)
+		}
+		t.log.Invalidate(naddr)
+		goto retry
+	}
+
+	switch {
+	case cur == nil:
+		t.added(h, ix, nrec)
+	case rec == nil:
+		t.removed(h, cur)
+	default:
+		t.account(h, nrec.size()-cur.size())
+	}
+	return live, act, nil
+}
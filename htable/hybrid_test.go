@@ -0,0 +1,278 @@
+package htable
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestHybrid(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	newTable := func(t *testing.T, cfg hlog.Config, opts ...Option) (*Table, *hlog.Log) {
+		l, err := hlog.New(cfg)
+		assert.NoError(t, err)
+		return New(2, append(opts, WithLog(l))...), l
+	}
+
+	t.Run("Basic", func(t *testing.T) {
+		table, l := newTable(t, hlog.Config{PageBits: 12, MemoryPages: 4})
+
+		table.Insert(h, []byte("a"), []byte("1"))
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "1")
+
+		// replacing with a value that fits updates in place
+		tail := l.Tail()
+		table.Insert(h, []byte("a"), []byte("2"))
+		assert.Equal(t, l.Tail(), tail)
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "2")
+
+		// replacing with a larger value appends a new version
+		table.Insert(h, []byte("a"), []byte("22"))
+		assert.That(t, l.Tail() > tail)
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "22")
+
+		// and shrinking it updates in place again
+		tail = l.Tail()
+		table.Insert(h, []byte("a"), []byte("2"))
+		assert.Equal(t, l.Tail(), tail)
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "2")
+		assert.Equal(t, table.bytes(), int64(recordSize)+2)
+
+		// deleting in the mutable region does not append
+		tail = l.Tail()
+		assert.That(t, must(table.Delete(h, []byte("a"))))
+		assert.Equal(t, l.Tail(), tail)
+		assert.That(t, table.Lookup(h, []byte("a")) == nil)
+		assert.That(t, !must(table.Delete(h, []byte("a"))))
+
+		val, loaded, err := table.LoadOrStore(h, []byte("a"), []byte("3"))
+
+		assert.NoError(t, err)
+		assert.That(t, !loaded)
+		assert.Equal(t, string(val), "3")
+		assert.That(t, must(table.CompareAndSwap(h, []byte("a"), []byte("3"), []byte("4"))))
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "4")
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, 1)
+		assert.Equal(t, table.count(), int64(1))
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		table, l := newTable(t, hlog.Config{PageBits: 8, MemoryPages: 16, MutablePages: 1})
+
+		table.Insert(h, []byte("a"), []byte("1"))
+		for i := 0; i < 20; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		assert.That(t, l.ReadOnly() > 0)
+
+		// deleting a record in the read only region appends a tombstone
+		tail := l.Tail()
+		assert.That(t, must(table.Delete(h, []byte("a"))))
+		assert.That(t, l.Tail() > tail)
+		assert.That(t, table.Lookup(h, []byte("a")) == nil)
+
+		table.Insert(h, []byte("a"), []byte("2"))
+		assert.Equal(t, string(table.Lookup(h, []byte("a"))), "2")
+
+		n := 0
+		table.Range(h, func(key, val []byte) bool {
+			n++
+			return true
+		})
+		assert.Equal(t, n, 21)
+		assert.Equal(t, table.Stats(h).Records, 21)
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		table, _ := newTable(t, hlog.Config{PageBits: 8, MemoryPages: 2, MutablePages: 1})
+
+		var err error
+		for i := 0; err == nil; i++ {
+			data := []byte(fmt.Sprint(i))
+			_, err = table.Upsert(h, data, data)
+		}
+		assert.That(t, errors.Is(err, ErrOutOfMemory))
+		assert.Equal(t, err.Error(), ErrOutOfMemory.Error()+": "+hlog.ErrFull.Error())
+
+		// every operation that stores a record returns the error.
+		key, val := []byte("key"), []byte("val")
+		assert.That(t, errors.Is(table.Insert(h, key, val), ErrOutOfMemory))
+		assert.That(t, errors.Is(table.InsertTTL(h, key, val, time.Hour), ErrOutOfMemory))
+		assert.That(t, errors.Is(table.MultiInsert(h, [][]byte{key}, [][]byte{val}, nil), ErrOutOfMemory))
+
+		_, loaded, err := table.LoadOrStore(h, key, val)
+		assert.That(t, errors.Is(err, ErrOutOfMemory))
+		assert.That(t, !loaded)
+
+		// deleting a record in the read only region appends a tombstone.
+		deleted, err := table.Delete(h, []byte("0"))
+		assert.That(t, errors.Is(err, ErrOutOfMemory))
+		assert.That(t, !deleted)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		table, _ := newTable(t, hlog.Config{PageBits: 12, MemoryPages: 4})
+		assert.NoError(t, table.Insert(h, []byte("a"), []byte("1")))
+		assert.NoError(t, table.Close(h))
+
+		assert.Equal(t, table.Insert(h, []byte("a"), []byte("2")), ErrClosed)
+		_, ok, err := table.LookupInto(h, []byte("a"), nil)
+		assert.Equal(t, err, ErrClosed)
+		assert.That(t, !ok)
+		_, loaded, err := table.LoadOrStore(h, []byte("b"), []byte("1"))
+		assert.Equal(t, err, ErrClosed)
+		assert.That(t, !loaded)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		table, l := newTable(t, hlog.Config{PageBits: 8, MemoryPages: 2, MutablePages: 1})
+
+		key, val := []byte("key"), make([]byte, l.PageSize())
+		assert.Equal(t, table.Insert(h, key, val), ErrTooLarge)
+		_, err := table.Upsert(h, key, val)
+		assert.Equal(t, err, ErrTooLarge)
+		swapped, err := table.CompareAndSwap(h, key, nil, val)
+		assert.Equal(t, err, ErrTooLarge)
+		assert.That(t, !swapped)
+		_, st, err := table.RMW(h, key, nil, func([]byte, bool) ([]byte, bool) { return val, true })
+		assert.Equal(t, err, ErrTooLarge)
+		assert.Equal(t, st, Error)
+		assert.Nil(t, table.Lookup(h, key))
+
+		// the largest record that fits in a page can be stored.
+		val = val[:l.MaxSize()-int(recordSize)-len(key)]
+		assert.NoError(t, table.Insert(h, key, val))
+		assert.Equal(t, len(table.Lookup(h, key)), len(val))
+	})
+
+	t.Run("Grow", func(t *testing.T) {
+		table, _ := newTable(t, hlog.Config{PageBits: 16, MemoryPages: 4}, WithLoadFactor(0))
+
+		const max = 1000
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		table.Grow(h)
+		table.Grow(h)
+		assert.Equal(t, table.Buckets(), 16)
+
+		for i := 0; i < max; i += 2 {
+			assert.That(t, must(table.Delete(h, []byte(fmt.Sprint(i)))))
+		}
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			if i%2 == 0 {
+				assert.That(t, table.Lookup(h, data) == nil)
+			} else {
+				assert.Equal(t, string(table.Lookup(h, data)), string(data))
+			}
+		}
+
+		n := 0
+		table.Range(h, func(key, val []byte) bool {
+			assert.Equal(t, string(key), string(val))
+			n++
+			return true
+		})
+		assert.Equal(t, n, max/2)
+		assert.Equal(t, table.Stats(h).Records, max/2)
+	})
+
+	t.Run("InPlace", func(t *testing.T) {
+		table, l := newTable(t, hlog.Config{PageBits: 16, MemoryPages: 64, MutablePages: 4})
+
+		vals := [][]byte{[]byte("aaaaaaaa"), []byte("bbbbbbbb")}
+		table.Insert(h, []byte("k"), vals[0])
+		tail := l.Tail()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			for i := 0; i < 1000; i++ {
+				assert.NoError(t, table.Insert(h, []byte("k"), vals[i%2]))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			for i := 0; i < 1000; i++ {
+				val := string(table.Lookup(h, []byte("k")))
+				assert.That(t, val == string(vals[0]) || val == string(vals[1]))
+				table.Range(h, func(key, val []byte) bool {
+					assert.That(t, string(val) == string(vals[0]) || string(val) == string(vals[1]))
+					return true
+				})
+			}
+		}()
+		wg.Wait()
+
+		assert.Equal(t, l.Tail(), tail)
+		assert.Equal(t, string(table.Lookup(h, []byte("k"))), string(vals[1]))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		table, _ := newTable(t, hlog.Config{PageBits: 16, MemoryPages: 64, MutablePages: 4})
+
+		const (
+			workers = 8
+			keys    = 16
+			iters   = 512
+		)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint(j % keys))
+					for {
+						old, loaded, err := table.LoadOrStore(h, key, []byte("1"))
+						assert.NoError(t, err)
+						if !loaded {
+							break
+						}
+						next := []byte(fmt.Sprint(atoi(old) + 1))
+						if must(table.CompareAndSwap(h, key, old, next)) {
+							break
+						}
+					}
+
+					own := []byte(fmt.Sprint("own-", i, "-", j))
+					table.Insert(h, own, own)
+					assert.Equal(t, string(table.Lookup(h, own)), string(own))
+					assert.That(t, must(table.CompareAndDelete(h, own, own)))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for j := 0; j < keys; j++ {
+			key := []byte(fmt.Sprint(j))
+			assert.Equal(t, atoi(table.Lookup(h, key)), workers*iters/keys)
+		}
+		assert.Equal(t, table.Stats(h).Records, keys)
+	})
+}
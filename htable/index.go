@@ -0,0 +1,322 @@
+package htable
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/risky"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// index is a power of two sized array of buckets.
+type index struct {
+	buckets []bucket
+	bits    uint64 // 2^bits buckets
+	mask    uint64
+}
+
+// newIndex constructs an index with 2^bits buckets.
+func newIndex(bits uint64) *index {
+	return &index{
+		buckets: make([]bucket, 1<<bits),
+		bits:    bits,
+		mask:    1<<bits - 1,
+	}
+}
+
+// split turns the hash into ex hash bits and bucket index.
+func (ix *index) split(hash uint64) (uint16, uint64) {
+	return uint16(hash) & tagHashMask, hash >> tagHashBits & ix.mask
+}
+
+// bucket returns the bucket for the given index.
+func (ix *index) bucket(i uint64) *bucket {
+	ptr := risky.Index(unsafe.Pointer(&ix.buckets), bucketSize, uintptr(i))
+	return (*bucket)(unsafe.Pointer(ptr))
+}
+
+// put stores the location into an empty entry in the chain of buckets starting
+// at the index, allocating overflow buckets as necessary. It must only be used
+// when no other handle can be modifying the buckets.
+func (ix *index) put(i uint64, loc pin.Location) {
+	for bucket := ix.bucket(i); ; bucket = bucket.grow() {
+		for j := range &bucket.entries {
+			addr := &bucket.entries[j]
+			if pin.LoadLocation(addr).Nil() {
+				pin.StoreLocation(addr, loc)
+				return
+			}
+		}
+	}
+}
+
+// the phases an index can be in. growing or clearing the index moves from
+// stable into prepare, and waits for every handle to leave the epoch before
+// moving into migrate. this ensures no operation is using the current index
+// while it is migrated.
+const (
+	phaseStable  = iota // operations use the current index
+	phasePrepare        // operations wait for the migrate phase
+	phaseMigrate        // operations migrate their chunk and use the next index
+)
+
+// the states a chunk of buckets can be in during migration.
+const (
+	chunkPending = iota
+	chunkBusy
+	chunkDone
+)
+
+// chunkBits is the log of the number of buckets migrated at once.
+const chunkBits = 8
+
+// state keeps track of the index for a table and any growth in progress.
+type state struct {
+	phase  uint32
+	cur    *index
+	next   *index
+	chunks []uint32 // the chunkPending/Busy/Done state of each chunk
+	done   uint64   // the number of chunks that are done
+	clear  bool     // if the records are retired instead of migrated
+	logged bool     // if the records are stored in a log and cannot be relinked
+}
+
+// newGrowState constructs a state in the prepare phase that doubles the index.
+func newGrowState(cur *index) *state {
+	chunks := 1
+	if cur.bits > chunkBits {
+		chunks = 1 << (cur.bits - chunkBits)
+	}
+
+	return &state{
+		phase:  phasePrepare,
+		cur:    cur,
+		next:   newIndex(cur.bits + 1),
+		chunks: make([]uint32, chunks),
+	}
+}
+
+// newClearState constructs a state in the prepare phase that retires every
+// record and replaces the index with an empty one of the same size.
+func newClearState(cur *index) *state {
+	st := newGrowState(cur)
+	st.next = newIndex(cur.bits)
+	st.clear = true
+	return st
+}
+
+// help ensures the chunk containing the bucket index in the current index has
+// been migrated to the next index, migrating it if no other handle has started.
+// It returns true if this call finished the last chunk.
+func (s *state) help(h epoch.Handle, i uint64) bool {
+	c := i >> chunkBits
+	addr := &s.chunks[c]
+
+	if atomic.CompareAndSwapUint32(addr, chunkPending, chunkBusy) {
+		start, end := c<<chunkBits, (c+1)<<chunkBits
+		if end > uint64(len(s.cur.buckets)) {
+			end = uint64(len(s.cur.buckets))
+		}
+		for i := start; i < end; i++ {
+			if s.clear {
+				s.retire(h, i)
+			} else {
+				s.migrate(i)
+			}
+		}
+
+		atomic.StoreUint32(addr, chunkDone)
+		return atomic.AddUint64(&s.done, 1) == uint64(len(s.chunks))
+	}
+
+	for atomic.LoadUint32(addr) != chunkDone {
+		runtime.Gosched()
+	}
+	return false
+}
+
+// migrate moves the records in the bucket at index i in the current index into
+// the buckets at index i and i + 2^bits in the next index, based on the next
+// bit of their hash. The records are relinked in place, which is safe because
+// no operation can be reading the current index or the chunks of the next index
+// being migrated.
+func (s *state) migrate(i uint64) {
+	for bucket := s.cur.bucket(i); bucket != nil; bucket = bucket.next() {
+		for j := range &bucket.entries {
+			loc := pin.LoadLocation(&bucket.entries[j])
+			if loc.Nil() {
+				continue
+			}
+
+			// records in a log cannot be relinked, so both buckets share the
+			// chain, and operations skip records for the other bucket.
+			if s.logged {
+				s.next.put(i, loc)
+				s.next.put(i+1<<s.cur.bits, loc)
+				continue
+			}
+
+			var (
+				heads [2]pin.Location
+				tails [2]*record
+			)
+
+			// split the records into two lists preserving their order. every non-nil
+			// location already carries the extra hash bits.
+			for !loc.Nil() {
+				rec := (*record)(pin.Read(loc))
+				k := rec.hash >> tagHashBits >> s.cur.bits & 1
+
+				if tails[k] == nil {
+					heads[k] = loc
+				} else {
+					pin.StoreLocation(&tails[k].next, loc)
+				}
+				tails[k] = rec
+
+				loc = pin.LoadLocation(&rec.next)
+			}
+
+			for k := range &heads {
+				if tails[k] != nil {
+					pin.StoreLocation(&tails[k].next, pin.Location{})
+					s.next.put(i+uint64(k)<<s.cur.bits, heads[k])
+				}
+			}
+		}
+	}
+}
+
+// retire unpins every record in the bucket at index i in the current index. It
+// is safe to unpin them immediately because no operation can be reading the
+// current index. Records stored in a log are left to the log.
+func (s *state) retire(h epoch.Handle, i uint64) {
+	if s.logged {
+		return
+	}
+	for bucket := s.cur.bucket(i); bucket != nil; bucket = bucket.next() {
+		for j := range &bucket.entries {
+			loc := pin.LoadLocation(&bucket.entries[j])
+			for !loc.Nil() {
+				rec := (*record)(pin.Read(loc))
+				next := pin.LoadLocation(&rec.next)
+				pin.Unpin(h, loc)
+				loc = next
+			}
+		}
+	}
+}
+
+// load atomically loads the state of the table.
+func (t *Table) load() *state {
+	return (*state)(atomic.LoadPointer(&t.state))
+}
+
+// acquire returns the index that operations on the hash should use. If the
+// index is growing, it either waits for the migration to start, or ensures the
+// bucket for the hash has been migrated. The handle must be protected, and it
+// may be unprotected and protected again while waiting.
+func (t *Table) acquire(h epoch.Handle, hash uint64) *index {
+	for {
+		st := t.load()
+		switch atomic.LoadUint32(&st.phase) {
+		case phaseStable:
+			return st.cur
+
+		case phaseMigrate:
+			_, i := st.cur.split(hash)
+			if st.help(h, i) {
+				t.finish(st)
+			}
+			return st.next
+		}
+
+		// we have to leave the protected region so that the migrate phase can
+		// begin, and drain so that it begins promptly.
+		epoch.Unprotect(h)
+		runtime.Gosched()
+		epoch.ProtectAndDrain(h)
+	}
+}
+
+// finish replaces the state with a stable one using the migrated index.
+func (t *Table) finish(st *state) {
+	atomic.StorePointer(&t.state, unsafe.Pointer(&state{cur: st.next}))
+}
+
+// change replaces the state of the table with the state returned by next, and
+// helps migrate until it is finished. If next returns nil, no change is
+// necessary. The handle must not be protected.
+func (t *Table) change(h epoch.Handle, next func(cur *index) *state) {
+	var ours *state
+	for {
+		epoch.ProtectAndDrain(h)
+
+		// finish replaces the state, so once ours is gone, it is done.
+		st := t.load()
+		if ours != nil && st != ours {
+			epoch.Unprotect(h)
+			return
+		}
+
+		switch atomic.LoadUint32(&st.phase) {
+		case phaseStable:
+			n := next(st.cur)
+			if n == nil {
+				epoch.Unprotect(h)
+				return
+			}
+			if atomic.CompareAndSwapPointer(&t.state, unsafe.Pointer(st), unsafe.Pointer(n)) {
+				ours = n
+				epoch.BumpWith(h, func(epoch.Handle) {
+					if n.clear {
+						t.reset()
+					}
+					atomic.StoreUint32(&n.phase, phaseMigrate)
+				})
+			}
+
+		case phaseMigrate:
+			for i := range st.chunks {
+				if st.help(h, uint64(i)<<chunkBits) {
+					t.finish(st)
+				}
+			}
+		}
+
+		epoch.Unprotect(h)
+		runtime.Gosched()
+	}
+}
+
+// grow doubles the number of buckets in the index if it has 2^bits buckets,
+// and helps migrate until the table is larger. The handle must not be
+// protected.
+func (t *Table) grow(h epoch.Handle, bits uint64) {
+	t.change(h, func(cur *index) *state {
+		if cur.bits > bits {
+			return nil
+		}
+		st := newGrowState(cur)
+		st.logged = t.log != nil
+		return st
+	})
+}
+
+// Grow doubles the number of buckets in the table while other handles continue
+// to use it. It blocks until the growth is complete, migrating buckets along
+// with any other handles using the table. The handle must not be protected.
+func (t *Table) Grow(h epoch.Handle) {
+	epoch.Protect(h)
+	bits := t.load().cur.bits
+	epoch.Unprotect(h)
+
+	t.grow(h, bits)
+}
+
+// Buckets returns the number of buckets in the table's index.
+func (t *Table) Buckets() int {
+	return len(t.load().cur.buckets)
+}
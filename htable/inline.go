@@ -0,0 +1,287 @@
+package htable
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/machine"
+	"github.com/zeebo/gofaster/internal/risky"
+	"github.com/zeebo/gofaster/internal/xxh64"
+)
+
+// inlineBucket is a cache line sized array of keys and values stored directly
+// in the bucket, with a word of tags for the slots and a pointer to an overflow
+// bucket.
+type inlineBucket struct {
+	tags     uint64 // a lane of 16 bits for each slot
+	keys     [inlineSlots]uint64
+	vals     [inlineSlots]uint64
+	overflow *inlineBucket
+}
+
+const (
+	inlineSlots      = 3
+	inlineBucketSize = unsafe.Sizeof(inlineBucket{})
+)
+
+type ( // ensure the inline bucket is sized to a cache line
+	_ [inlineBucketSize - machine.CacheLine]byte
+	_ [machine.CacheLine - inlineBucketSize]byte
+)
+
+// lanes in the tags of an inline bucket are zero when the slot is empty, and
+// otherwise have the valid bit set. unlike entries in a Table, many slots may
+// share the same hash bits because the keys are compared directly.
+const (
+	laneValidBit     = 1 << 15
+	laneTentativeBit = 1 << 14
+	laneDeleteBit    = 1 << 13
+	laneHashBits     = 13
+	laneHashMask     = 1<<laneHashBits - 1
+)
+
+// lane returns the 16 bits of tags for the slot.
+func lane(tags uint64, slot int) uint16 { return uint16(tags >> (16 * uint(slot))) }
+
+// withLane returns the tags with the lane for the slot replaced.
+func withLane(tags uint64, slot int, l uint16) uint64 {
+	shift := 16 * uint(slot)
+	return tags&^(0xffff<<shift) | uint64(l)<<shift
+}
+
+// loadLane atomically loads the lane for the slot.
+func (b *inlineBucket) loadLane(slot int) uint16 {
+	return lane(atomic.LoadUint64(&b.tags), slot)
+}
+
+// casLane atomically replaces the lane for the slot if it is equal to old,
+// retrying if other lanes change concurrently.
+func (b *inlineBucket) casLane(slot int, old, new uint16) bool {
+	for {
+		tags := atomic.LoadUint64(&b.tags)
+		if lane(tags, slot) != old {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&b.tags, tags, withLane(tags, slot, new)) {
+			return true
+		}
+	}
+}
+
+// next atomically loads the overflow bucket.
+func (b *inlineBucket) next() *inlineBucket {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&b.overflow))
+	return (*inlineBucket)(atomic.LoadPointer(ptr))
+}
+
+// grow atomically allocates an overflow bucket if one does not exist, and
+// returns the overflow bucket.
+func (b *inlineBucket) grow() *inlineBucket {
+	ptr := (*unsafe.Pointer)(unsafe.Pointer(&b.overflow))
+	atomic.CompareAndSwapPointer(ptr, nil, unsafe.Pointer(new(inlineBucket)))
+	return b.next()
+}
+
+// Uint64Table is a concurrent hash table from uint64 keys to uint64 values
+// that stores them directly in its buckets. Values are updated atomically in
+// place, so no records are allocated or pinned. It does not grow its buckets,
+// instead using overflow buckets.
+type Uint64Table struct {
+	buckets []inlineBucket
+	mask    uint64
+	seed    uint64
+	ops     uint64
+}
+
+// NewUint64Table constructs a table with 2^bits buckets holding 3 keys each.
+func NewUint64Table(bits uint64) *Uint64Table {
+	return &Uint64Table{
+		buckets: make([]inlineBucket, 1<<bits),
+		mask:    1<<bits - 1,
+		seed:    randomSeed(),
+	}
+}
+
+// protect enters a protected region for the handle, draining the epoch queue periodically.
+func (t *Uint64Table) protect(h epoch.Handle) {
+	if atomic.AddUint64(&t.ops, 1)%512 == 0 {
+		epoch.ProtectAndDrain(h)
+	} else {
+		epoch.Protect(h)
+	}
+}
+
+// split hashes the key into the lane for it and its bucket.
+func (t *Uint64Table) split(key uint64) (uint16, *inlineBucket) {
+	hash := xxh64.Sum64Uint64(t.seed, key)
+	i := hash >> laneHashBits & t.mask
+	ptr := risky.Index(unsafe.Pointer(&t.buckets), inlineBucketSize, uintptr(i))
+	return laneValidBit | uint16(hash)&laneHashMask, (*inlineBucket)(unsafe.Pointer(ptr))
+}
+
+// find returns the bucket and slot holding the key, or a nil bucket. The
+// handle must be protected. Slots are only reused after an epoch has passed
+// since their deletion, so while protected, the slot holds the key until the
+// lane changes.
+func find(first *inlineBucket, l uint16, key uint64) (*inlineBucket, int) {
+	for b := first; b != nil; b = b.next() {
+		tags := atomic.LoadUint64(&b.tags)
+		for slot := 0; slot < inlineSlots; slot++ {
+			if lane(tags, slot) == l && atomic.LoadUint64(&b.keys[slot]) == key {
+				return b, slot
+			}
+		}
+	}
+	return nil, 0
+}
+
+// claim attempts to add the key and value into an empty slot in the chain of
+// buckets, returning false if there was contention. It marks the lane as
+// tentative while it checks that no other handle is adding the same key.
+func claim(first *inlineBucket, l uint16, key, val uint64) bool {
+	tl := l | laneTentativeBit
+
+	// find an empty slot, allocating overflow buckets as necessary
+	var (
+		cb   *inlineBucket
+		slot int
+	)
+	for b := first; cb == nil; b = b.grow() {
+		for s := 0; s < inlineSlots; s++ {
+			if b.casLane(s, 0, tl) {
+				cb, slot = b, s
+				break
+			}
+		}
+	}
+
+	atomic.StoreUint64(&cb.keys[slot], key)
+	atomic.StoreUint64(&cb.vals[slot], val)
+
+	// rescan for any tentative slots with the same hash bits, whose keys may
+	// not be written yet, or any valid slots with the same key.
+	for b := first; b != nil; b = b.next() {
+		tags := atomic.LoadUint64(&b.tags)
+		for s := 0; s < inlineSlots; s++ {
+			if b == cb && s == slot {
+				continue
+			}
+			switch lane(tags, s) {
+			case tl:
+			case l:
+				if atomic.LoadUint64(&b.keys[s]) != key {
+					continue
+				}
+			default:
+				continue
+			}
+
+			cb.casLane(slot, tl, 0)
+			return false
+		}
+	}
+
+	// otherwise, we won with no contention, so clear tentative bit
+	cb.casLane(slot, tl, l)
+	return true
+}
+
+// Lookup returns the value for the key and true if it exists.
+func (t *Uint64Table) Lookup(h epoch.Handle, key uint64) (uint64, bool) {
+	t.protect(h)
+	defer epoch.Unprotect(h)
+
+	l, first := t.split(key)
+	b, slot := find(first, l, key)
+	if b == nil {
+		return 0, false
+	}
+
+	// if the lane changed, the key was deleted while we read the value.
+	val := atomic.LoadUint64(&b.vals[slot])
+	if b.loadLane(slot) != l {
+		return 0, false
+	}
+	return val, true
+}
+
+// modify atomically applies fn to the value for the key, adding the key with
+// the value init if it does not exist and init is true. It returns the value
+// returned by fn and true if the key existed. fn may be called multiple times.
+func (t *Uint64Table) modify(h epoch.Handle, key uint64, init bool, val uint64,
+	fn func(old uint64) (uint64, bool)) (uint64, bool) {
+
+	t.protect(h)
+	defer epoch.Unprotect(h)
+
+	l, first := t.split(key)
+
+	for {
+		if b, slot := find(first, l, key); b != nil {
+			addr := &b.vals[slot]
+			old := atomic.LoadUint64(addr)
+			new, ok := fn(old)
+			if !ok {
+				return old, true
+			}
+
+			// if the lane changed, the key was deleted, and we may have updated the
+			// value afterwards. that is unobservable, so we can order the update
+			// after the deletion and retry.
+			if atomic.CompareAndSwapUint64(addr, old, new) && b.loadLane(slot) == l {
+				return new, true
+			}
+			continue
+		}
+
+		if !init {
+			return 0, false
+		}
+		if claim(first, l, key, val) {
+			return val, false
+		}
+		runtime.Gosched()
+	}
+}
+
+// Store sets the value for the key.
+func (t *Uint64Table) Store(h epoch.Handle, key, val uint64) {
+	t.modify(h, key, true, val, func(uint64) (uint64, bool) { return val, true })
+}
+
+// Add atomically adds delta to the value for the key, treating a missing key
+// as zero, and returns the new value.
+func (t *Uint64Table) Add(h epoch.Handle, key, delta uint64) uint64 {
+	val, _ := t.modify(h, key, true, delta, func(old uint64) (uint64, bool) { return old + delta, true })
+	return val
+}
+
+// CompareAndSwap sets the value for the key to new if it is equal to old, and
+// returns true if it was able to.
+func (t *Uint64Table) CompareAndSwap(h epoch.Handle, key, old, new uint64) bool {
+	swapped := false
+	t.modify(h, key, false, 0, func(cur uint64) (uint64, bool) {
+		swapped = cur == old
+		return new, swapped
+	})
+	return swapped
+}
+
+// Delete removes the key from the table and returns true if it was able to.
+func (t *Uint64Table) Delete(h epoch.Handle, key uint64) bool {
+	t.protect(h)
+	defer epoch.Unprotect(h)
+
+	l, first := t.split(key)
+	b, slot := find(first, l, key)
+	if b == nil || !b.casLane(slot, l, l|laneDeleteBit) {
+		return false
+	}
+
+	// we use the epoch system to free the slot which ensures no other handles
+	// are reading its key or value.
+	epoch.BumpWith(h, func(epoch.Handle) { b.casLane(slot, l|laneDeleteBit, 0) })
+	return true
+}
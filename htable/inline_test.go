@@ -0,0 +1,130 @@
+package htable
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestUint64Table(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	t.Run("Basic", func(t *testing.T) {
+		const max = 100
+
+		// a single bucket forces overflow buckets and shared hash bits
+		table := NewUint64Table(0)
+		for i := uint64(0); i < max; i++ {
+			table.Store(h, i, i*2)
+		}
+		for i := uint64(0); i < max; i++ {
+			val, ok := table.Lookup(h, i)
+			assert.That(t, ok)
+			assert.Equal(t, val, i*2)
+		}
+
+		assert.That(t, table.Delete(h, 5))
+		assert.That(t, !table.Delete(h, 5))
+		_, ok := table.Lookup(h, 5)
+		assert.That(t, !ok)
+
+		table.Store(h, 5, 7)
+		val, ok := table.Lookup(h, 5)
+		assert.That(t, ok)
+		assert.Equal(t, val, uint64(7))
+
+		_, ok = table.Lookup(h, max)
+		assert.That(t, !ok)
+	})
+
+	t.Run("Conditional", func(t *testing.T) {
+		table := NewUint64Table(2)
+
+		assert.Equal(t, table.Add(h, 1, 3), uint64(3))
+		assert.Equal(t, table.Add(h, 1, 4), uint64(7))
+
+		assert.That(t, !table.CompareAndSwap(h, 2, 0, 1))
+		assert.That(t, !table.CompareAndSwap(h, 1, 3, 1))
+		assert.That(t, table.CompareAndSwap(h, 1, 7, 1))
+
+		val, ok := table.Lookup(h, 1)
+		assert.That(t, ok)
+		assert.Equal(t, val, uint64(1))
+	})
+
+	t.Run("Reuse", func(t *testing.T) {
+		table := NewUint64Table(0)
+		for i := 0; i < 1000; i++ {
+			table.Store(h, uint64(i), uint64(i))
+			assert.That(t, table.Delete(h, uint64(i)))
+		}
+		epoch.ProtectAndDrain(h)
+		epoch.Unprotect(h)
+
+		// deleted slots are reclaimed, so the chain stays short
+		n := 0
+		for b := &table.buckets[0]; b != nil; b = b.next() {
+			n++
+		}
+		assert.That(t, n < 10)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const (
+			workers = 8
+			iters   = 2048
+			keys    = 16
+		)
+
+		table := NewUint64Table(1)
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for i := 0; i < iters; i++ {
+					table.Add(h, uint64(i%keys), 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := uint64(0); i < keys; i++ {
+			val, ok := table.Lookup(h, i)
+			assert.That(t, ok)
+			assert.Equal(t, val, uint64(workers*iters/keys))
+		}
+	})
+}
+
+func BenchmarkUint64Table(b *testing.B) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	table := NewUint64Table(8)
+	for i := uint64(0); i < 256; i++ {
+		table.Store(h, i, i)
+	}
+
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table.Lookup(h, uint64(i&255))
+		}
+	})
+
+	b.Run("Add", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table.Add(h, uint64(i&255), 1)
+		}
+	})
+}
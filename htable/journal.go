@@ -0,0 +1,182 @@
+package htable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/wal"
+)
+
+// the kinds of change appended to the write ahead log. a store is followed by
+// the expiration as a varint, the length of the key as a uvarint, the key and
+// the value. a delete is followed by the key.
+const (
+	journalStore = iota + 1
+	journalDelete
+	journalClear
+)
+
+// WithWAL causes the table to append every change it makes to the write ahead
+// log, so that Replay can rebuild it after a crash. Changes to the same key are
+// appended in the order they are made.
+//
+// Insert and the other changes return once the change is made, possibly before
+// it is journaled and always before it is durable, and they do not return
+// errors appending to the log. A change is durable once the table's Sync
+// returns nil after it, which reports those errors.
+func WithWAL(l *wal.Log) Option {
+	return func(t *Table) { t.wal = l }
+}
+
+// journalFailure wraps an error so that it can be stored in an atomic.Value.
+type journalFailure struct{ err error }
+
+// Sync waits until every change journaled before it was called is durable in
+// the write ahead log, and returns the first error appending a change or
+// writing the log, if any. It returns nil if the table has no write ahead log.
+func (t *Table) Sync() error {
+	if t.wal == nil {
+		return nil
+	}
+	if f, ok := t.walErr.Load().(journalFailure); ok {
+		return f.err
+	}
+	return t.wal.Sync()
+}
+
+// appended keeps the first error appending to the write ahead log for Sync.
+func (t *Table) appended(err error) {
+	if err != nil {
+		t.walErr.CompareAndSwap(nil, journalFailure{err})
+	}
+}
+
+// lock acquires the stripe for the hash, leaving and entering the protected
+// region while waiting so that the handle holding it can make progress. The
+// handle must be protected.
+func (t *Table) lock(h epoch.Handle, hash uint64) {
+	addr := &t.stripes[hash%uint64(len(t.stripes))]
+	for !atomic.CompareAndSwapUint32(addr, 0, 1) {
+		refresh(h)
+	}
+}
+
+// unlock releases the stripe for the hash.
+func (t *Table) unlock(hash uint64) {
+	atomic.StoreUint32(&t.stripes[hash%uint64(len(t.stripes))], 0)
+}
+
+// journal is like apply, but appends the change to the write ahead log, if
+// any. The stripe for the hash is held while the change is made and appended,
+// so that the log has the changes to a key in the order they were made.
+func (t *Table) journal(h epoch.Handle, hash uint64, key []byte, blind bool,
+	fn func(cur *record) (action, *record)) (*record, action, error) {
+
+	if t.wal == nil {
+		return t.apply(h, hash, key, blind, fn)
+	}
+
+	var rec *record
+	t.lock(h, hash)
+	cur, act, err := t.apply(h, hash, key, blind, func(cur *record) (action, *record) {
+		var act action
+		act, rec = fn(cur)
+		return act, rec
+	})
+
+	// errors appending are kept and returned by Sync.
+	s := t.session(h)
+	switch {
+	case err != nil:
+	case act == actionStore:
+		var tmp [2 * binary.MaxVarintLen64]byte
+		n := binary.PutVarint(tmp[:], rec.expires)
+		n += binary.PutUvarint(tmp[n:], rec.key)
+		s.buf = append(append(s.buf[:0], journalStore), tmp[:n]...)
+		s.buf = append(s.buf, rec.Key()...)
+		s.buf = append(s.buf, rec.Val()...)
+		t.appended(t.wal.Append(s.buf))
+	case act == actionDelete:
+		s.buf = append(append(s.buf[:0], journalDelete), key...)
+		t.appended(t.wal.Append(s.buf))
+	}
+	t.unlock(hash)
+
+	return cur, act, err
+}
+
+// journalClear appends a clear to the write ahead log, if any, and clears the
+// table while holding every stripe, so that no change is being made while the
+// clear is appended. The handle must not be protected.
+func (t *Table) journalClear(h epoch.Handle) {
+	if t.wal == nil {
+		t.clear(h)
+		return
+	}
+
+	for i := range &t.stripes {
+		for !atomic.CompareAndSwapUint32(&t.stripes[i], 0, 1) {
+			runtime.Gosched()
+		}
+	}
+	t.appended(t.wal.Append([]byte{journalClear}))
+	t.clear(h)
+	for i := range &t.stripes {
+		atomic.StoreUint32(&t.stripes[i], 0)
+	}
+}
+
+// Replay applies every change in the table's write ahead log to it, without
+// appending them again. It should be called before the table is otherwise
+// used. The handle must not be protected.
+func (t *Table) Replay(h epoch.Handle) error {
+	if t.wal == nil {
+		return nil
+	}
+
+	return t.wal.Replay(func(buf []byte) error {
+		if len(buf) == 0 {
+			return fmt.Errorf("%w: empty change", ErrCorrupt)
+		}
+
+		switch buf[0] {
+		case journalStore:
+			expires, n := binary.Varint(buf[1:])
+			if n <= 0 {
+				return fmt.Errorf("%w: invalid expiration", ErrCorrupt)
+			}
+			buf = buf[1+n:]
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return fmt.Errorf("%w: invalid key", ErrCorrupt)
+			}
+			key, val := buf[n:n+int(size)], buf[n+int(size):]
+
+			hash := t.hash(key)
+			rec := newRecord(hash, key, val)
+			rec.expires = expires
+
+			t.protect(h)
+			_, _, err := t.apply(h, hash, key, true, func(*record) (action, *record) { return actionStore, rec })
+			t.unprotect(h)
+			return err
+
+		case journalDelete:
+			key := buf[1:]
+			t.protect(h)
+			_, _, err := t.apply(h, t.hash(key), key, false, func(*record) (action, *record) { return actionDelete, nil })
+			t.unprotect(h)
+			return err
+
+		case journalClear:
+			t.clear(h)
+			return nil
+
+		default:
+			return fmt.Errorf("%w: unknown change %d", ErrCorrupt, buf[0])
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package htable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+	"github.com/zeebo/gofaster/wal"
+)
+
+func TestJournal(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	open := func(t *testing.T, base string) *wal.Log {
+		l, err := wal.Open(base, wal.Config{Interval: time.Hour, SegmentSize: 4096})
+		assert.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		return l
+	}
+
+	// contents returns every key and value in the table.
+	contents := func(table *Table) map[string]string {
+		m := make(map[string]string)
+		table.Range(h, func(key, val []byte) bool {
+			m[string(key)] = string(val)
+			return true
+		})
+		return m
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+		table := New(2, WithWAL(open(t, base)))
+
+		for i := 0; i < 100; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		table.Clear(h)
+		for i := 0; i < 500; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		for i := 0; i < 500; i += 3 {
+			assert.That(t, must(table.Delete(h, []byte(fmt.Sprint(i)))))
+		}
+		for i := 1; i < 500; i += 3 {
+			data := []byte(fmt.Sprint(i))
+			assert.That(t, must(table.CompareAndSwap(h, data, data, []byte("swapped"))))
+		}
+		table.InsertTTL(h, []byte("ttl"), []byte("ttl"), time.Hour)
+		assert.NoError(t, table.Sync())
+
+		// the table is never closed, as if the process crashed.
+		restored := New(2, WithWAL(open(t, base)))
+		assert.NoError(t, restored.Replay(h))
+		assert.DeepEqual(t, contents(restored), contents(table))
+		assert.Equal(t, restored.count(), table.count())
+
+		// replaying did not append the changes again.
+		assert.NoError(t, restored.Sync())
+		again := New(2, WithWAL(open(t, base)))
+		assert.NoError(t, again.Replay(h))
+		assert.DeepEqual(t, contents(again), contents(table))
+	})
+
+	t.Run("Torn", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+		table := New(2, WithWAL(open(t, base)))
+
+		table.Insert(h, []byte("a"), []byte("1"))
+		table.Insert(h, []byte("b"), []byte("2"))
+		assert.NoError(t, table.Sync())
+
+		// cut the last change short, as if the process crashed writing it.
+		info, err := os.Stat(base + ".1")
+		assert.NoError(t, err)
+		assert.NoError(t, os.Truncate(base+".1", info.Size()-1))
+
+		restored := New(2, WithWAL(open(t, base)))
+		assert.NoError(t, restored.Replay(h))
+		assert.DeepEqual(t, contents(restored), map[string]string{"a": "1"})
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+		table := New(2, WithWAL(open(t, base)))
+
+		const (
+			workers = 8
+			keys    = 16
+			iters   = 256
+		)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint(j % keys))
+					for {
+						old, loaded, err := table.LoadOrStore(h, key, []byte("1"))
+						assert.NoError(t, err)
+						if !loaded {
+							break
+						}
+						next := []byte(fmt.Sprint(atoi(old) + 1))
+						if must(table.CompareAndSwap(h, key, old, next)) {
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.NoError(t, table.Sync())
+
+		restored := New(2, WithWAL(open(t, base)))
+		assert.NoError(t, restored.Replay(h))
+		for j := 0; j < keys; j++ {
+			key := []byte(fmt.Sprint(j))
+			assert.Equal(t, atoi(restored.Lookup(h, key)), workers*iters/keys)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		assert.NoError(t, New(2).Sync())
+
+		l := open(t, filepath.Join(t.TempDir(), "wal"))
+		table := New(2, WithWAL(l))
+		assert.NoError(t, table.Insert(h, []byte("a"), []byte("1")))
+		assert.NoError(t, table.Sync())
+
+		// the change is made even though it cannot be journaled, and Sync
+		// keeps reporting why.
+		assert.NoError(t, l.Close())
+		assert.NoError(t, table.Insert(h, []byte("b"), []byte("2")))
+		assert.Equal(t, string(table.Lookup(h, []byte("b"))), "2")
+		assert.Equal(t, table.Sync(), wal.ErrClosed)
+		assert.Equal(t, table.Sync(), wal.ErrClosed)
+	})
+}
@@ -0,0 +1,54 @@
+package htable
+
+import (
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// isClosed returns true if the table has been closed. Operations check it after
+// acquiring the index so that any operation that misses it is using an index
+// that will be retired by the close.
+func (t *Table) isClosed() bool {
+	return atomic.LoadUint32(&t.closed) != 0
+}
+
+// reset zeros the record and byte counts of every handle. It must only be used
+// when no other handle can be modifying the index.
+func (t *Table) reset() {
+	for i := range &t.counters {
+		c := &t.counters[i]
+		atomic.StoreInt64(&c.records, 0)
+		atomic.StoreInt64(&c.bytes, 0)
+	}
+}
+
+// Clear removes every record from the table by replacing the index with an
+// empty one of the same size, waiting for every handle to stop using the old
+// index before unpinning its records. Operations concurrent with Clear may or
+// may not be removed. The handle must not be protected.
+func (t *Table) Clear(h epoch.Handle) {
+	t.journalClear(h)
+}
+
+// clear is like Clear, but does not append it to the write ahead log.
+func (t *Table) clear(h epoch.Handle) {
+	t.change(h, func(cur *index) *state {
+		st := newClearState(cur)
+		st.logged = t.log != nil
+		return st
+	})
+}
+
+// Close clears the table and causes every later operation to find nothing and
+// change nothing, with the methods that return an error returning ErrClosed.
+// Records are unpinned, so they are garbage collected once the table and any
+// values returned from it are unreachable. It returns ErrClosed if the table
+// was already closed. The handle must not be protected.
+func (t *Table) Close(h epoch.Handle) error {
+	if !atomic.CompareAndSwapUint32(&t.closed, 0, 1) {
+		return ErrClosed
+	}
+	t.clear(h)
+	return nil
+}
@@ -0,0 +1,141 @@
+package htable
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestLifecycle(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 100
+
+	fill := func(table *Table) {
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+	}
+
+	t.Run("Clear", func(t *testing.T) {
+		table := New(2, WithLoadFactor(0))
+		fill(table)
+		table.Clear(h)
+
+		assert.That(t, table.Lookup(h, []byte("0")) == nil)
+		assert.Equal(t, table.Buckets(), 4)
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, 0)
+		assert.Equal(t, table.count(), int64(0))
+		assert.Equal(t, table.bytes(), int64(0))
+
+		fill(table)
+		assert.Equal(t, string(table.Lookup(h, []byte("0"))), "0")
+		assert.Equal(t, table.count(), int64(max))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		table := New(2)
+		fill(table)
+		assert.NoError(t, table.Close(h))
+		assert.Equal(t, table.Close(h), ErrClosed)
+
+		assert.Equal(t, table.Insert(h, []byte("a"), []byte("a")), ErrClosed)
+		assert.That(t, table.Lookup(h, []byte("a")) == nil)
+		assert.Equal(t, table.Stats(h).Records, 0)
+
+		// every method returning an error reports that the table is closed.
+		_, ok, err := table.LookupInto(h, []byte("0"), nil)
+		assert.Equal(t, err, ErrClosed)
+		assert.That(t, !ok)
+		_, err = table.View(h, []byte("0"), func([]byte) {})
+		assert.Equal(t, err, ErrClosed)
+		ok, err = table.Delete(h, []byte("0"))
+		assert.Equal(t, err, ErrClosed)
+		assert.That(t, !ok)
+		_, loaded, err := table.LoadOrStore(h, []byte("a"), []byte("a"))
+		assert.Equal(t, err, ErrClosed)
+		assert.That(t, !loaded)
+		_, err = table.CompareAndSwap(h, []byte("0"), []byte("0"), []byte("1"))
+		assert.Equal(t, err, ErrClosed)
+		_, err = table.CompareAndDelete(h, []byte("0"), []byte("0"))
+		assert.Equal(t, err, ErrClosed)
+		assert.Equal(t, table.InsertTTL(h, []byte("a"), []byte("a"), time.Hour), ErrClosed)
+		assert.Equal(t, table.MultiInsert(h, [][]byte{[]byte("a")}, [][]byte{[]byte("a")}, nil), ErrClosed)
+		_, _, err = table.Sweep(h, 0, 10)
+		assert.Equal(t, err, ErrClosed)
+
+		results := make([]Result, 1)
+		table.MultiLookup(h, [][]byte{[]byte("0")}, results)
+		assert.Equal(t, results[0].Err, ErrClosed)
+
+		_, err = table.Upsert(h, []byte("a"), []byte("a"))
+		assert.Equal(t, err, ErrClosed)
+		_, _, err = table.Read(h, []byte("a"), nil)
+		assert.Equal(t, err, ErrClosed)
+	})
+
+	t.Run("Collected", func(t *testing.T) {
+		table := New(2)
+		fill(table)
+
+		// records are allocated on their own, so finalizers can be attached to
+		// them directly.
+		var finalized uint64
+		table.scan(h, 0, max, func(rec *record) bool {
+			runtime.SetFinalizer(rec, func(*record) { atomic.AddUint64(&finalized, 1) })
+			return true
+		})
+
+		// the pinned records stay alive even though only the pin buffers refer
+		// to them.
+		runtime.GC()
+		runtime.GC()
+		assert.Equal(t, atomic.LoadUint64(&finalized), uint64(0))
+
+		// finalizers run in their own goroutine, so wait for them.
+		assert.NoError(t, table.Close(h))
+		for i := 0; i < 100 && atomic.LoadUint64(&finalized) < max; i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, atomic.LoadUint64(&finalized), uint64(max))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		table := New(2)
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for i := 0; i < 1000; i++ {
+					data := []byte(fmt.Sprint(i % max))
+					table.Insert(h, data, data)
+					table.Lookup(h, data)
+				}
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			table.Clear(h)
+		}
+		wg.Wait()
+
+		table.Clear(h)
+		assert.Equal(t, table.count(), int64(0))
+		assert.Equal(t, table.Stats(h).Records, 0)
+	})
+}
@@ -0,0 +1,133 @@
+package htable
+
+import (
+	"errors"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// LogIterator reads the records of a table that stores its records in a log in
+// the order they were appended.
+type LogIterator struct {
+	t    *Table
+	h    epoch.Handle
+	it   *hlog.Iterator
+	live bool
+
+	rec *record
+	err error
+}
+
+// ScanLog returns an iterator over the records appended to the log of the
+// table between the addresses. The begin address must be where a record was
+// allocated, and is limited to the begin of the log. The end address is limited
+// to the safe read only offset of the log, as records after it may still be
+// changing. If live is true, records that are no longer the newest for their
+// key according to the index are skipped. The handle must not be protected
+// while calling Next, which must not be called concurrently with Close.
+func (t *Table) ScanLog(h epoch.Handle, begin, end hlog.Address, live bool) *LogIterator {
+	it := &LogIterator{t: t, h: h, live: live}
+	if t.log == nil {
+		it.err = ErrNotLogged
+		return it
+	}
+
+	if b := t.log.Begin(); begin < b {
+		begin = b
+	}
+	if sro := t.log.SafeReadOnly(); end > sro {
+		end = sro
+	}
+	it.it = t.log.Iterate(h, begin, end)
+	return it
+}
+
+// Next advances the iterator to the next record, and returns false when there
+// are no more records or there was an error.
+func (it *LogIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for it.it.Next() {
+		rec := recordAt(it.it.Record())
+		if rec == nil {
+			it.err = hlog.ErrInvalid
+			return false
+		}
+		if it.live {
+			addr, err := it.t.newest(it.h, rec.hash, rec.Key())
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if addr != it.it.Address() {
+				continue
+			}
+		}
+		it.rec = rec
+		return true
+	}
+
+	it.err = it.it.Err()
+	return false
+}
+
+// Key returns the key of the current record, which is only valid until the
+// next call to Next.
+func (it *LogIterator) Key() []byte { return it.rec.Key() }
+
+// Value returns the value of the current record, which is empty for a
+// tombstone and only valid until the next call to Next.
+func (it *LogIterator) Value() []byte { return it.rec.Val() }
+
+// Address returns the address of the current record.
+func (it *LogIterator) Address() hlog.Address { return it.it.Address() }
+
+// Tombstone returns true if the current record deletes its key.
+func (it *LogIterator) Tombstone() bool { return dead(pin.LoadLocation(&it.rec.next)) }
+
+// Err returns the error that stopped the iterator, if any.
+func (it *LogIterator) Err() error { return it.err }
+
+// newest returns the address of the newest record for the key in the log, or
+// zero if there is none. The handle must not be protected.
+func (t *Table) newest(h epoch.Handle, hash uint64, key []byte) (hlog.Address, error) {
+retry:
+	begin := t.log.Begin()
+
+	epoch.Protect(h)
+	ix := t.acquire(h, hash)
+	if t.isClosed() {
+		epoch.Unprotect(h)
+		return 0, ErrClosed
+	}
+	ex, i := ix.split(hash)
+
+	var (
+		loc pin.Location
+		rec *record
+	)
+	if addr := ix.slot(ex, i); addr != nil {
+		_, loc, rec = t.search(addr, pin.LoadLocation(addr), key)
+	}
+	epoch.Unprotect(h)
+
+	if rec != nil || loc.Nil() {
+		return hlog.Address(loc.Address()), nil
+	}
+
+	raddr, rec, err := t.fetchWait(h, hlog.Address(loc.Address()), begin, key)
+	if errors.Is(err, device.ErrTruncated) {
+		goto retry
+	} else if err != nil {
+		return 0, err
+	}
+	if rec == nil {
+		return 0, nil
+	}
+	return raddr, nil
+}
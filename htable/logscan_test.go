@@ -0,0 +1,109 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestScanLog(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 100
+
+	d, err := device.NewMemory(device.Config{SegmentBits: 12})
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, d.Close()) }()
+
+	l, err := hlog.New(hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2, Device: d})
+	assert.NoError(t, err)
+	table := New(4, WithLog(l))
+
+	// insert every key, then replace the even ones and delete some odd ones
+	// once they are read only so that new records are appended for both.
+	for i := 0; i < max; i++ {
+		table.Insert(h, []byte(fmt.Sprint("key-", i)), []byte(fmt.Sprint("val-", i)))
+	}
+	_, err = l.Flush(h)
+	assert.NoError(t, err)
+	for i := 0; i < max; i++ {
+		key := []byte(fmt.Sprint("key-", i))
+		switch {
+		case i%2 == 0:
+			table.Insert(h, key, []byte(fmt.Sprint("new-", i)))
+		case i%10 == 5:
+			assert.That(t, must(table.Delete(h, key)))
+		}
+	}
+	end, err := l.Flush(h)
+	assert.NoError(t, err)
+	assert.That(t, l.Head() > 0)
+
+	type entry struct {
+		key, val  string
+		tombstone bool
+	}
+	scan := func(live bool) (entries []entry) {
+		it := table.ScanLog(h, 0, end, live)
+		last := hlog.Address(0)
+		for it.Next() {
+			assert.That(t, it.Address() > last)
+			last = it.Address()
+			entries = append(entries, entry{string(it.Key()), string(it.Value()), it.Tombstone()})
+		}
+		assert.NoError(t, it.Err())
+		return entries
+	}
+
+	t.Run("All", func(t *testing.T) {
+		entries := scan(false)
+		assert.Equal(t, len(entries), max+max/2+max/10)
+
+		for i := 0; i < max; i++ {
+			assert.Equal(t, entries[i], entry{fmt.Sprint("key-", i), fmt.Sprint("val-", i), false})
+		}
+		var replaced, deleted int
+		for _, e := range entries[max:] {
+			if e.tombstone {
+				assert.Equal(t, e.val, "")
+				deleted++
+			} else {
+				replaced++
+			}
+		}
+		assert.Equal(t, replaced, max/2)
+		assert.Equal(t, deleted, max/10)
+	})
+
+	t.Run("Live", func(t *testing.T) {
+		entries := scan(true)
+		assert.Equal(t, len(entries), max)
+
+		seen := make(map[string]entry)
+		for _, e := range entries {
+			seen[e.key] = e
+		}
+		for i := 0; i < max; i++ {
+			key := fmt.Sprint("key-", i)
+			switch {
+			case i%2 == 0:
+				assert.Equal(t, seen[key], entry{key, fmt.Sprint("new-", i), false})
+			case i%10 == 5:
+				assert.Equal(t, seen[key], entry{key, "", true})
+			default:
+				assert.Equal(t, seen[key], entry{key, fmt.Sprint("val-", i), false})
+			}
+		}
+	})
+
+	t.Run("NotLogged", func(t *testing.T) {
+		it := New(4).ScanLog(h, 0, end, false)
+		assert.That(t, !it.Next())
+		assert.Equal(t, it.Err(), ErrNotLogged)
+	})
+}
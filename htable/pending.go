@@ -0,0 +1,196 @@
+package htable
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// WithReadCompletion causes Read to return Pending instead of waiting when the
+// record for a key has to be read from the log's device. The function is called
+// with the outcome of the read by CompletePending on the handle that issued it,
+// which is protected, so it must not call back into the table with the same
+// handle. The key and value must not be retained after it returns.
+func WithReadCompletion(fn func(h epoch.Handle, key, val []byte, st Status, err error)) Option {
+	return func(t *Table) { t.onRead = fn }
+}
+
+// alive returns the record read from the device, or nil if it has been deleted
+// or has expired.
+func (t *Table) alive(rec *record) *record {
+	if rec == nil || dead(pin.LoadLocation(&rec.next)) || t.expired(rec) {
+		return nil
+	}
+	return rec
+}
+
+// begin returns the begin of the log, or zero if there is none. Records before
+// it may have been compacted, so loading it before the index ensures that a
+// chain continuing before it has no more records for any key.
+func (t *Table) begin() hlog.Address {
+	if t.log == nil {
+		return 0
+	}
+	return t.log.Begin()
+}
+
+// fetch reads records from the device starting at the address, following their
+// chain until it finds the key or reaches the begin of the log loaded before
+// the chain was, and calls done through the queue with the address and a copy
+// of the record, or nil if the chain ends. If the records are truncated by
+// compaction while being read, the error is device.ErrTruncated, and the chain
+// must be found again. The key must not be modified until done is called.
+func (t *Table) fetch(q *device.Queue, addr, begin hlog.Address, key []byte,
+	done func(h epoch.Handle, addr hlog.Address, rec *record, err error)) {
+
+	if addr < begin || t.rc == nil {
+		t.chase(q, addr, begin, key, done)
+		return
+	}
+
+	// records on the device never change, so the record found by following
+	// the chain from the address is always the same, unless it was compacted.
+	k := cacheKey{addr: addr, hash: t.hash(key)}
+	if raddr, rec := t.rc.get(k, key); rec != nil {
+		if raddr < begin {
+			rec = nil
+		}
+		q.Post(func(h epoch.Handle, err error) { done(h, raddr, rec, err) }, nil)
+		return
+	}
+
+	t.chase(q, addr, begin, key, func(h epoch.Handle, raddr hlog.Address, rec *record, err error) {
+		if err == nil && rec != nil {
+			t.rc.put(k, raddr, rec)
+		}
+		done(h, raddr, rec, err)
+	})
+}
+
+// chase is fetch without the read cache.
+func (t *Table) chase(q *device.Queue, addr, begin hlog.Address, key []byte,
+	done func(h epoch.Handle, addr hlog.Address, rec *record, err error)) {
+
+	if addr < begin {
+		q.Post(func(h epoch.Handle, err error) { done(h, addr, nil, err) }, nil)
+		return
+	}
+
+	t.log.ReadAsync(q, addr, func(h epoch.Handle, buf []byte, err error) {
+		if err != nil {
+			done(h, addr, nil, err)
+			return
+		}
+
+		// the buffer is aligned, and records never refer to later addresses,
+		// so the chain continues on the device.
+		rec := recordAt(buf)
+		if rec == nil {
+			done(h, addr, nil, hlog.ErrInvalid)
+			return
+		}
+		if bytes.Equal(rec.Key(), key) {
+			done(h, addr, rec, nil)
+			return
+		}
+		next := pin.LoadLocation(&rec.next)
+		if next.Nil() {
+			done(h, addr, nil, nil)
+			return
+		}
+		t.chase(q, hlog.Address(next.Address()), begin, key, done)
+	})
+}
+
+// fetchWait is like fetch, but waits for the record and returns it with its
+// address. The handle must not be protected.
+func (t *Table) fetchWait(h epoch.Handle, addr, begin hlog.Address, key []byte) (
+	raddr hlog.Address, rec *record, err error) {
+
+	var q device.Queue
+	t.fetch(&q, addr, begin, key, func(_ epoch.Handle, a hlog.Address, r *record, e error) {
+		raddr, rec, err = a, r, e
+	})
+	q.Complete(h, true)
+	return raddr, rec, err
+}
+
+// lookup is like find, but reads the record from the device and waits for it
+// if it is no longer in memory, returning an error if the read fails or the
+// table is closed. The handle must be protected, and it is unprotected while
+// waiting.
+func (t *Table) lookup(h epoch.Handle, hash uint64, key []byte) (*record, error) {
+retry:
+	begin := t.begin()
+	rec, loc := t.find(h, hash, key)
+	if rec == nil && t.isClosed() {
+		return nil, ErrClosed
+	}
+	if loc.Nil() {
+		return rec, nil
+	}
+
+	epoch.Unprotect(h)
+	_, rec, err := t.fetchWait(h, hlog.Address(loc.Address()), begin, key)
+	epoch.Protect(h)
+	if errors.Is(err, device.ErrTruncated) {
+		goto retry
+	} else if err != nil {
+		return nil, err
+	}
+
+	rec = t.alive(rec)
+	t.referenced(h, rec)
+	return rec, nil
+}
+
+// readPending issues a read for the key from the device starting at the
+// location, which was loaded after begin, calling the completion function when
+// it is done. The handle must be protected.
+func (t *Table) readPending(h epoch.Handle, hash uint64, loc pin.Location, begin hlog.Address, key []byte) {
+	key = append([]byte(nil), key...)
+	t.fetch(&t.session(h).queue, hlog.Address(loc.Address()), begin, key,
+		func(h epoch.Handle, _ hlog.Address, rec *record, err error) {
+			switch {
+			case errors.Is(err, device.ErrTruncated):
+				// the records were compacted while being read, so the key may
+				// have moved.
+				begin := t.begin()
+				rec, loc := t.find(h, hash, key)
+				if !loc.Nil() {
+					t.readPending(h, hash, loc, begin, key)
+				} else if rec == nil {
+					t.onRead(h, key, nil, NotFound, nil)
+				} else {
+					t.onRead(h, key, rec.Val(), OK, nil)
+				}
+				return
+
+			case err != nil:
+				t.onRead(h, key, nil, Error, err)
+				return
+			}
+
+			rec = t.alive(rec)
+			t.referenced(h, rec)
+			if rec == nil {
+				t.onRead(h, key, nil, NotFound, nil)
+			} else {
+				t.onRead(h, key, rec.Val(), OK, nil)
+			}
+		})
+}
+
+// CompletePending calls the completion function of every Read by the handle
+// whose record has been read from the device. If wait is true, it blocks until
+// every Read by the handle has completed. It returns true if no Read by the
+// handle is pending. The handle must not be protected.
+func (t *Table) CompletePending(h epoch.Handle, wait bool) bool {
+	q := &t.session(h).queue
+	q.Complete(h, wait)
+	return q.Pending() == 0
+}
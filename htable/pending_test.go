@@ -0,0 +1,218 @@
+package htable
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestPending(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 1000
+
+	var newTableOn func(t *testing.T, d device.Device, opts ...Option) (*Table, *hlog.Log)
+
+	// newTable constructs a table whose log only keeps a few small pages in
+	// memory, filled with enough records that most are on the device.
+	newTable := func(t *testing.T, opts ...Option) (*Table, *hlog.Log) {
+		d, err := device.OpenFile(filepath.Join(t.TempDir(), "log"), device.Config{SegmentBits: 16})
+		assert.NoError(t, err)
+		return newTableOn(t, d, opts...)
+	}
+
+	// newTableOn is like newTable with the log on the device.
+	newTableOn = func(t *testing.T, d device.Device, opts ...Option) (*Table, *hlog.Log) {
+		t.Cleanup(func() { assert.NoError(t, d.Close()) })
+
+		l, err := hlog.New(hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2, Device: d})
+		assert.NoError(t, err)
+
+		table := New(4, append(opts, WithLog(l))...)
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.NoError(t, table.Insert(h, key, []byte(fmt.Sprint("val-", i))))
+		}
+		assert.That(t, l.Head() > 0)
+		return table, l
+	}
+
+	t.Run("Lookup", func(t *testing.T) {
+		table, _ := newTable(t)
+
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+		}
+		assert.That(t, table.Lookup(h, []byte("missing")) == nil)
+
+		var results [4]Result
+		table.MultiLookup(h, [][]byte{[]byte("key-0"), []byte("key-1"), []byte("missing")}, results[:])
+		assert.Equal(t, string(results[0].Val), "val-0")
+		assert.Equal(t, string(results[1].Val), "val-1")
+		assert.That(t, !results[2].Found)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		table, _ := newTable(t)
+
+		// conditional operations read the current value from the device
+		val, loaded, err := table.LoadOrStore(h, []byte("key-0"), []byte("new"))
+		assert.NoError(t, err)
+		assert.That(t, loaded)
+		assert.Equal(t, string(val), "val-0")
+
+		assert.That(t, !must(table.CompareAndSwap(h, []byte("key-1"), []byte("wrong"), []byte("new"))))
+		assert.That(t, must(table.CompareAndSwap(h, []byte("key-1"), []byte("val-1"), []byte("new"))))
+		assert.Equal(t, string(table.Lookup(h, []byte("key-1"))), "new")
+
+		assert.That(t, must(table.Delete(h, []byte("key-2"))))
+		assert.That(t, !must(table.Delete(h, []byte("key-2"))))
+		assert.That(t, table.Lookup(h, []byte("key-2")) == nil)
+
+		st, err := table.Remove(h, []byte("missing"))
+		assert.NoError(t, err)
+		assert.Equal(t, st, NotFound)
+
+		// blind writes shadow the records on the device
+		table.Insert(h, []byte("key-3"), []byte("new"))
+		assert.Equal(t, string(table.Lookup(h, []byte("key-3"))), "new")
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		type outcome struct {
+			val string
+			st  Status
+		}
+		got := make(map[string]outcome)
+
+		table, l := newTable(t, WithReadCompletion(func(h epoch.Handle, key, val []byte, st Status, err error) {
+			assert.NoError(t, err)
+			assert.That(t, epoch.IsProtected(h))
+			got[string(key)] = outcome{string(val), st}
+		}))
+		assert.That(t, must(table.Delete(h, []byte("key-1"))))
+
+		pending := 0
+		for _, key := range []string{"key-0", "key-1", "missing", fmt.Sprint("key-", max-1)} {
+			val, st, err := table.Read(h, []byte(key), nil)
+			assert.NoError(t, err)
+			if st == Pending {
+				pending++
+			} else {
+				got[key] = outcome{string(val), st}
+			}
+		}
+		assert.That(t, pending > 0)
+		assert.That(t, table.CompletePending(h, true))
+		assert.That(t, l.Head() > 0)
+
+		assert.Equal(t, got["key-0"], outcome{"val-0", OK})
+		assert.Equal(t, got["key-1"], outcome{"", NotFound})
+		assert.Equal(t, got[fmt.Sprint("key-", max-1)], outcome{fmt.Sprint("val-", max-1), OK})
+		assert.Equal(t, got["missing"], outcome{"", NotFound})
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		table, _ := newTable(t)
+
+		const (
+			workers = 4
+			keys    = 64
+			iters   = 256
+		)
+
+		// every worker increments counters that are mostly on the device while
+		// inserting and deleting keys of their own.
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint("count-", j%keys))
+					for {
+						old, loaded, err := table.LoadOrStore(h, key, []byte("1"))
+						assert.NoError(t, err)
+						if !loaded {
+							break
+						}
+						next := []byte(fmt.Sprint(atoi(old) + 1))
+						if must(table.CompareAndSwap(h, key, old, next)) {
+							break
+						}
+					}
+
+					own := []byte(fmt.Sprint("key-", (i*iters+j)%max))
+					table.Insert(h, own, own)
+					assert.Equal(t, string(table.Lookup(h, own)), string(own))
+					assert.That(t, must(table.CompareAndDelete(h, own, own)))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for j := 0; j < keys; j++ {
+			key := []byte(fmt.Sprint("count-", j))
+			assert.Equal(t, atoi(table.Lookup(h, key)), workers*iters/keys)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		errRead := errors.New("read failed")
+
+		var fail uint32
+		d, err := device.NewFaulty(device.Config{SegmentBits: 16}, device.Faults{
+			ReadError: func(uint64, int) error {
+				if atomic.LoadUint32(&fail) != 0 {
+					return errRead
+				}
+				return nil
+			},
+		})
+		assert.NoError(t, err)
+		table, _ := newTableOn(t, d)
+		atomic.StoreUint32(&fail, 1)
+
+		// errors reading the device are returned as they are.
+		st, err := table.Remove(h, []byte("key-0"))
+		assert.Equal(t, err, errRead)
+		assert.Equal(t, st, Error)
+
+		// lookups report the error instead of a missing key.
+		key := []byte("key-0")
+		_, ok, err := table.LookupInto(h, key, nil)
+		assert.Equal(t, err, errRead)
+		assert.That(t, !ok)
+		_, err = table.View(h, key, func([]byte) {})
+		assert.Equal(t, err, errRead)
+		_, st, err = table.Read(h, key, nil)
+		assert.Equal(t, err, errRead)
+		assert.Equal(t, st, Error)
+		assert.Nil(t, table.Lookup(h, key))
+
+		results := make([]Result, 1)
+		table.MultiLookup(h, [][]byte{key}, results)
+		assert.Equal(t, results[0].Err, errRead)
+		assert.That(t, !results[0].Found)
+
+		// once the device recovers, the record is read again.
+		atomic.StoreUint32(&fail, 0)
+		_, ok, err = table.LookupInto(h, key, nil)
+		assert.NoError(t, err)
+		assert.That(t, ok)
+	})
+}
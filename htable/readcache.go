@@ -0,0 +1,167 @@
+package htable
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/risky"
+)
+
+// WithReadCache causes a table that stores its records in a log to keep copies
+// of the records it reads from the log's device in memory, using up to n bytes
+// including their metadata. A copy is found by the address on the device where
+// the chain for its key continued, so changes to the key, which link new records
+// in front of the chain, are never hidden by it. Copies are evicted with the
+// CLOCK algorithm, passing over copies that have been read since the hand last
+// passed them.
+//
+// Unlike the read cache of FASTER, the copies are not kept in a log of their
+// own spliced into the hash chains. They are kept beside the index, so reads
+// that miss the log's memory look them up in a map before going to the device,
+// and changes never have to skip over or invalidate them.
+func WithReadCache(n int64) Option {
+	return func(t *Table) { t.rc = newReadCache(n) }
+}
+
+// cacheShards is the number of independently locked parts of a read cache.
+const cacheShards = 64
+
+// readCache holds copies of records read from the device. The budget is shared
+// by every shard, and copies are evicted from the shards in turn.
+type readCache struct {
+	max    int64
+	bytes  int64  // the size of every copy in every shard
+	hand   uint64 // the shard to evict from next
+	shards [cacheShards]cacheShard
+}
+
+// cacheKey identifies a copy by the address a chain continued at on the device
+// and the hash of the key that was searched for.
+type cacheKey struct {
+	addr hlog.Address
+	hash uint64
+}
+
+// cacheEntry is a copy of the record found for a key.
+type cacheEntry struct {
+	key  cacheKey
+	addr hlog.Address // the address of the record
+	rec  *record
+	ref  bool // set when the copy is read, and cleared by the hand
+}
+
+// cacheShard is a part of a read cache with its own lock and clock.
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	clock   []*cacheEntry
+	hand    int
+	hits    int64
+	misses  int64
+	_       [64]byte
+}
+
+// newReadCache constructs a read cache using up to n bytes.
+func newReadCache(n int64) *readCache {
+	rc := &readCache{max: n}
+	for i := range rc.shards {
+		rc.shards[i].entries = make(map[cacheKey]*cacheEntry)
+	}
+	return rc
+}
+
+// shard returns the shard holding the copy for the cache key.
+func (rc *readCache) shard(k cacheKey) *cacheShard {
+	return &rc.shards[(uint64(k.addr)^k.hash)%cacheShards]
+}
+
+// get returns the copy of the record for the key and its address, or nil if
+// there is none.
+func (rc *readCache) get(k cacheKey, key []byte) (hlog.Address, *record) {
+	s := rc.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[k]
+	if e == nil || !bytes.Equal(e.rec.Key(), key) {
+		s.misses++
+		return 0, nil
+	}
+	s.hits++
+	e.ref = true
+	return e.addr, e.rec
+}
+
+// put keeps a copy of the record found at the address for the cache key,
+// evicting other copies to stay within the budget.
+func (rc *readCache) put(k cacheKey, addr hlog.Address, rec *record) {
+	size := rec.size()
+	if size > rc.max {
+		return
+	}
+
+	buf := risky.Alloc8(int(size))
+	copy(buf, rec.slice(0, int(size)))
+	rec = *(**record)(unsafe.Pointer(&buf))
+
+	s := rc.shard(k)
+	s.mu.Lock()
+	if _, ok := s.entries[k]; ok {
+		s.mu.Unlock()
+		return
+	}
+	e := &cacheEntry{key: k, addr: addr, rec: rec}
+	s.entries[k] = e
+	s.clock = append(s.clock, e)
+	s.mu.Unlock()
+
+	// the copy is counted, so some shard has a copy to evict until the
+	// cache is back within its budget.
+	atomic.AddInt64(&rc.bytes, size)
+	for atomic.LoadInt64(&rc.bytes) > rc.max {
+		i := atomic.AddUint64(&rc.hand, 1) % cacheShards
+		if size := rc.shards[i].evict(); size > 0 {
+			atomic.AddInt64(&rc.bytes, -size)
+		}
+	}
+}
+
+// evict removes the first copy the hand finds that has not been read since it
+// last passed, and returns its size, or 0 if the shard is empty.
+func (s *cacheShard) evict() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.clock) > 0 {
+		e := s.clock[s.hand]
+		if e.ref {
+			e.ref = false
+			s.hand = (s.hand + 1) % len(s.clock)
+			continue
+		}
+
+		delete(s.entries, e.key)
+		last := len(s.clock) - 1
+		s.clock[s.hand], s.clock[last] = s.clock[last], nil
+		s.clock = s.clock[:last]
+		if s.hand >= len(s.clock) {
+			s.hand = 0
+		}
+		return e.rec.size()
+	}
+	return 0
+}
+
+// stats returns the number of reads that found and did not find a copy.
+func (rc *readCache) stats() (hits, misses int64) {
+	for i := range rc.shards {
+		s := &rc.shards[i]
+		s.mu.Lock()
+		hits, misses = hits+s.hits, misses+s.misses
+		s.mu.Unlock()
+	}
+	return hits, misses
+}
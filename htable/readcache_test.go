@@ -0,0 +1,181 @@
+package htable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestReadCache(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 1000
+
+	newTable := func(t *testing.T, budget int64) (*Table, *hlog.Log) {
+		d, err := device.NewMemory(device.Config{SegmentBits: 16})
+		assert.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, d.Close()) })
+
+		l, err := hlog.New(hlog.Config{PageBits: 10, MemoryPages: 4, MutablePages: 2, Device: d})
+		assert.NoError(t, err)
+
+		table := New(4, WithLog(l), WithReadCache(budget))
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			table.Insert(h, key, []byte(fmt.Sprint("val-", i)))
+		}
+		return table, l
+	}
+
+	t.Run("Hits", func(t *testing.T) {
+		table, l := newTable(t, 1<<20)
+
+		for round := 0; round < 2; round++ {
+			for i := 0; i < max; i++ {
+				key := []byte(fmt.Sprint("key-", i))
+				assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+			}
+		}
+		assert.That(t, table.Lookup(h, []byte("missing")) == nil)
+
+		// every key read from the device the first time is a hit the second.
+		st := table.Stats(h)
+		assert.That(t, l.Head() > 0)
+		assert.That(t, st.CacheMisses > 0)
+		assert.That(t, st.CacheHits >= st.CacheMisses-1)
+	})
+
+	t.Run("Updates", func(t *testing.T) {
+		table, _ := newTable(t, 1<<20)
+
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.NotNil(t, table.Lookup(h, key))
+		}
+
+		// change the keys while their old records are cached, and then push
+		// the changes to the device as well.
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			switch i % 3 {
+			case 0:
+				assert.That(t, must(table.Delete(h, key)))
+			case 1:
+				table.Insert(h, key, []byte(fmt.Sprint("new-", i)))
+			}
+		}
+		check := func() {
+			for i := 0; i < max; i++ {
+				key := []byte(fmt.Sprint("key-", i))
+				switch i % 3 {
+				case 0:
+					assert.That(t, table.Lookup(h, key) == nil)
+				case 1:
+					assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("new-", i))
+				case 2:
+					assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+				}
+			}
+		}
+		check()
+		for i := 0; i < max; i++ {
+			table.Insert(h, []byte(fmt.Sprint("filler-", i)), nil)
+		}
+		check()
+		check()
+
+		// conditional changes read the cached records too.
+		key := []byte("key-2")
+		assert.That(t, must(table.CompareAndSwap(h, key, []byte("val-2"), []byte("cas"))))
+		assert.Equal(t, string(table.Lookup(h, key)), "cas")
+		assert.That(t, !must(table.CompareAndSwap(h, key, []byte("val-2"), []byte("again"))))
+	})
+
+	t.Run("Budget", func(t *testing.T) {
+		const budget = 16 << 10
+		table, _ := newTable(t, budget)
+
+		for i := 0; i < max; i++ {
+			key := []byte(fmt.Sprint("key-", i))
+			assert.Equal(t, string(table.Lookup(h, key)), fmt.Sprint("val-", i))
+		}
+
+		var bytes int64
+		for i := range table.rc.shards {
+			for _, e := range table.rc.shards[i].entries {
+				bytes += e.rec.size()
+			}
+		}
+		assert.That(t, bytes > 0)
+		assert.That(t, bytes <= budget)
+		assert.Equal(t, bytes, table.rc.bytes)
+	})
+
+	t.Run("Small", func(t *testing.T) {
+		// the budget is shared by the shards, so a cache too small to give
+		// each of them a record still keeps one.
+		table, _ := newTable(t, 128)
+
+		for round := 0; round < 2; round++ {
+			assert.Equal(t, string(table.Lookup(h, []byte("key-0"))), "val-0")
+		}
+		st := table.Stats(h)
+		assert.Equal(t, st.CacheMisses, int64(1))
+		assert.Equal(t, st.CacheHits, int64(1))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		table, _ := newTable(t, 8<<10)
+
+		const (
+			workers = 4
+			keys    = 64
+			iters   = 256
+		)
+
+		// every worker increments counters that are mostly on the device and
+		// in a small cache, while reading and replacing keys of their own.
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint("count-", j%keys))
+					for {
+						old, loaded, err := table.LoadOrStore(h, key, []byte("1"))
+						assert.NoError(t, err)
+						if !loaded {
+							break
+						}
+						next := []byte(fmt.Sprint(atoi(old) + 1))
+						if must(table.CompareAndSwap(h, key, old, next)) {
+							break
+						}
+					}
+
+					own := []byte(fmt.Sprint("key-", (i*iters+j)%max))
+					assert.NotNil(t, table.Lookup(h, own))
+					table.Insert(h, own, own)
+					assert.Equal(t, string(table.Lookup(h, own)), string(own))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for j := 0; j < keys; j++ {
+			key := []byte(fmt.Sprint("count-", j))
+			assert.Equal(t, atoi(table.Lookup(h, key)), workers*iters/keys)
+		}
+	})
+}
@@ -8,11 +8,16 @@ import (
 )
 
 // record keeps track of a key value pair with some metadata, where the key and
-// value are allocated directly after the metadata.
+// value are allocated directly after the metadata. Tables that store their
+// records in a log have no byte budget, so ref instead holds the version of the
+// table the record was written in.
 type record struct {
-	next pin.Location
-	key  uint64
-	val  uint64
+	next    pin.Location
+	hash    uint64
+	expires int64  // unix nanoseconds at which the record expires, or zero
+	ref     uint64 // set when the record is read, and cleared by eviction
+	key     uint64
+	val     uint64
 	// key and value data follows directly in memory
 }
 
@@ -24,12 +29,14 @@ type ( // make sure the alignment is what we expect for alloc
 )
 
 // newRecord constructs a record with the key and value directly next to each other
-// in memory.
-func newRecord(key, val []byte) *record {
+// in memory. The hash of the key is kept so that the index can grow without
+// knowing how it was computed.
+func newRecord(hash uint64, key, val []byte) *record {
 	buf := risky.Alloc8(int(recordSize) + len(key) + len(val))
 
 	// relies on the data pointer being first in a slice
 	rec := *(**record)(unsafe.Pointer(&buf))
+	rec.hash = hash
 	rec.key = uint64(len(key))
 	rec.val = uint64(len(val))
 
@@ -39,11 +46,31 @@ func newRecord(key, val []byte) *record {
 	return rec
 }
 
+// recordAt returns the record at the start of a buffer read from the log, or
+// nil if the buffer is too short for the record and the key and value it
+// claims to have, as when a page of the device is torn or corrupt.
+func recordAt(buf []byte) *record {
+	if uintptr(len(buf)) < recordSize {
+		return nil
+	}
+	rec := (*record)(unsafe.Pointer(&buf[0]))
+	n := uint64(uintptr(len(buf)) - recordSize)
+	if rec.key > n || rec.val > n-rec.key {
+		return nil
+	}
+	return rec
+}
+
 // slice returns a byte starting offset bytes past the record, with the given length.
 func (r *record) slice(offset uintptr, length int) []byte {
 	return risky.Slice(unsafe.Pointer(uintptr(unsafe.Pointer(r))+offset), length)
 }
 
+// size returns the number of bytes used by the record.
+func (r *record) size() int64 {
+	return int64(recordSize + uintptr(r.key) + uintptr(r.val))
+}
+
 // Key returns a byte slice containing the key in the record.
 func (r *record) Key() []byte {
 	return r.slice(recordSize, int(r.key))
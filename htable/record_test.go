@@ -10,13 +10,30 @@ import (
 
 func TestRecord(t *testing.T) {
 	t.Run("Basic", func(t *testing.T) {
-		rec := newRecord([]byte("key"), []byte("value"))
+		rec := newRecord(10, []byte("key"), []byte("value"))
+		assert.Equal(t, rec.hash, 10)
 		assert.Equal(t, rec.key, 3)
 		assert.Equal(t, rec.val, 5)
 		assert.Equal(t, string(rec.Key()), "key")
 		assert.Equal(t, string(rec.Val()), "value")
 	})
 
+	t.Run("At", func(t *testing.T) {
+		rec := newRecord(10, []byte("key"), []byte("value"))
+		buf := rec.slice(0, int(rec.size()))
+
+		assert.Equal(t, recordAt(buf), rec)
+		assert.Nil(t, recordAt(buf[:len(buf)-1]))
+		assert.Nil(t, recordAt(buf[:recordSize-1]))
+
+		// lengths read from a corrupt page do not reach past the buffer, even
+		// if they overflow when added.
+		rec.val = ^uint64(0)
+		assert.Nil(t, recordAt(buf))
+		rec.key, rec.val = ^uint64(0), 2
+		assert.Nil(t, recordAt(buf))
+	})
+
 	t.Run("Only Basic", func(t *testing.T) {
 		locationType := reflect.TypeOf(pin.Location{})
 		rv := reflect.TypeOf(record{})
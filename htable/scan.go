@@ -0,0 +1,174 @@
+package htable
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"runtime"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// Scans and ranges visit the table one bucket (along with its overflow buckets
+// and record chains) at a time, holding epoch protection only while visiting a
+// bucket. The order of the buckets is given by a cursor that counts with the
+// bits of the bucket index reversed, so that when the index doubles, the two
+// buckets that split from a visited bucket are both considered visited.
+//
+// Records that are present for the entire scan are visited exactly once, even
+// if the index grows during the scan. Records that are inserted or deleted
+// during the scan may or may not be visited. A record that is replaced during
+// the scan is visited once with either the old or the new value. Entries that
+// are tentative, and records that are logically deleted or expired, are
+// skipped.
+
+// advance returns the cursor for the bucket after the cursor for an index with
+// the given mask, or zero if the cursor was for the last bucket.
+func advance(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// visit calls fn with every live record in the chain of buckets starting at
+// the index until fn returns false. It returns the number of records visited
+// and false if fn returned false. The handle must be protected.
+func (t *Table) visit(ix *index, i uint64, fn func(rec *record) bool) (int, bool) {
+	var seen [][]byte
+
+	n := 0
+	for bucket := ix.bucket(i); bucket != nil; bucket = bucket.next() {
+		for j := range &bucket.entries {
+			loc := pin.LoadLocation(&bucket.entries[j])
+			if loc.Nil() || tag(loc.Extra()).Tentative() {
+				continue
+			}
+
+			seen = seen[:0]
+			for !loc.Nil() {
+				rec := t.record(loc)
+				if rec == nil {
+					break
+				}
+				loc = pin.LoadLocation(&rec.next)
+
+				if !t.live(ix, i, rec, loc, &seen) {
+					continue
+				}
+
+				n++
+				if !fn(rec) {
+					return n, false
+				}
+			}
+		}
+	}
+	return n, true
+}
+
+// live returns true if the record is live, given the location loaded from its
+// next pointer and the keys of the records earlier in its chain, which it
+// appends to.
+func (t *Table) live(ix *index, i uint64, rec *record, next pin.Location, seen *[][]byte) bool {
+	if t.log == nil {
+		tg := tag(next.Extra())
+		return !tg.Deleting() || tg.Replacing()
+	}
+
+	// chains in a log hold every version of a key with the newest first, and
+	// may hold records for the other bucket they were split from.
+	if rec.hash>>tagHashBits&ix.mask != i {
+		return false
+	}
+	for _, key := range *seen {
+		if bytes.Equal(key, rec.Key()) {
+			return false
+		}
+	}
+	*seen = append(*seen, rec.Key())
+	return !dead(next)
+}
+
+// settled returns false if the records are stored in a log and a record in the
+// chain of buckets starting at the index is being updated in place, in which
+// case none of them may be visited until the handle has left its protected
+// region. The handle must be protected.
+func (t *Table) settled(ix *index, i uint64) bool {
+	if t.log == nil {
+		return true
+	}
+	for bucket := ix.bucket(i); bucket != nil; bucket = bucket.next() {
+		for j := range &bucket.entries {
+			loc := pin.LoadLocation(&bucket.entries[j])
+			if loc.Nil() || tag(loc.Extra()).Tentative() {
+				continue
+			}
+			for !loc.Nil() {
+				rec := t.record(loc)
+				if rec == nil {
+					break
+				}
+				next := pin.LoadLocation(&rec.next)
+				if t.updating(loc, next) {
+					return false
+				}
+				loc = next
+			}
+		}
+	}
+	return true
+}
+
+// scan visits the buckets starting at the cursor until fn returns false or
+// until at least count records have been visited. It returns the cursor of the
+// next bucket to visit, or zero if every bucket has been visited, and false if
+// fn returned false.
+func (t *Table) scan(h epoch.Handle, cursor uint64, count int, fn func(rec *record) bool) (uint64, bool) {
+	for {
+		t.protect(h)
+
+		// the cursor holds the bucket index in its low bits, so we shift it up
+		// to be in the position of the hash to acquire the index.
+		ix := t.acquire(h, cursor<<tagHashBits)
+		if !t.settled(ix, cursor&ix.mask) {
+			t.unprotect(h)
+			runtime.Gosched()
+			continue
+		}
+		n, ok := t.visit(ix, cursor&ix.mask, fn)
+		cursor = advance(cursor, ix.mask)
+
+		t.unprotect(h)
+
+		if count -= n; !ok || count <= 0 || cursor == 0 {
+			return cursor, ok
+		}
+	}
+}
+
+// Scan calls fn with the key and value of records in the table starting at the
+// cursor, which should be zero to start a new scan. It visits whole buckets
+// until at least count records have been visited, and returns the cursor to
+// pass to the next call, or zero if the scan is complete. The key and value
+// must not be modified or retained after fn returns, and fn must not call back
+// into the table with the same handle.
+func (t *Table) Scan(h epoch.Handle, cursor uint64, count int, fn func(key, val []byte)) uint64 {
+	cursor, _ = t.scan(h, cursor, count, func(rec *record) bool {
+		if !t.expired(rec) {
+			fn(rec.Key(), rec.Val())
+		}
+		return true
+	})
+	return cursor
+}
+
+// Range calls fn with the key and value of every record in the table until fn
+// returns false. It has the same consistency guarantees as Scan, and the key and
+// value must not be modified or retained after fn returns.
+func (t *Table) Range(h epoch.Handle, fn func(key, val []byte) bool) {
+	t.scan(h, 0, math.MaxInt64, func(rec *record) bool {
+		return t.expired(rec) || fn(rec.Key(), rec.Val())
+	})
+}
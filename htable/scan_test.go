@@ -0,0 +1,120 @@
+package htable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestAdvance(t *testing.T) {
+	// with 8 buckets, the cursor visits them in reverse bit order
+	var got []uint64
+	for cursor := uint64(0); ; {
+		got = append(got, cursor)
+		if cursor = advance(cursor, 7); cursor == 0 {
+			break
+		}
+	}
+	assert.DeepEqual(t, got, []uint64{0, 4, 2, 6, 1, 5, 3, 7})
+}
+
+func TestScan(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 1000
+
+	table := New(2, WithLoadFactor(0))
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		table.Insert(h, data, data)
+	}
+
+	t.Run("Range", func(t *testing.T) {
+		seen := make(map[string]int)
+		table.Range(h, func(key, val []byte) bool {
+			assert.Equal(t, string(key), string(val))
+			seen[string(key)]++
+			return true
+		})
+		assert.Equal(t, len(seen), max)
+		for _, n := range seen {
+			assert.Equal(t, n, 1)
+		}
+
+		calls := 0
+		table.Range(h, func(key, val []byte) bool {
+			calls++
+			return calls < 10
+		})
+		assert.Equal(t, calls, 10)
+	})
+
+	t.Run("Grow", func(t *testing.T) {
+		seen := make(map[string]int)
+		cursor := uint64(0)
+		for {
+			cursor = table.Scan(h, cursor, 10, func(key, val []byte) {
+				seen[string(key)]++
+			})
+			if cursor == 0 {
+				break
+			}
+			if table.Buckets() < 64 {
+				table.Grow(h)
+			}
+		}
+
+		assert.That(t, table.Buckets() > 4)
+		assert.Equal(t, len(seen), max)
+		for _, n := range seen {
+			assert.Equal(t, n, 1)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		done := make(chan struct{})
+		defer close(done)
+
+		// replace every value and churn other keys while scanning
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				data := []byte(fmt.Sprint(i % max))
+				table.Insert(h, data, data)
+
+				churn := []byte(fmt.Sprint("churn-", i))
+				table.Insert(h, churn, churn)
+				table.Delete(h, churn)
+			}
+		}()
+
+		for iter := 0; iter < 10; iter++ {
+			seen := make(map[string]int)
+			table.Range(h, func(key, val []byte) bool {
+				seen[string(key)]++
+				return true
+			})
+			for i := 0; i < max; i++ {
+				assert.Equal(t, seen[fmt.Sprint(i)], 1)
+			}
+		}
+	})
+}
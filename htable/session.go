@@ -0,0 +1,115 @@
+package htable
+
+import (
+	"sync/atomic"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// session keeps track of the reads a handle has waiting on the device, the
+// serial numbers of its changes, the version of the table it last observed,
+// and a buffer for appending changes.
+type session struct {
+	queue   device.Queue
+	id      string // the name of the session, or empty if it has none
+	next    uint64 // the serial number of the changes the handle makes next
+	serial  uint64 // the serial number of the last change the handle made
+	version uint64 // the version of the table the handle last observed
+	cut     struct {
+		serial  uint64 // the serial number when it observed the version
+		records int64  // the records counted by the handle at the time
+		bytes   int64  // the bytes counted by the handle at the time
+	}
+	buf []byte // the change the handle is appending to the write ahead log
+}
+
+// session returns the session for the handle.
+func (t *Table) session(h epoch.Handle) *session {
+	return &t.sessions[h.Id()%uint32(len(t.sessions))]
+}
+
+// StartSession names the session for the handle so that every checkpoint
+// records the serial number of the last change it made before the checkpoint.
+// The serial is the number of the last change already reflected in the table,
+// such as one returned by Recover, or zero for a new session. The handle must
+// not be protected.
+func (t *Table) StartSession(h epoch.Handle, id string, serial uint64) {
+	t.cpr.Lock()
+	defer t.cpr.Unlock()
+
+	s := t.session(h)
+	s.id = id
+	s.next = serial
+	atomic.StoreUint64(&s.serial, serial)
+}
+
+// StopSession removes the name of the session for the handle, so that later
+// checkpoints do not record it. The handle must not be protected.
+func (t *Table) StopSession(h epoch.Handle) {
+	t.cpr.Lock()
+	defer t.cpr.Unlock()
+
+	t.session(h).id = ""
+}
+
+// Serial sets the serial number of the changes the handle makes after it is
+// called. Serial numbers must not decrease during a session.
+func (t *Table) Serial(h epoch.Handle, serial uint64) {
+	t.session(h).next = serial
+}
+
+// committed records that the change the handle was making is finished, unless
+// it failed. The handle must be protected since it made the change.
+func (t *Table) committed(h epoch.Handle, err error) {
+	if err == nil {
+		s := t.session(h)
+		atomic.StoreUint64(&s.serial, s.next)
+	}
+}
+
+// observe returns the version of the table for the change the handle is about
+// to make. When the handle first observes a new version, it records the serial
+// number of its last change and its counters, which are its part of the
+// checkpoint that advanced the version. The handle must be protected, and must
+// not have applied anything for the change.
+func (t *Table) observe(h epoch.Handle) uint64 {
+	s := t.session(h)
+	version := atomic.LoadUint64(&t.version)
+	if version != s.version {
+		c := t.counter(h)
+		atomic.StoreUint64(&s.cut.serial, atomic.LoadUint64(&s.serial))
+		atomic.StoreInt64(&s.cut.records, atomic.LoadInt64(&c.records))
+		atomic.StoreInt64(&s.cut.bytes, atomic.LoadInt64(&c.bytes))
+		atomic.StoreUint64(&s.version, version)
+	}
+	return version
+}
+
+// cut returns the serial number of the last change of every named session
+// before it observed the version, along with the number of records and bytes
+// in the table as of those changes. It must be called with cpr held once every
+// change in an earlier version has finished.
+func (t *Table) cut(version uint64) (serials map[string]uint64, records, bytes int64) {
+	serials = make(map[string]uint64)
+	for i := range &t.sessions {
+		s, c := &t.sessions[i], &t.counters[i]
+
+		// a handle that has not observed the version has made no change since
+		// the cut. its values are loaded before its version so that none of
+		// them are from after it observes it.
+		serial := atomic.LoadUint64(&s.serial)
+		n, size := atomic.LoadInt64(&c.records), atomic.LoadInt64(&c.bytes)
+		if atomic.LoadUint64(&s.version) == version {
+			serial = atomic.LoadUint64(&s.cut.serial)
+			n, size = atomic.LoadInt64(&s.cut.records), atomic.LoadInt64(&s.cut.bytes)
+		}
+
+		if s.id != "" {
+			serials[s.id] = serial
+		}
+		records += n
+		bytes += size
+	}
+	return serials, records, bytes
+}
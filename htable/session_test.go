@@ -0,0 +1,247 @@
+package htable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/device"
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+// the sessions used to test checkpoints each change their own keys, with the
+// change numbered n deleting its key every so often and storing n otherwise.
+const (
+	sessionWorkers = 4
+	sessionKeys    = 1024
+)
+
+func sessionKey(w int, n uint64) []byte {
+	return []byte(fmt.Sprint(w, "-", n%sessionKeys))
+}
+
+func sessionChange(table *Table, h epoch.Handle, w int, n uint64) {
+	table.Serial(h, n)
+	if n%7 == 0 {
+		table.Delete(h, sessionKey(w, n))
+	} else {
+		table.Insert(h, sessionKey(w, n), []byte(fmt.Sprint(n)))
+	}
+}
+
+// sessionWrite runs the changes for a session until stop is set.
+func sessionWrite(table *Table, w int, stop *uint32) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	table.StartSession(h, fmt.Sprint("session-", w), 0)
+	defer table.StopSession(h)
+
+	for n := uint64(1); atomic.LoadUint32(stop) == 0; n++ {
+		sessionChange(table, h, w, n)
+	}
+}
+
+// sessionCheck asserts the keys of the session are exactly as they were after
+// the change numbered serial.
+func sessionCheck(t *testing.T, table *Table, h epoch.Handle, w int, serial uint64) {
+	want := make(map[string]string)
+	for n := uint64(1); n <= serial; n++ {
+		if n%7 == 0 {
+			delete(want, string(sessionKey(w, n)))
+		} else {
+			want[string(sessionKey(w, n))] = fmt.Sprint(n)
+		}
+	}
+	for n := uint64(0); n < sessionKeys; n++ {
+		key := sessionKey(w, n)
+		val, ok := want[string(key)]
+		got := table.Lookup(h, key)
+		assert.Equal(t, got != nil, ok)
+		assert.Equal(t, string(got), val)
+	}
+}
+
+func sessionConfig(t *testing.T, path string) hlog.Config {
+	d, err := device.OpenFile(path, device.Config{SegmentBits: 20})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+	return hlog.Config{PageBits: 12, MemoryPages: 8, Device: d}
+}
+
+func TestSession(t *testing.T) {
+	if dir := os.Getenv("HTABLE_CRASH_DIR"); dir != "" {
+		sessionCrash(t, dir)
+		return
+	}
+
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	t.Run("Prefix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "log")
+		l, err := hlog.New(sessionConfig(t, path))
+		assert.NoError(t, err)
+		table := New(2, WithLog(l), WithLoadFactor(1))
+
+		var (
+			wg   sync.WaitGroup
+			stop uint32
+		)
+		for w := 0; w < sessionWorkers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				sessionWrite(table, w, &stop)
+			}(w)
+		}
+
+		var bufs [10]bytes.Buffer
+		for i := range bufs {
+			time.Sleep(5 * time.Millisecond)
+			assert.NoError(t, table.CheckpointIndex(h, &bufs[i]))
+		}
+		atomic.StoreUint32(&stop, 1)
+		wg.Wait()
+
+		// every checkpoint is usable, since the log is only appended to.
+		var (
+			restored *Table
+			serials  map[string]uint64
+			last     = make(map[string]uint64)
+		)
+		for i := range bufs {
+			var err error
+			restored, serials, err = Recover(h, bytes.NewReader(bufs[i].Bytes()), sessionConfig(t, path))
+			assert.NoError(t, err)
+			assert.Equal(t, len(serials), sessionWorkers)
+			for w := 0; w < sessionWorkers; w++ {
+				id := fmt.Sprint("session-", w)
+				assert.That(t, serials[id] >= last[id])
+				sessionCheck(t, restored, h, w, serials[id])
+				last[id] = serials[id]
+			}
+		}
+
+		// sessions continue from their recovered serial numbers
+		serial := serials["session-0"] + 1
+		restored.StartSession(h, "session-0", serials["session-0"])
+		sessionChange(restored, h, 0, serial)
+
+		var buf bytes.Buffer
+		assert.NoError(t, restored.CheckpointIndex(h, &buf))
+		restored, serials, err = Recover(h, bytes.NewReader(buf.Bytes()), sessionConfig(t, path))
+		assert.NoError(t, err)
+		assert.Equal(t, len(serials), 1)
+		assert.Equal(t, serials["session-0"], serial)
+		sessionCheck(t, restored, h, 0, serial)
+	})
+
+	t.Run("Observe", func(t *testing.T) {
+		l, err := hlog.New(hlog.Config{PageBits: 12, MemoryPages: 4})
+		assert.NoError(t, err)
+		table := New(2, WithLog(l))
+
+		table.StartSession(h, "a", 0)
+		defer table.StopSession(h)
+		table.Serial(h, 1)
+		assert.NoError(t, table.Insert(h, []byte("a"), []byte("1")))
+
+		// advancing the version as a checkpoint does cuts the session at its
+		// next change, which is written in the new version.
+		version := atomic.AddUint64(&table.version, 1)
+		table.Serial(h, 2)
+		assert.NoError(t, table.Insert(h, []byte("b"), []byte("2")))
+		table.Serial(h, 3)
+		assert.NoError(t, table.Insert(h, []byte("c"), []byte("3")))
+
+		serials, records, _ := table.cut(version)
+		assert.Equal(t, serials["a"], uint64(1))
+		assert.Equal(t, records, int64(1))
+
+		// records from the earlier version are not changed in place.
+		tail := l.Tail()
+		assert.NoError(t, table.Insert(h, []byte("a"), []byte("4")))
+		assert.That(t, l.Tail() > tail)
+
+		tail = l.Tail()
+		assert.NoError(t, table.Insert(h, []byte("b"), []byte("5")))
+		assert.Equal(t, l.Tail(), tail)
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("skipping crash test in short mode")
+		}
+
+		for i := 0; i < 3; i++ {
+			dir := t.TempDir()
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSession$")
+			cmd.Env = append(os.Environ(), "HTABLE_CRASH_DIR="+dir)
+			assert.NoError(t, cmd.Start())
+			defer func() { _ = cmd.Process.Kill() }()
+
+			// kill the writer at a random point once it has checkpointed.
+			ckpt := filepath.Join(dir, "ckpt")
+			for deadline := time.Now().Add(10 * time.Second); ; {
+				if _, err := os.Stat(ckpt); err == nil {
+					break
+				}
+				assert.That(t, time.Now().Before(deadline))
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+			assert.NoError(t, cmd.Process.Kill())
+			_ = cmd.Wait()
+
+			data, err := os.ReadFile(ckpt)
+			assert.NoError(t, err)
+			restored, serials, err := Recover(h, bytes.NewReader(data), sessionConfig(t, filepath.Join(dir, "log")))
+			assert.NoError(t, err)
+			assert.That(t, len(serials) <= sessionWorkers)
+
+			// sessions missing from the checkpoint started after it.
+			for w := 0; w < sessionWorkers; w++ {
+				sessionCheck(t, restored, h, w, serials[fmt.Sprint("session-", w)])
+			}
+		}
+	})
+}
+
+// sessionCrash runs the sessions in the directory while checkpointing them
+// until the process is killed.
+func sessionCrash(t *testing.T, dir string) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	l, err := hlog.New(sessionConfig(t, filepath.Join(dir, "log")))
+	assert.NoError(t, err)
+	table := New(2, WithLog(l), WithLoadFactor(1))
+
+	var stop uint32
+	for w := 0; w < sessionWorkers; w++ {
+		go sessionWrite(table, w, &stop)
+	}
+
+	// each checkpoint replaces the last once it is durable.
+	for {
+		time.Sleep(time.Millisecond)
+
+		fh, err := os.Create(filepath.Join(dir, "ckpt.tmp"))
+		assert.NoError(t, err)
+		assert.NoError(t, table.CheckpointIndex(h, fh))
+		assert.NoError(t, fh.Sync())
+		assert.NoError(t, fh.Close())
+		assert.NoError(t, os.Rename(filepath.Join(dir, "ckpt.tmp"), filepath.Join(dir, "ckpt")))
+	}
+}
@@ -0,0 +1,130 @@
+package htable
+
+import (
+	"runtime"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/pin"
+)
+
+// Stats describes the contents and shape of a Table.
+type Stats struct {
+	Records   int // live records
+	Expired   int // live records that have expired but have not been removed
+	Bytes     int // bytes used by live records, including their metadata
+	Buckets   int // buckets in the index, not including overflow buckets
+	Overflow  int // overflow buckets
+	Slots     int // entries in all of the buckets, including overflow buckets
+	Used      int // entries that point at a record chain
+	Tentative int // entries observed in the middle of being added
+	Hits      int // lookups that found a record
+	Misses    int // lookups that did not find a record
+	Evictions int // records evicted to stay under the byte budget
+
+	CacheHits   int // reads from the device served by the read cache
+	CacheMisses int // reads from the device not in the read cache
+
+	// OverflowChains[n] is the number of buckets with n overflow buckets.
+	OverflowChains []int
+
+	// RecordChains[n] is the number of entries with n records sharing the
+	// entry's tag, which indicates how often tags collide.
+	RecordChains []int
+}
+
+// increment adds one to the nth element of the histogram, growing it if
+// necessary.
+func increment(hist []int, n int) []int {
+	for len(hist) <= n {
+		hist = append(hist, 0)
+	}
+	hist[n]++
+	return hist
+}
+
+// stats adds information about the chain of buckets starting at the index into
+// the stats. The handle must be protected.
+func (t *Table) stats(ix *index, i uint64, st *Stats) {
+	var seen [][]byte
+
+	overflow := 0
+	for bucket := ix.bucket(i); bucket != nil; bucket = bucket.next() {
+		if bucket != ix.bucket(i) {
+			overflow++
+		}
+
+		for j := range &bucket.entries {
+			st.Slots++
+
+			loc := pin.LoadLocation(&bucket.entries[j])
+			if loc.Nil() {
+				continue
+			} else if tag(loc.Extra()).Tentative() {
+				st.Tentative++
+				continue
+			}
+			st.Used++
+
+			length := 0
+			seen = seen[:0]
+			for !loc.Nil() {
+				rec := t.record(loc)
+				if rec == nil {
+					break
+				}
+				loc = pin.LoadLocation(&rec.next)
+
+				if !t.live(ix, i, rec, loc, &seen) {
+					continue
+				}
+
+				length++
+				st.Records++
+				if t.expired(rec) {
+					st.Expired++
+				}
+				st.Bytes += int(rec.size())
+			}
+			st.RecordChains = increment(st.RecordChains, length)
+		}
+	}
+
+	st.Overflow += overflow
+	st.OverflowChains = increment(st.OverflowChains, overflow)
+}
+
+// Stats walks the table and returns information about its contents. It visits
+// the buckets in the same way as Scan, so the information is approximate if
+// the table is being modified concurrently.
+func (t *Table) Stats(h epoch.Handle) Stats {
+	var st Stats
+
+	for cursor := uint64(0); ; {
+		t.protect(h)
+
+		ix := t.acquire(h, cursor<<tagHashBits)
+		if !t.settled(ix, cursor&ix.mask) {
+			t.unprotect(h)
+			runtime.Gosched()
+			continue
+		}
+		t.stats(ix, cursor&ix.mask, &st)
+		st.Buckets = len(ix.buckets)
+		cursor = advance(cursor, ix.mask)
+
+		t.unprotect(h)
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	st.Hits = int(t.sum(func(c *counter) *int64 { return &c.hits }))
+	st.Misses = int(t.sum(func(c *counter) *int64 { return &c.misses }))
+	st.Evictions = int(t.sum(func(c *counter) *int64 { return &c.evictions }))
+	if t.rc != nil {
+		hits, misses := t.rc.stats()
+		st.CacheHits, st.CacheMisses = int(hits), int(misses)
+	}
+	return st
+}
@@ -0,0 +1,70 @@
+package htable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestStats(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	sum := func(hist []int) (n int) {
+		for _, v := range hist {
+			n += v
+		}
+		return n
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		st := New(3).Stats(h)
+		assert.Equal(t, st.Records, 0)
+		assert.Equal(t, st.Buckets, 8)
+		assert.Equal(t, st.Slots, 8*7)
+		assert.DeepEqual(t, st.OverflowChains, []int{8})
+		assert.Equal(t, len(st.RecordChains), 0)
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		const max = 100
+
+		table := New(0, WithLoadFactor(0))
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		table.Delete(h, []byte("0"))
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Records, max-1)
+		assert.Equal(t, st.Buckets, 1)
+		assert.That(t, st.Overflow >= (max-1)/7)
+		assert.Equal(t, st.Slots, 7*(1+st.Overflow))
+		assert.Equal(t, sum(st.RecordChains), st.Used)
+		assert.Equal(t, st.OverflowChains[st.Overflow], 1)
+		assert.Equal(t, st.Tentative, 0)
+
+		bytes := 0
+		for i := 1; i < max; i++ {
+			bytes += int(recordSize) + 2*len(fmt.Sprint(i))
+		}
+		assert.Equal(t, st.Bytes, bytes)
+	})
+
+	t.Run("Collisions", func(t *testing.T) {
+		table := New(0, WithHasher(HasherFunc(func(seed uint64, key []byte) uint64 {
+			return 0
+		})))
+		for i := 0; i < 10; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+
+		st := table.Stats(h)
+		assert.Equal(t, st.Used, 1)
+		assert.Equal(t, st.RecordChains[10], 1)
+	})
+}
@@ -0,0 +1,204 @@
+package htable
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zeebo/gofaster/epoch"
+)
+
+// Status describes the outcome of an operation.
+type Status uint8
+
+const (
+	OK       Status = iota // the operation completed
+	NotFound               // the key does not exist
+	Pending                // the operation will complete asynchronously
+	Error                  // the operation failed with an error
+)
+
+// String returns a name for the status.
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case NotFound:
+		return "NotFound"
+	case Pending:
+		return "Pending"
+	case Error:
+		return "Error"
+	default:
+		return fmt.Sprintf("Status(%d)", uint8(s))
+	}
+}
+
+// MaxKeySize is the largest key in bytes accepted by the methods that return
+// a Status.
+const MaxKeySize = 1 << 16
+
+var (
+	// ErrKeyTooLarge is returned when a key is larger than MaxKeySize.
+	ErrKeyTooLarge = errors.New("htable: key too large")
+
+	// ErrOutOfMemory is returned when a record could never fit in the byte
+	// budget of the table, or the log storing its records has no room.
+	ErrOutOfMemory = errors.New("htable: record exceeds memory budget")
+
+	// ErrTooLarge is returned when the records are stored in a log and a
+	// record is larger than one of its pages.
+	ErrTooLarge = errors.New("htable: record larger than a page of the log")
+
+	// ErrClosed is returned when the table has been closed.
+	ErrClosed = errors.New("htable: table closed")
+)
+
+// check returns an error if the key and value cannot be stored in the table.
+func (t *Table) check(key, val []byte) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	size := int64(recordSize) + int64(len(key)) + int64(len(val))
+	if t.maxBytes > 0 && size > t.maxBytes {
+		return ErrOutOfMemory
+	}
+	return t.fits(key, val)
+}
+
+// Read copies the value for the key into dst, growing it if necessary, and
+// returns the resulting slice. The status is NotFound if the key does not
+// exist, and Error along with the error if the key is invalid or the record
+// cannot be read from the log's device. If the record has to be read from the
+// device and the table has a read completion function, the status is Pending,
+// and the outcome is passed to the function by CompletePending.
+func (t *Table) Read(h epoch.Handle, key, dst []byte) ([]byte, Status, error) {
+	if err := t.check(key, nil); err != nil {
+		return dst, Error, err
+	}
+	if t.onRead == nil {
+		dst, ok, err := t.LookupInto(h, key, dst)
+		switch {
+		case err != nil:
+			return dst, Error, err
+		case !ok:
+			return dst, NotFound, nil
+		}
+		return dst, OK, nil
+	}
+
+	t.protect(h)
+
+	st := NotFound
+	hash, begin := t.hash(key), t.begin()
+	rec, loc := t.find(h, hash, key)
+	switch {
+	case !loc.Nil():
+		t.readPending(h, hash, loc, begin, key)
+		st = Pending
+	case rec != nil:
+		dst = append(dst[:0], rec.Val()...)
+		st = OK
+	}
+
+	t.unprotect(h)
+	return dst, st, nil
+}
+
+// Upsert adds the key and value to the table, replacing any existing value.
+// The status is Error along with the error if the record cannot be stored.
+func (t *Table) Upsert(h epoch.Handle, key, val []byte) (Status, error) {
+	if err := t.check(key, val); err != nil {
+		return Error, err
+	}
+	t.protect(h)
+
+	hash := t.hash(key)
+	_, err := t.store(h, hash, key, newRecord(hash, key, val))
+
+	t.unprotect(h)
+	if err != nil {
+		return Error, err
+	}
+	return OK, nil
+}
+
+// RMW atomically replaces the value for the key with the one returned by fn,
+// which is called with the current value and true, or nil and false if the key
+// does not exist. fn may be called more than once under contention, and the
+// value passed to it must not be retained. If fn returns false, the value is
+// left unchanged. The value the key has afterwards is copied into dst, growing
+// it if necessary, and the status is NotFound if it has none. The status is
+// Error along with the error if the key is invalid or the value cannot be
+// stored, which includes fn returning a value too large for the table.
+func (t *Table) RMW(h epoch.Handle, key, dst []byte, fn func(old []byte, ok bool) ([]byte, bool)) (
+	[]byte, Status, error) {
+
+	if err := t.check(key, nil); err != nil {
+		return dst, Error, err
+	}
+	t.protect(h)
+
+	var rec *record
+	var verr error // set if the value returned by fn cannot be stored
+	hash := t.hash(key)
+	cur, act, err := t.modify(h, hash, key, func(cur *record) (action, *record) {
+		var old []byte
+		if cur != nil {
+			old = cur.Val()
+		}
+		val, ok := fn(old, cur != nil)
+		if !ok {
+			verr = nil
+			return actionKeep, nil
+		}
+		if verr = t.check(key, val); verr != nil {
+			return actionKeep, nil
+		}
+		rec = newRecord(hash, key, val)
+		return actionStore, rec
+	})
+	if err == nil {
+		err = verr
+	}
+
+	st := NotFound
+	switch {
+	case err != nil:
+	case act == actionStore:
+		dst, st = append(dst[:0], rec.Val()...), OK
+	case cur != nil:
+		dst, st = append(dst[:0], cur.Val()...), OK
+	}
+
+	t.unprotect(h)
+	if err != nil {
+		return dst, Error, err
+	}
+	return dst, st, nil
+}
+
+// Remove removes the key from the table. The status is NotFound if the key
+// does not exist, and Error along with the error if the key is invalid or its
+// removal cannot be stored.
+func (t *Table) Remove(h epoch.Handle, key []byte) (Status, error) {
+	if err := t.check(key, nil); err != nil {
+		return Error, err
+	}
+	t.protect(h)
+
+	cur, _, err := t.modify(h, t.hash(key), key, func(cur *record) (action, *record) {
+		return actionDelete, nil
+	})
+
+	t.unprotect(h)
+	switch {
+	case err != nil:
+		return Error, err
+	case cur == nil:
+		return NotFound, nil
+	}
+	return OK, nil
+}
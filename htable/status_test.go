@@ -0,0 +1,79 @@
+package htable
+
+import (
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestStatus(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	table := New(2, WithMaxBytes(1024))
+
+	st, err := table.Upsert(h, []byte("a"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+
+	// empty values are distinguished from missing keys
+	val, st, err := table.Read(h, []byte("a"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+	assert.Equal(t, len(val), 0)
+
+	_, st, err = table.Read(h, []byte("b"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, st, NotFound)
+
+	st, err = table.Remove(h, []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+
+	st, err = table.Remove(h, []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, st, NotFound)
+
+	st, err = table.Upsert(h, make([]byte, MaxKeySize+1), nil)
+	assert.Equal(t, err, ErrKeyTooLarge)
+	assert.Equal(t, st, Error)
+
+	st, err = table.Upsert(h, []byte("a"), make([]byte, 1024))
+	assert.Equal(t, err, ErrOutOfMemory)
+	assert.Equal(t, st, Error)
+
+	// read modify write sees the current value, and may keep it
+	appendByte := func(old []byte, ok bool) ([]byte, bool) {
+		return append(append([]byte{}, old...), 'x'), true
+	}
+	val, st, err = table.RMW(h, []byte("c"), nil, appendByte)
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+	assert.Equal(t, string(val), "x")
+
+	val, st, err = table.RMW(h, []byte("c"), val, appendByte)
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+	assert.Equal(t, string(val), "xx")
+
+	keep := func(old []byte, ok bool) ([]byte, bool) { return nil, false }
+	val, st, err = table.RMW(h, []byte("c"), nil, keep)
+	assert.NoError(t, err)
+	assert.Equal(t, st, OK)
+	assert.Equal(t, string(val), "xx")
+
+	_, st, err = table.RMW(h, []byte("d"), nil, keep)
+	assert.NoError(t, err)
+	assert.Equal(t, st, NotFound)
+
+	// values returned by fn are limited like the ones passed to Upsert
+	grow := func(old []byte, ok bool) ([]byte, bool) { return make([]byte, 1024), true }
+	_, st, err = table.RMW(h, []byte("c"), nil, grow)
+	assert.Equal(t, err, ErrOutOfMemory)
+	assert.Equal(t, st, Error)
+	assert.Equal(t, string(table.Lookup(h, []byte("c"))), "xx")
+
+	assert.Equal(t, Pending.String(), "Pending")
+	assert.Equal(t, Status(10).String(), "Status(10)")
+}
@@ -1,41 +1,85 @@
 package htable
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
-	"github.com/cespare/xxhash"
 	"github.com/zeebo/gofaster/epoch"
-	"github.com/zeebo/gofaster/internal/risky"
+	"github.com/zeebo/gofaster/hlog"
+	"github.com/zeebo/gofaster/internal/machine"
 	"github.com/zeebo/gofaster/pin"
+	"github.com/zeebo/gofaster/wal"
 )
 
 // Table is a concurrent hash table.
 type Table struct {
-	buckets []bucket
-	bits    uint64 // 2^bits buckets
-	mask    uint64
-	ops     uint64
+	state      unsafe.Pointer // *state
+	ops        uint64
+	loadFactor float64
+	hasher     Hasher
+	seed       uint64
+	clock      func() time.Time
+	maxBytes   int64
+	onEvict    func(key, val []byte)
+	hand       uint64 // the cursor of the next bucket to consider for eviction
+	log        *hlog.Log
+	onRead     func(h epoch.Handle, key, val []byte, st Status, err error)
+	rc         *readCache
+	wal        *wal.Log
+	walErr     atomic.Value // the first error appending to the wal
+	stripes    [256]uint32  // serialize changes to keys while they are journaled
+	closed     uint32
+	version    uint64     // advanced by every checkpoint to cut the log
+	cpr        sync.Mutex // serializes checkpoints and naming sessions
+	counters   [machine.MaxThreads]counter
+	sessions   [machine.MaxThreads]session
 }
 
-// New constructs a table with 2^bits buckets.
-func New(bits uint64) *Table {
-	return &Table{
-		buckets: make([]bucket, 1<<bits),
-		bits:    bits,
-		mask:    1<<bits - 1,
-	}
+// counter keeps track of the number of records and bytes added by a handle,
+// along with cache statistics, padded to avoid false sharing.
+type counter struct {
+	records   int64
+	bytes     int64
+	hits      int64
+	misses    int64
+	evictions int64
+	grow      uint64 // 1 + the bits of the index the handle wants to grow
+	evict     bool   // if the handle noticed the table is over its byte budget
+	_         [15]byte
 }
 
-// split turns the hash into ex hash bits and bucket index.
-func (t *Table) split(hash uint64) (uint16, uint64) {
-	return uint16(hash) & tagHashMask, hash >> tagHashBits & t.mask
+// Option configures a Table.
+type Option func(*Table)
+
+// WithLoadFactor causes the table to double the number of buckets whenever the
+// average number of records per bucket exceeds the factor. A factor of zero
+// disables automatic growth. The default is 4.
+func WithLoadFactor(factor float64) Option {
+	return func(t *Table) { t.loadFactor = factor }
 }
 
-// index returns the bucket for the given index.
-func (t *Table) index(i uint64) *bucket {
-	ptr := risky.Index(unsafe.Pointer(&t.buckets), bucketSize, uintptr(i))
-	return (*bucket)(unsafe.Pointer(ptr))
+// New constructs a table with 2^bits buckets.
+func New(bits uint64, opts ...Option) *Table {
+	t := &Table{
+		state:      unsafe.Pointer(&state{cur: newIndex(bits)}),
+		loadFactor: 4,
+		hasher:     xxHasher{},
+		seed:       randomSeed(),
+		clock:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.log != nil {
+		t.maxBytes = 0
+	}
+	return t
 }
 
 // protect enters a protected region for the handle, draining the epoch queue periodically.
@@ -47,105 +91,532 @@ func (t *Table) protect(h epoch.Handle) {
 	}
 }
 
+// unprotect exits the protected region for the handle, growing the table if the
+// handle noticed it was overloaded, and evicting if it is over its byte budget.
+func (t *Table) unprotect(h epoch.Handle) {
+	epoch.Unprotect(h)
+
+	c := t.counter(h)
+	if c.grow > 0 {
+		bits := c.grow - 1
+		c.grow = 0
+		t.grow(h, bits)
+	}
+	if c.evict {
+		c.evict = false
+		t.evict(h)
+	}
+}
+
+// counter returns the counter for the handle.
+func (t *Table) counter(h epoch.Handle) *counter {
+	return &t.counters[h.Id()%machine.MaxThreads]
+}
+
+// sum returns the total of the field across every handle's counter.
+func (t *Table) sum(field func(c *counter) *int64) int64 {
+	var n int64
+	for i := range &t.counters {
+		n += atomic.LoadInt64(field(&t.counters[i]))
+	}
+	return n
+}
+
+// count returns the number of records in the table.
+func (t *Table) count() int64 {
+	return t.sum(func(c *counter) *int64 { return &c.records })
+}
+
+// bytes returns the number of bytes used by the records in the table.
+func (t *Table) bytes() int64 {
+	return t.sum(func(c *counter) *int64 { return &c.bytes })
+}
+
+// account records that the handle changed the bytes used by records in the
+// index, checking if the table is over its byte budget.
+func (t *Table) account(h epoch.Handle, delta int64) {
+	c := t.counter(h)
+	atomic.AddInt64(&c.bytes, delta)
+	if delta > 0 && t.maxBytes > 0 && t.bytes() > t.maxBytes {
+		c.evict = true
+	}
+}
+
+// added records that the handle added a record to the index, checking if the
+// index should grow.
+func (t *Table) added(h epoch.Handle, ix *index, rec *record) {
+	t.account(h, rec.size())
+
+	c := t.counter(h)
+	if atomic.AddInt64(&c.records, 1)%64 != 0 || t.loadFactor <= 0 {
+		return
+	}
+	if float64(t.count()) > t.loadFactor*float64(len(ix.buckets)) {
+		c.grow = ix.bits + 1
+	}
+}
+
+// removed records that the handle removed a record from the index.
+func (t *Table) removed(h epoch.Handle, rec *record) {
+	atomic.AddInt64(&t.counter(h).records, -1)
+	t.account(h, -rec.size())
+}
+
+// slot returns the address of the entry for the extra hash bits in the chain
+// of buckets starting at the index, or nil if none exists.
+func (ix *index) slot(ex uint16, i uint64) *pin.Location {
+	for bucket := ix.bucket(i); bucket != nil; bucket = bucket.next() {
+		if addr := bucket.slot(ex); addr != nil {
+			return addr
+		}
+	}
+	return nil
+}
+
+// find returns the record for the key, or nil if it does not exist or has
+// expired. If the records are stored in a log and the key may be in a record
+// that is no longer in memory, it instead returns the location of the first
+// such record. The handle must be protected, and the record is only valid while
+// it remains protected. It may leave and enter the protected region while the
+// record is being updated in place, so no other records may be held across it.
+func (t *Table) find(h epoch.Handle, hash uint64, key []byte) (*record, pin.Location) {
+retry:
+	ix := t.acquire(h, hash)
+	if t.isClosed() {
+		return nil, pin.Location{}
+	}
+
+	ex, i := ix.split(hash)
+	addr := ix.slot(ex, i)
+	if addr == nil {
+		t.referenced(h, nil)
+		return nil, pin.Location{}
+	}
+	_, loc, rec := t.search(addr, pin.LoadLocation(addr), key)
+	if rec == nil && !loc.Nil() {
+		return nil, loc
+	}
+	if rec != nil && t.log != nil {
+		next := pin.LoadLocation(&rec.next)
+		if t.updating(loc, next) {
+			refresh(h)
+			goto retry
+		}
+		if dead(next) {
+			rec = nil
+		}
+	}
+	if rec != nil && t.expired(rec) {
+		rec = nil
+	}
+	t.referenced(h, rec)
+	return rec, pin.Location{}
+}
+
+// claim attempts to add a new entry for the extra hash bits pointing at the
+// location. It uses a tentative bit to ensure that only one entry exists for
+// any extra hash bits, and returns false if there was contention.
+func (ix *index) claim(ex uint16, i uint64, loc pin.Location) bool {
+	tloc := loc.WithExtra(uint16(tag(ex).WithTentative()))
+
+	// find an empty spot, allocating overflow buckets as necessary
+	var caddr *pin.Location
+	for bucket := ix.bucket(i); caddr == nil; bucket = bucket.grow() {
+		for i := range &bucket.entries {
+			addr := &bucket.entries[i]
+			cloc := pin.LoadLocation(addr)
+			if cloc.Nil() && pin.CompareAndSwapLocation(addr, cloc, tloc) {
+				caddr = addr
+				break
+			}
+		}
+	}
+
+	// now we have to rescan the buckets for any matching locations, including
+	// tentative ones. if there is a match, abort so that the caller retries.
+	for bucket := ix.bucket(i); bucket != nil; bucket = bucket.next() {
+		if bucket.contains(ex, caddr) {
+			pin.StoreLocation(caddr, pin.Location{})
+			return false
+		}
+	}
+
+	// otherwise, we won with no contention, so clear tentative bit
+	pin.StoreLocation(caddr, loc.WithExtra(ex))
+	return true
+}
+
+// action describes how modify should change the table.
+type action uint8
+
+const (
+	actionKeep   action = iota // leave the table unchanged
+	actionStore                // store the returned record for the key
+	actionDelete               // remove the record for the key
+)
+
+// store replaces the record for the key with rec, returning the record it
+// replaced. If the records are stored in a log, older records are not read from
+// the device, so the returned record is nil if they are no longer in memory.
+// The handle must be protected.
+func (t *Table) store(h epoch.Handle, hash uint64, key []byte, rec *record) (*record, error) {
+	fn := func(cur *record) (action, *record) { return actionStore, rec }
+	cur, _, err := t.journal(h, hash, key, true, fn)
+	return cur, err
+}
+
+// modify atomically changes the record for the key based on the result of fn.
+// fn is called with the current record for the key, or nil if none exists or it
+// has expired, and may be called multiple times under contention. If it returns
+// actionStore, the returned record replaces the current record, and if it
+// returns actionDelete, an expired record is removed as well. Returning the same
+// record from multiple calls avoids pinning it more than once. It returns the
+// record that fn was last called with and the action that was applied. If the
+// table is closed, fn is not called and nothing is applied. It returns an error
+// if the record cannot be stored. The handle must be protected.
+func (t *Table) modify(h epoch.Handle, hash uint64, key []byte,
+	fn func(cur *record) (action, *record)) (*record, action, error) {
+
+	return t.journal(h, hash, key, false, fn)
+}
+
+// apply is like modify, but does not append the change to the write ahead log.
+// If blind is true and the records are stored in a log, fn is called with nil
+// instead of reading the record from the device. If the log has no room for
+// the change, the error wraps ErrOutOfMemory.
+func (t *Table) apply(h epoch.Handle, hash uint64, key []byte, blind bool,
+	fn func(cur *record) (action, *record)) (*record, action, error) {
+
+	if t.log != nil {
+		cur, act, err := t.append(h, hash, key, blind, nil, fn)
+		t.committed(h, err)
+		if errors.Is(err, hlog.ErrFull) {
+			err = fmt.Errorf("%w: %v", ErrOutOfMemory, err)
+		}
+		return cur, act, err
+	}
+
+	ix := t.acquire(h, hash)
+	if t.isClosed() {
+		return nil, actionKeep, ErrClosed
+	}
+	ex, i := ix.split(hash)
+
+	var (
+		prec *record      // the record that has been pinned, if any
+		ploc pin.Location // the location it was pinned to
+	)
+
+retry:
+	var (
+		head  pin.Location  // the location loaded from the entry
+		paddr *pin.Location // the address that points at the current record
+		cloc  pin.Location  // the location loaded from paddr
+		cur   *record       // the current record
+	)
+
+	addr := ix.slot(ex, i)
+	if addr != nil {
+		head = pin.LoadLocation(addr)
+		paddr, cloc, cur = t.search(addr, head, key)
+	}
+
+	live := cur
+	if cur != nil && t.expired(cur) {
+		live = nil
+	}
+
+	act, rec := fn(live)
+
+	// keep the pinned record in sync with the record returned from fn. if it
+	// was never published, it is safe to unpin immediately.
+	if act != actionStore {
+		rec = nil
+	}
+	if rec != prec {
+		if prec != nil {
+			pin.Unpin(h, ploc)
+		}
+		if rec != nil {
+			ploc = pin.Pin(h, unsafe.Pointer(rec))
+		}
+		prec = rec
+	}
+
+	switch {
+	case act == actionKeep:
+		return live, act, nil
+
+	case act == actionStore && cur == nil && addr == nil:
+		// there is no entry for the hash bits, so claim a new one.
+		pin.StoreLocation(&rec.next, pin.Location{})
+		if !ix.claim(ex, i, ploc) {
+			runtime.Gosched()
+			goto retry
+		}
+		t.added(h, ix, rec)
+		return live, act, nil
+
+	case act == actionStore && cur == nil:
+		// attempt to prepend our record to the start of the linked list we
+		// searched. the entry may have been emptied or reused since we found it,
+		// so check the tag is the same.
+		if head.Nil() || head.Extra() != ex {
+			goto retry
+		}
+		pin.StoreLocation(&rec.next, head)
+		if !pin.CompareAndSwapLocation(addr, head, ploc.WithExtra(ex)) {
+			goto retry
+		}
+		t.added(h, ix, rec)
+		return live, act, nil
+
+	case act == actionDelete && cur == nil:
+		// there is nothing to remove, so nothing was applied.
+		return live, actionKeep, nil
+	}
+
+	// we're replacing or removing the current record. if the address pointing
+	// at it is flagged, the record holding it is being removed, so retry.
+	if tag(cloc.Extra()).Deleting() {
+		runtime.Gosched()
+		goto retry
+	}
+
+	// grab the original next pointer. if it is flagged, someone else is
+	// replacing or removing the record, so retry.
+	rloc := pin.LoadLocation(&cur.next)
+	rtag := tag(rloc.Extra())
+	if rtag.Deleting() {
+		runtime.Gosched()
+		goto retry
+	}
+
+	// flag the pointer on the record as logically deleted so that nothing can
+	// be linked after it, and if it is being replaced, so that scans know the
+	// record is still live.
+	mtag := rtag.WithDelete()
+	if act == actionStore {
+		mtag = mtag.WithReplace()
+	}
+	if !pin.CompareAndSwapLocation(&cur.next, rloc, rloc.WithExtra(uint16(mtag))) {
+		goto retry
+	}
+
+	// swing the address from the current record to either its replacement or
+	// its next record. if that fails, restore the flag and retry.
+	nloc := rloc
+	if act == actionStore {
+		pin.StoreLocation(&rec.next, rloc)
+		nloc = ploc.WithExtra(ex)
+	}
+	if !pin.CompareAndSwapLocation(paddr, cloc, nloc) {
+		pin.StoreLocation(&cur.next, rloc)
+		goto retry
+	}
+
+	// we use the epoch system to unpin the removed location which ensures
+	// no other handles are reading.
+	epoch.BumpWith(h, func(h epoch.Handle) { pin.Unpin(h, cloc) })
+
+	if act == actionDelete {
+		t.removed(h, cur)
+	} else {
+		t.account(h, rec.size()-cur.size())
+	}
+	return live, act, nil
+}
+
 // Delete removes the key from the table and returns true if it was able to.
-func (t *Table) Delete(h epoch.Handle, key []byte) bool {
+// It returns an error if the records are stored in a log and the removal
+// cannot be stored.
+func (t *Table) Delete(h epoch.Handle, key []byte) (bool, error) {
+	return t.DeleteHashed(h, t.hash(key), key)
+}
+
+// DeleteHashed is like Delete with the hash of the key provided by the caller.
+// It must always be the same for the same key.
+func (t *Table) DeleteHashed(h epoch.Handle, hash uint64, key []byte) (bool, error) {
+	if err := t.fits(key, nil); err != nil {
+		return false, err
+	}
 	t.protect(h)
 
-	ex, idx := t.split(xxhash.Sum64(key))
-	for bucket := t.index(idx); bucket != nil; bucket = bucket.overflow {
-		if found, deleted := bucket.Delete(h, ex, key); found {
-			epoch.Unprotect(h)
-			return deleted
-		}
+	cur, _, err := t.modify(h, hash, key, func(cur *record) (action, *record) {
+		return actionDelete, nil
+	})
+
+	t.unprotect(h)
+	return cur != nil && err == nil, err
+}
+
+// CompareAndDelete removes the key from the table if its value is equal to old,
+// and returns true if it was able to. It returns an error if the records are
+// stored in a log and the removal cannot be stored.
+func (t *Table) CompareAndDelete(h epoch.Handle, key, old []byte) (bool, error) {
+	if err := t.fits(key, nil); err != nil {
+		return false, err
 	}
+	t.protect(h)
 
-	epoch.Unprotect(h)
-	return false
+	_, act, err := t.modify(h, t.hash(key), key, func(cur *record) (action, *record) {
+		if cur == nil || !bytes.Equal(cur.Val(), old) {
+			return actionKeep, nil
+		}
+		return actionDelete, nil
+	})
+
+	t.unprotect(h)
+	return act == actionDelete && err == nil, err
 }
 
-// Lookup finds the value for the key, returning nil if no key matches.
+// Lookup finds the value for the key, returning nil if no key matches. The
+// returned slice aliases the memory of the record, so it must not be modified,
+// unless the records are stored in a log, in which case it is a copy. It also
+// returns nil if the record cannot be read from the log's device. Use
+// LookupInto or View to distinguish missing keys from empty values and from
+// errors.
 func (t *Table) Lookup(h epoch.Handle, key []byte) []byte {
+	return t.LookupHashed(h, t.hash(key), key)
+}
+
+// LookupHashed is like Lookup with the hash of the key provided by the caller.
+// It must always be the same for the same key.
+func (t *Table) LookupHashed(h epoch.Handle, hash uint64, key []byte) []byte {
 	t.protect(h)
 
-	ex, idx := t.split(xxhash.Sum64(key))
-	for bucket := t.index(idx); bucket != nil; bucket = bucket.overflow {
-		if found, val := bucket.Lookup(h, ex, key); found {
-			epoch.Unprotect(h)
-			return val
+	var val []byte
+	if rec, _ := t.lookup(h, hash, key); rec != nil {
+		val = rec.Val()
+		if t.log != nil {
+			val = append([]byte{}, val...)
 		}
 	}
 
-	epoch.Unprotect(h)
-	return nil
+	t.unprotect(h)
+	return val
 }
 
-// Insert adds the key and value to the table.
-func (t *Table) Insert(h epoch.Handle, key, value []byte) {
+// LookupInto copies the value for the key into dst while the handle is still
+// protected, growing it if necessary, and returns the resulting slice. The
+// boolean is true if the key was found. It returns an error if the records are
+// stored in a log and the record cannot be read from its device.
+func (t *Table) LookupInto(h epoch.Handle, key, dst []byte) ([]byte, bool, error) {
 	t.protect(h)
 
-	rec := newRecord(key, value)
-	ex, idx := t.split(xxhash.Sum64(key))
-	loc := pin.Pin(h, unsafe.Pointer(rec)).WithExtra(ex)
-	tloc := loc.WithExtra(uint16(tag(ex).WithTentative()))
+	rec, err := t.lookup(h, t.hash(key), key)
+	if rec != nil {
+		dst = append(dst[:0], rec.Val()...)
+	}
 
-retry:
+	t.unprotect(h)
+	return dst, rec != nil, err
+}
 
-	// first attempt to find a bucket with a matching tag already
-	for bucket := t.index(idx); bucket != nil; bucket = bucket.overflow {
-		if bucket.Insert(h, loc, key) {
-			epoch.Unprotect(h)
-			return
-		}
+// View calls fn with the value for the key while the handle is still
+// protected, and returns true if the key was found. The value must not be
+// modified or retained after fn returns, and fn must not call back into the
+// table with the same handle. It returns an error if the records are stored in
+// a log and the record cannot be read from its device.
+func (t *Table) View(h epoch.Handle, key []byte, fn func(val []byte)) (bool, error) {
+	t.protect(h)
+
+	rec, err := t.lookup(h, t.hash(key), key)
+	if rec != nil {
+		fn(rec.Val())
 	}
 
-	// we didn't find one. find an empty spot or allocate an overflow bucket
-	var last *bucket
-	for bucket := t.index(idx); bucket != nil; bucket = bucket.overflow {
-		last = bucket
+	t.unprotect(h)
+	return rec != nil, err
+}
 
-		for i := range &bucket.entries {
-			caddr := &bucket.entries[i]
-			cloc := pin.LoadLocation(caddr)
-
-			// if we find a nil location, attempt to add our loc in
-			if cloc.Nil() {
-				if !pin.CompareAndSwapLocation(caddr, cloc, tloc) {
-					goto retry
-				}
-
-				// now we have to rescan the buckets for any matching tentative locations
-				match := false
-			searching:
-				for bucket := t.index(idx); bucket != nil; bucket = bucket.overflow {
-					for i := range &bucket.entries {
-						maddr := &bucket.entries[i]
-						if caddr == maddr {
-							continue
-						}
-						mex := tag(pin.LoadLocation(maddr).Extra()).Hash()
-						if mex == ex {
-							match = true
-							break searching
-						}
-					}
-				}
-
-				// if there was a match, abort and retry
-				if match {
-					pin.StoreLocation(caddr, pin.Location{})
-					goto retry
-				}
-
-				// otherwise, we won with no contention, so clear tentative bit
-				pin.StoreLocation(caddr, loc)
-				epoch.Unprotect(h)
-				return
-			}
+// Insert adds the key and value to the table, replacing any existing value.
+// It returns an error if the records are stored in a log and the record cannot
+// be stored, such as when it is larger than a page or the log is full.
+func (t *Table) Insert(h epoch.Handle, key, value []byte) error {
+	return t.InsertHashed(h, t.hash(key), key, value)
+}
+
+// InsertHashed is like Insert with the hash of the key provided by the caller.
+// It must always be the same for the same key.
+func (t *Table) InsertHashed(h epoch.Handle, hash uint64, key, value []byte) error {
+	if err := t.fits(key, value); err != nil {
+		return err
+	}
+	t.protect(h)
+
+	_, err := t.store(h, hash, key, newRecord(hash, key, value))
+
+	t.unprotect(h)
+	return err
+}
+
+// LoadOrStore returns a copy of the existing value for the key if present.
+// Otherwise, it stores and returns the given value. The loaded result is true
+// if the value was loaded, and false if it was stored. It returns an error if
+// the records are stored in a log and the record cannot be stored.
+func (t *Table) LoadOrStore(h epoch.Handle, key, value []byte) ([]byte, bool, error) {
+	var val []byte
+	loaded, err := t.loadOrStore(h, key, value, func(cur []byte) {
+		val = append([]byte{}, cur...)
+	})
+	switch {
+	case err != nil:
+		return nil, false, err
+	case loaded:
+		return val, true, nil
+	}
+	return value, false, nil
+}
+
+// loadOrStore is like LoadOrStore, but calls load with the existing value
+// while the handle is still protected instead of returning it.
+func (t *Table) loadOrStore(h epoch.Handle, key, value []byte, load func(val []byte)) (bool, error) {
+	if err := t.fits(key, value); err != nil {
+		return false, err
+	}
+	t.protect(h)
+
+	var rec *record
+	hash := t.hash(key)
+	cur, _, err := t.modify(h, hash, key, func(cur *record) (action, *record) {
+		if cur != nil {
+			return actionKeep, nil
 		}
+		if rec == nil {
+			rec = newRecord(hash, key, value)
+		}
+		return actionStore, rec
+	})
+	if cur != nil && err == nil {
+		load(cur.Val())
+	}
+
+	t.unprotect(h)
+	return cur != nil && err == nil, err
+}
+
+// CompareAndSwap replaces the value for the key with new if its value is equal
+// to old, and returns true if it was able to. It returns an error if the
+// records are stored in a log and the record cannot be stored.
+func (t *Table) CompareAndSwap(h epoch.Handle, key, old, new []byte) (bool, error) {
+	if err := t.fits(key, new); err != nil {
+		return false, err
 	}
+	t.protect(h)
+
+	var rec *record
+	hash := t.hash(key)
+	_, act, err := t.modify(h, hash, key, func(cur *record) (action, *record) {
+		if cur == nil || !bytes.Equal(cur.Val(), old) {
+			return actionKeep, nil
+		}
+		if rec == nil {
+			rec = newRecord(hash, key, new)
+		}
+		return actionStore, rec
+	})
 
-	// we found no empty spot. allocate an overflow bucket and retry
-	ptr := (*unsafe.Pointer)(unsafe.Pointer(&last.overflow))
-	atomic.CompareAndSwapPointer(ptr, nil, unsafe.Pointer(new(bucket)))
-	goto retry
+	t.unprotect(h)
+	return act == actionStore && err == nil, err
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
 	"github.com/zeebo/gofaster/internal/machine"
 	"github.com/zeebo/gofaster/internal/pcg"
 )
@@ -44,6 +45,267 @@ func TestTable(t *testing.T) {
 	fmt.Printf("%#v\n", table)
 }
 
+func TestTableInsert(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	const max = 1000
+
+	table := New(4)
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		table.Insert(h, data, data)
+	}
+
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		assert.Equal(t, string(table.Lookup(h, data)), string(data))
+	}
+
+	// inserting an existing key replaces its value.
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		table.Insert(h, data, append(data, 'x'))
+		assert.Equal(t, string(table.Lookup(h, data)), string(data)+"x")
+	}
+
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		assert.That(t, must(table.Delete(h, data)))
+		assert.That(t, !must(table.Delete(h, data)))
+	}
+
+	for i := 0; i < max; i++ {
+		data := []byte(fmt.Sprint(i))
+		assert.Nil(t, table.Lookup(h, data))
+	}
+}
+
+func TestTableConditional(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	key := []byte("key")
+	table := New(4)
+
+	t.Run("LoadOrStore", func(t *testing.T) {
+		val, loaded, err := table.LoadOrStore(h, key, []byte("a"))
+		assert.NoError(t, err)
+		assert.That(t, !loaded)
+		assert.Equal(t, string(val), "a")
+
+		val, loaded, err = table.LoadOrStore(h, key, []byte("b"))
+
+		assert.NoError(t, err)
+		assert.That(t, loaded)
+		assert.Equal(t, string(val), "a")
+		assert.Equal(t, string(table.Lookup(h, key)), "a")
+
+		// the loaded value is a copy of the record's.
+		val[0] = 'z'
+		assert.Equal(t, string(table.Lookup(h, key)), "a")
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		assert.That(t, !must(table.CompareAndSwap(h, key, []byte("b"), []byte("c"))))
+		assert.Equal(t, string(table.Lookup(h, key)), "a")
+
+		assert.That(t, must(table.CompareAndSwap(h, key, []byte("a"), []byte("c"))))
+		assert.Equal(t, string(table.Lookup(h, key)), "c")
+
+		assert.That(t, !must(table.CompareAndSwap(h, []byte("missing"), nil, []byte("c"))))
+		assert.Nil(t, table.Lookup(h, []byte("missing")))
+	})
+
+	t.Run("CompareAndDelete", func(t *testing.T) {
+		assert.That(t, !must(table.CompareAndDelete(h, key, []byte("a"))))
+		assert.Equal(t, string(table.Lookup(h, key)), "c")
+
+		assert.That(t, must(table.CompareAndDelete(h, key, []byte("c"))))
+		assert.Nil(t, table.Lookup(h, key))
+		assert.That(t, !must(table.CompareAndDelete(h, key, []byte("c"))))
+	})
+}
+
+func TestTableLookup(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	table := New(4)
+	table.Insert(h, []byte("key"), []byte("value"))
+	table.Insert(h, []byte("empty"), nil)
+
+	t.Run("LookupInto", func(t *testing.T) {
+		buf := make([]byte, 0, 16)
+
+		val, ok, err := table.LookupInto(h, []byte("key"), buf)
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.Equal(t, string(val), "value")
+		assert.Equal(t, &val[:1][0], &buf[:1][0])
+
+		val, ok, err = table.LookupInto(h, []byte("empty"), buf)
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.Equal(t, len(val), 0)
+
+		val, ok, err = table.LookupInto(h, []byte("missing"), nil)
+		assert.NoError(t, err)
+		assert.That(t, !ok)
+		assert.Nil(t, val)
+	})
+
+	t.Run("View", func(t *testing.T) {
+		var got string
+		assert.That(t, must(table.View(h, []byte("key"), func(val []byte) { got = string(val) })))
+		assert.Equal(t, got, "value")
+
+		called := false
+		assert.That(t, must(table.View(h, []byte("empty"), func(val []byte) { called = len(val) == 0 })))
+		assert.That(t, called)
+
+		assert.That(t, !must(table.View(h, []byte("missing"), func([]byte) { t.Fatal("called") })))
+	})
+}
+
+func TestTableConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		keys    = 16
+		iters   = 512
+	)
+
+	table := New(2)
+
+	// every worker increments every counter with a CompareAndSwap loop, while
+	// also inserting and deleting keys of their own to cause chain churn.
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			h := epoch.AcquireHandle()
+			defer epoch.ReleaseHandle(h)
+
+			for j := 0; j < iters; j++ {
+				key := []byte(fmt.Sprint(j % keys))
+				for {
+					old, loaded, err := table.LoadOrStore(h, key, []byte("1"))
+					assert.NoError(t, err)
+					if !loaded {
+						break
+					}
+					old = append([]byte(nil), old...)
+					next := []byte(fmt.Sprint(atoi(old) + 1))
+					if must(table.CompareAndSwap(h, key, old, next)) {
+						break
+					}
+				}
+
+				own := []byte(fmt.Sprint("own-", i, "-", j))
+				table.Insert(h, own, own)
+				assert.Equal(t, string(table.Lookup(h, own)), string(own))
+				assert.That(t, must(table.CompareAndDelete(h, own, own)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	for j := 0; j < keys; j++ {
+		key := []byte(fmt.Sprint(j))
+		assert.Equal(t, atoi(table.Lookup(h, key)), workers*iters/keys)
+	}
+}
+
+func TestTableGrow(t *testing.T) {
+	t.Run("Automatic", func(t *testing.T) {
+		h := epoch.AcquireHandle()
+		defer epoch.ReleaseHandle(h)
+
+		const max = 10000
+
+		table := New(0)
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			table.Insert(h, data, data)
+		}
+		assert.That(t, table.Buckets() >= max/4)
+
+		for i := 0; i < max; i++ {
+			data := []byte(fmt.Sprint(i))
+			assert.Equal(t, string(table.Lookup(h, data)), string(data))
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const (
+			workers = 8
+			iters   = 2000
+			grows   = 8
+		)
+
+		table := New(0, WithLoadFactor(0))
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				h := epoch.AcquireHandle()
+				defer epoch.ReleaseHandle(h)
+
+				for j := 0; j < iters; j++ {
+					key := []byte(fmt.Sprint(i, "-", j))
+					table.Insert(h, key, key)
+					assert.Equal(t, string(table.Lookup(h, key)), string(key))
+
+					if j%2 == 0 {
+						assert.That(t, must(table.Delete(h, key)))
+					}
+				}
+			}(i)
+		}
+
+		h := epoch.AcquireHandle()
+		defer epoch.ReleaseHandle(h)
+
+		for i := 0; i < grows; i++ {
+			table.Grow(h)
+		}
+		wg.Wait()
+
+		assert.Equal(t, table.Buckets(), 1<<grows)
+		for i := 0; i < workers; i++ {
+			for j := 0; j < iters; j++ {
+				key := []byte(fmt.Sprint(i, "-", j))
+				_, ok, err := table.LookupInto(h, key, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, ok, j%2 == 1)
+			}
+		}
+	})
+}
+
+// must returns the result of a table operation, panicking if it failed.
+func must(ok bool, err error) bool {
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+func atoi(data []byte) (n int) {
+	for _, b := range data {
+		n = n*10 + int(b-'0')
+	}
+	return n
+}
+
 func BenchmarkTable(b *testing.B) {
 	var (
 		dataS [256]string
@@ -5,16 +5,24 @@ const (
 	tagDeleteBit    = 1 << 14
 	tagHashBits     = 14
 	tagHashMask     = 1<<tagHashBits - 1
+
+	// entries are never replaced, so the tentative bit is reused on the next
+	// pointers of records to flag that a deleted record is being replaced, or
+	// without the delete bit, that a record is being updated in place.
+	tagReplaceBit = tagTentativeBit
 )
 
 type tag uint16
 
 func (t tag) Tentative() bool { return t&tagTentativeBit > 0 }
 func (t tag) Deleting() bool  { return t&tagDeleteBit > 0 }
+func (t tag) Replacing() bool { return t&tagReplaceBit > 0 }
+func (t tag) Updating() bool  { return t&(tagDeleteBit|tagReplaceBit) == tagReplaceBit }
 
 func (t tag) WithTentative() tag    { return t | tagTentativeBit }
 func (t tag) WithoutTentative() tag { return t &^ tagTentativeBit }
 func (t tag) WithDelete() tag       { return t | tagDeleteBit }
 func (t tag) WithoutDelete() tag    { return t &^ tagDeleteBit }
+func (t tag) WithReplace() tag      { return t | tagReplaceBit }
 
 func (t tag) Hash() uint16 { return uint16(t & tagHashMask) }
@@ -0,0 +1,158 @@
+package htable
+
+import (
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/machine"
+)
+
+// Typed is a concurrent hash table from keys of type K to values of type V,
+// built on a Table by encoding keys and values with codecs.
+type Typed[K, V any] struct {
+	table   *Table
+	keys    Codec[K]
+	vals    Codec[V]
+	scratch [machine.MaxThreads]scratch
+}
+
+// scratch holds buffers for encoding used by a single handle, padded to avoid
+// false sharing.
+type scratch struct {
+	key []byte
+	val []byte
+	_   [16]byte
+}
+
+// NewTyped constructs a Typed table using the Table to store the encoded keys
+// and values.
+func NewTyped[K, V any](table *Table, keys Codec[K], vals Codec[V]) *Typed[K, V] {
+	return &Typed[K, V]{
+		table: table,
+		keys:  keys,
+		vals:  vals,
+	}
+}
+
+// Table returns the Table holding the encoded keys and values.
+func (t *Typed[K, V]) Table() *Table { return t.table }
+
+// encodeKey encodes the key into the scratch buffer for the handle. The result
+// is only valid until the next call with the same handle.
+func (t *Typed[K, V]) encodeKey(h epoch.Handle, k K) ([]byte, error) {
+	s := &t.scratch[h.Id()%machine.MaxThreads]
+	key, err := t.keys.Append(s.key[:0], k)
+	s.key = key
+	return key, err
+}
+
+// encodeVal is like encodeKey for values.
+func (t *Typed[K, V]) encodeVal(h epoch.Handle, v V) ([]byte, error) {
+	s := &t.scratch[h.Id()%machine.MaxThreads]
+	val, err := t.vals.Append(s.val[:0], v)
+	s.val = val
+	return val, err
+}
+
+// Insert adds the key and value to the table, replacing any existing value.
+func (t *Typed[K, V]) Insert(h epoch.Handle, k K, v V) error {
+	key, err := t.encodeKey(h, k)
+	if err != nil {
+		return err
+	}
+	val, err := t.encodeVal(h, v)
+	if err != nil {
+		return err
+	}
+	return t.table.Insert(h, key, val)
+}
+
+// Lookup returns the value for the key and true if it exists. Keys with fixed
+// size encodings are looked up without allocating.
+func (t *Typed[K, V]) Lookup(h epoch.Handle, k K) (v V, ok bool, err error) {
+	key, err := t.encodeKey(h, k)
+	if err != nil {
+		return v, false, err
+	}
+	var derr error
+	ok, err = t.table.View(h, key, func(val []byte) {
+		v, derr = t.vals.Decode(val)
+	})
+	if err != nil {
+		return v, false, err
+	}
+	return v, ok, derr
+}
+
+// Delete removes the key from the table and returns true if it was able to.
+func (t *Typed[K, V]) Delete(h epoch.Handle, k K) (bool, error) {
+	key, err := t.encodeKey(h, k)
+	if err != nil {
+		return false, err
+	}
+	return t.table.Delete(h, key)
+}
+
+// LoadOrStore returns the existing value for the key if present. Otherwise, it
+// stores and returns the given value. The loaded result is true if the value
+// was loaded, and false if it was stored.
+func (t *Typed[K, V]) LoadOrStore(h epoch.Handle, k K, v V) (V, bool, error) {
+	key, err := t.encodeKey(h, k)
+	if err != nil {
+		return v, false, err
+	}
+	val, err := t.encodeVal(h, v)
+	if err != nil {
+		return v, false, err
+	}
+
+	// the existing value is decoded while the handle is protected, because
+	// the record holding it may be retired as soon as it is not.
+	var derr error
+	loaded, err := t.table.loadOrStore(h, key, val, func(cur []byte) {
+		v, derr = t.vals.Decode(cur)
+	})
+	if err != nil {
+		return v, false, err
+	}
+	return v, loaded, derr
+}
+
+// CompareAndSwap replaces the value for the key with new if its value has the
+// same encoding as old, and returns true if it was able to.
+func (t *Typed[K, V]) CompareAndSwap(h epoch.Handle, k K, old, new V) (bool, error) {
+	key, err := t.encodeKey(h, k)
+	if err != nil {
+		return false, err
+	}
+	oval, err := t.encodeVal(h, old)
+	if err != nil {
+		return false, err
+	}
+
+	// the scratch value buffer holds the old value, so the new value has to be
+	// encoded into separate memory.
+	nval, err := t.vals.Append(nil, new)
+	if err != nil {
+		return false, err
+	}
+	return t.table.CompareAndSwap(h, key, oval, nval)
+}
+
+// Range calls fn with every key and value in the table until fn returns false,
+// with the same guarantees as Table.Range. It stops early and returns the error
+// if any key or value fails to decode.
+func (t *Typed[K, V]) Range(h epoch.Handle, fn func(k K, v V) bool) (err error) {
+	t.table.Range(h, func(key, val []byte) bool {
+		var (
+			k K
+			v V
+		)
+		if k, err = t.keys.Decode(key); err != nil {
+			return false
+		}
+		if v, err = t.vals.Decode(val); err != nil {
+			return false
+		}
+		return fn(k, v)
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+package htable
+
+import (
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestTyped(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	t.Run("Basic", func(t *testing.T) {
+		typed := NewTyped[string, version](New(0), StringCodec{}, BinaryCodec[version, *version]{})
+
+		assert.NoError(t, typed.Insert(h, "a", version{1, 0}))
+		assert.NoError(t, typed.Insert(h, "b", version{2, 0}))
+
+		v, ok, err := typed.Lookup(h, "a")
+		assert.NoError(t, err)
+		assert.That(t, ok)
+		assert.Equal(t, v, version{1, 0})
+
+		_, ok, err = typed.Lookup(h, "c")
+		assert.NoError(t, err)
+		assert.That(t, !ok)
+
+		v, loaded, err := typed.LoadOrStore(h, "b", version{3, 0})
+		assert.NoError(t, err)
+		assert.That(t, loaded)
+		assert.Equal(t, v, version{2, 0})
+
+		swapped, err := typed.CompareAndSwap(h, "b", version{2, 0}, version{2, 1})
+		assert.NoError(t, err)
+		assert.That(t, swapped)
+
+		deleted, err := typed.Delete(h, "a")
+		assert.NoError(t, err)
+		assert.That(t, deleted)
+
+		seen := make(map[string]version)
+		assert.NoError(t, typed.Range(h, func(k string, v version) bool {
+			seen[k] = v
+			return true
+		}))
+		assert.DeepEqual(t, seen, map[string]version{"b": {2, 1}})
+	})
+
+	t.Run("DecodeError", func(t *testing.T) {
+		table := New(0)
+		table.Insert(h, []byte("bad"), []byte("xyz"))
+
+		typed := NewTyped[string, uint64](table, StringCodec{}, IntCodec[uint64]{})
+		_, ok, err := typed.Lookup(h, "bad")
+		assert.That(t, ok)
+		assert.Error(t, err)
+		assert.Error(t, typed.Range(h, func(string, uint64) bool { return true }))
+	})
+
+	t.Run("NoAllocs", func(t *testing.T) {
+		typed := NewTyped[uint64, point](New(0), IntCodec[uint64]{}, NewFixedCodec[point]())
+		assert.NoError(t, typed.Insert(h, 10, point{X: 10}))
+
+		allocs := testing.AllocsPerRun(100, func() {
+			v, ok, err := typed.Lookup(h, 10)
+			if err != nil || !ok || v.X != 10 {
+				t.Fatal("lookup failed")
+			}
+		})
+		assert.Equal(t, allocs, 0.0)
+	})
+}
+
+func BenchmarkTyped(b *testing.B) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	typed := NewTyped[uint64, uint64](New(8), IntCodec[uint64]{}, IntCodec[uint64]{})
+	for i := uint64(0); i < 256; i++ {
+		_ = typed.Insert(h, i, i)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = typed.Lookup(h, uint64(i&255))
+	}
+}
@@ -15,12 +15,21 @@ func Index(slice unsafe.Pointer, size, slot uintptr) *unsafe.Pointer {
 	return (*unsafe.Pointer)(ptr)
 }
 
+// sliceHeader mirrors the runtime representation of a slice. Unlike
+// reflect.SliceHeader, the data is a pointer, so the data is never held only as
+// a uintptr that the garbage collector cannot see while the slice is built.
+type sliceHeader struct {
+	data unsafe.Pointer
+	len  int
+	cap  int
+}
+
 // Slice returns a []byte with the given length using the data pointer.
 func Slice(data unsafe.Pointer, length int) []byte {
-	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: uintptr(data),
-		Len:  length,
-		Cap:  length,
+	return *(*[]byte)(unsafe.Pointer(&sliceHeader{
+		data: data,
+		len:  length,
+		cap:  length,
 	}))
 }
 
@@ -0,0 +1,50 @@
+package xxh64
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cespare/xxhash"
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestSum64(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	t.Run("Unseeded", func(t *testing.T) {
+		for i := range data {
+			assert.Equal(t, Sum64(0, data[:i]), xxhash.Sum64(data[:i]))
+		}
+	})
+
+	t.Run("Seeded", func(t *testing.T) {
+		for i := range data {
+			assert.That(t, Sum64(1, data[:i]) != Sum64(2, data[:i]))
+		}
+
+		// known value from the reference implementation
+		assert.Equal(t, Sum64(1, nil), uint64(0xd5afba1336a3be4b))
+	})
+
+	t.Run("Uint64", func(t *testing.T) {
+		var buf [8]byte
+		for i := uint64(0); i < 100; i++ {
+			binary.LittleEndian.PutUint64(buf[:], i*0x9e3779b97f4a7c15)
+			assert.Equal(t, Sum64Uint64(i, i*0x9e3779b97f4a7c15), Sum64(i, buf[:]))
+		}
+	})
+}
+
+var blackholeUint64 uint64
+
+func BenchmarkSum64(b *testing.B) {
+	data := []byte("some key that is of a typical size")
+
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		blackholeUint64 += Sum64(uint64(i), data)
+	}
+}
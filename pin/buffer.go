@@ -5,7 +5,6 @@ import (
 	"unsafe"
 
 	"github.com/zeebo/gofaster/internal/machine"
-	"github.com/zeebo/gofaster/internal/risky"
 )
 
 const (
@@ -17,16 +16,20 @@ type buffer struct {
 	// linked list of unpinned locations. atomic/concurrent
 	unpinned unsafe.Pointer
 
+	// pointer to the first element of the array of pinned items. it is
+	// replaced atomically when the buffer grows so that reads from other
+	// threads see either the old or new array.
+	data unsafe.Pointer
+
 	// the rest of the fields are "thread local", though we use atomics anyway
 	// to appease the race detector.
 
-	data  []unsafe.Pointer // buffer of pinned items
-	start uint32           // start index into data for adding.
-	free  uint32           // amount free, used for resizing.
-	mask  uint32           // mask for modulo indexing into data
-	bits  uint32           // number of bits in the mask
+	start uint32 // start index into data for adding.
+	free  uint32 // amount free, used for resizing.
+	mask  uint32 // mask for modulo indexing into data
+	bits  uint32 // number of bits in the mask
 
-	_ [16]byte
+	_ [32]byte
 }
 
 type ( // ensure the buffer is sized to a cache line
@@ -37,31 +40,39 @@ type ( // ensure the buffer is sized to a cache line
 // newBuffer allocates a buffer with spaces for 2^bits pointers.
 func newBuffer(bits uint32) buffer {
 	var b buffer
-	b.data = make([]unsafe.Pointer, 1<<bits)
+	b.data = unsafe.Pointer(&make([]unsafe.Pointer, 1<<bits)[0])
 	b.free = 1 << bits
 	b.mask = 1<<bits - 1
 	b.bits = bits
 	return b
 }
 
+// size returns the number of pointers in the buffer.
+func (b *buffer) size() uint32 {
+	return atomic.LoadUint32(&b.mask) + 1
+}
+
 // grow doubles the buffer's size
 func (b *buffer) grow() {
-	// ugh all these atomics
-	atomic.AddUint32(&b.free, uint32(len(b.data)))
-	atomic.AddUint32(&b.mask, atomic.LoadUint32(&b.mask))
-	atomic.AddUint32(&b.mask, 1)
-	atomic.AddUint32(&b.bits, 1)
+	size := b.size()
 
-	next := make([]unsafe.Pointer, 2*len(b.data))
-	copy(next, b.data)
+	// only this thread writes into the array, so it is safe to copy it while
+	// other threads are reading from it.
+	next := make([]unsafe.Pointer, 2*size)
+	for i := uint32(0); i < size; i++ {
+		next[i] = atomic.LoadPointer(b.index(i))
+	}
+	atomic.StorePointer(&b.data, unsafe.Pointer(&next[0]))
 
-	// UGH need to do this with atomics. one pointer + 2 uint64 calls?
-	b.data = next
+	atomic.AddUint32(&b.free, size)
+	atomic.StoreUint32(&b.mask, 2*size-1)
+	atomic.AddUint32(&b.bits, 1)
 }
 
 // index returns a pointer the ith pointer in the buffer.
 func (b *buffer) index(i uint32) *unsafe.Pointer {
-	return risky.Index(unsafe.Pointer(&b.data), ptrSize, uintptr(i))
+	data := atomic.LoadPointer(&b.data)
+	return (*unsafe.Pointer)(unsafe.Pointer(uintptr(data) + ptrSize*uintptr(i)))
 }
 
 // pin adds the pointer to the location and decrements free.
@@ -79,6 +90,18 @@ func (b *buffer) unpin(loc Location) {
 	atomic.AddUint32(&b.free, 1)
 }
 
+// released is stored in place of pointers unpinned by other handles so that
+// they can be garbage collected before the owning handle frees the location.
+var released byte
+
+// release replaces the pointer at the location so that it may be garbage
+// collected, without making the location available to pin. If it races with
+// the owning handle growing the buffer, the pointer is kept until the owning
+// handle unpins it.
+func (b *buffer) release(loc Location) {
+	atomic.StorePointer(b.index(loc.index()), unsafe.Pointer(&released))
+}
+
 // read returns the value of the pointer identified by the location.
 func (b *buffer) read(loc Location) unsafe.Pointer {
 	return atomic.LoadPointer(b.index(loc.index()))
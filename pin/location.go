@@ -32,6 +32,15 @@ func (l Location) index() uint32 {
 	return uint32(l.x) >> (machine.MaxThreadBits + 1)
 }
 
+// Address returns a non-nil location that holds the address instead of helping
+// find a pinned pointer, for data structures that keep some of their memory
+// elsewhere. The address must fit in 47 bits, and the location must not be
+// passed to Read or Unpin.
+func Address(addr uint64) Location { return Location{addr<<1 | 1} }
+
+// Address returns the address held by a location constructed by Address.
+func (l Location) Address() uint64 { return l.x << 16 >> 17 }
+
 // Nil returns if the location is conceptually nil.
 func (l Location) Nil() bool { return l.x&1 == 0 }
 
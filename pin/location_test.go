@@ -24,4 +24,15 @@ func TestLocation(t *testing.T) {
 		assert.Equal(t, loc2.id(), 1)
 		assert.Equal(t, loc2.index(), 2)
 	})
+	t.Run("Address", func(t *testing.T) {
+		const addr = 1<<47 - 3
+
+		loc := Address(addr)
+		assert.That(t, !loc.Nil())
+		assert.Equal(t, loc.Address(), uint64(addr))
+
+		loc = loc.WithExtra(0xffff)
+		assert.Equal(t, loc.Address(), uint64(addr))
+		assert.Equal(t, loc.Extra(), 0xffff)
+	})
 }
@@ -47,7 +47,7 @@ func Pin(h epoch.Handle, ptr unsafe.Pointer) Location {
 	}
 
 	start := buffer.start & buffer.mask
-	end := buffer.start + uint32(len(buffer.data))
+	end := buffer.start + buffer.size()
 
 	for start < end {
 		if atomic.LoadPointer(buffer.index(start&buffer.mask)) == nil {
@@ -72,6 +72,7 @@ func Unpin(h epoch.Handle, loc Location) {
 	if id == h.Id() {
 		buffer.unpin(loc)
 	} else {
+		buffer.release(loc)
 		buffer.appendUnpinned(loc)
 	}
 }
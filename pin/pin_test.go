@@ -42,6 +42,65 @@ func TestPin(t *testing.T) {
 	assert.That(t, atomic.LoadUint64(&finalized) == 1)
 }
 
+func TestPinDifferentHandle(t *testing.T) {
+	h1 := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h1)
+	h2 := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h2)
+
+	x := new([1024]byte)
+	finalized := uint64(0)
+	runtime.SetFinalizer(x, func(*[1024]byte) {
+		atomic.StoreUint64(&finalized, 1)
+	})
+
+	// unpin with another handle, which must release the pointer even though
+	// the pinning handle never pins again.
+	loc := Pin(h1, unsafe.Pointer(x))
+	x = nil
+	Unpin(h2, loc)
+	runtime.GC()
+	runtime.GC()
+
+	assert.That(t, atomic.LoadUint64(&finalized) == 1)
+}
+
+func TestPinGrow(t *testing.T) {
+	h := epoch.AcquireHandle()
+	defer epoch.ReleaseHandle(h)
+
+	var locs []Location
+	var ptrs []unsafe.Pointer
+	pin := func(n int) {
+		for i := 0; i < n; i++ {
+			ptr := unsafe.Pointer(new(int))
+			locs = append(locs, Pin(h, ptr))
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	pin(100)
+
+	// read the first locations from another goroutine while the pinning
+	// handle grows its buffer many times.
+	var stop uint32
+	done := make(chan struct{})
+	go func(locs []Location, ptrs []unsafe.Pointer) {
+		defer close(done)
+		for i := 0; atomic.LoadUint32(&stop) == 0; i++ {
+			assert.Equal(t, Read(locs[i%len(locs)]), ptrs[i%len(ptrs)])
+		}
+	}(locs, ptrs)
+
+	pin(4096)
+	atomic.StoreUint32(&stop, 1)
+	<-done
+
+	for i, loc := range locs {
+		assert.Equal(t, Read(loc), ptrs[i])
+		Unpin(h, loc)
+	}
+}
+
 func BenchmarkPin(b *testing.B) {
 	mem := unsafe.Pointer(new([1024]byte))
 
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/htable"
+)
+
+// client is the state of a connection being served.
+type client struct {
+	h     epoch.Handle
+	table *htable.Table
+	r     *reader
+	w     *writer
+
+	name    []byte          // the upper case name of the command being executed
+	val     []byte          // holds values read from the table
+	num     []byte          // holds formatted numbers
+	keys    [][]byte        // holds the keys found by a scan
+	results []htable.Result // holds the values read by a batch
+}
+
+// command is a command that can be executed.
+type command struct {
+	// arity is the number of arguments including the name, or if it is
+	// negative, the least number of them.
+	arity int
+	fn    func(c *client, args [][]byte)
+}
+
+// commands are the commands that can be executed, by upper case name.
+var commands = map[string]command{
+	"PING":   {-1, (*client).ping},
+	"GET":    {2, (*client).get},
+	"SET":    {-3, (*client).set},
+	"DEL":    {-2, (*client).del},
+	"EXISTS": {-2, (*client).exists},
+	"INCRBY": {3, (*client).incrby},
+	"MGET":   {-2, (*client).mget},
+	"MSET":   {-3, (*client).mset},
+	"SCAN":   {-2, (*client).scan},
+}
+
+// execute executes the command and writes its reply, returning true if the
+// client asked for the connection to be closed.
+func (c *client) execute(args [][]byte) (quit bool) {
+	if len(args) == 0 {
+		return false
+	}
+
+	c.name = c.name[:0]
+	for _, b := range args[0] {
+		if 'a' <= b && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		c.name = append(c.name, b)
+	}
+	if string(c.name) == "QUIT" {
+		c.w.simple("OK")
+		return true
+	}
+
+	cmd, ok := commands[string(c.name)]
+	switch {
+	case !ok:
+		c.w.error("ERR unknown command '" + safe(args[0]) + "'")
+	case cmd.arity >= 0 && len(args) != cmd.arity,
+		cmd.arity < 0 && len(args) < -cmd.arity:
+		c.wrongArity(args)
+	default:
+		cmd.fn(c, args)
+	}
+	return false
+}
+
+// safe returns the argument as a string that can be put in an error reply.
+func safe(arg []byte) string {
+	buf := make([]byte, 0, len(arg))
+	for _, b := range arg {
+		if b < ' ' || b > '~' {
+			b = '?'
+		}
+		buf = append(buf, b)
+	}
+	return string(buf)
+}
+
+// wrongArity writes the error reply for a command with the wrong number of
+// arguments.
+func (c *client) wrongArity(args [][]byte) {
+	lower := make([]byte, len(c.name))
+	for i, b := range c.name {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		lower[i] = b
+	}
+	c.w.error("ERR wrong number of arguments for '" + string(lower) + "' command")
+}
+
+// ping replies with PONG, or with its argument.
+func (c *client) ping(args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.wrongArity(args)
+	}
+}
+
+// get replies with the value of the key.
+func (c *client) get(args [][]byte) {
+	var ok bool
+	var err error
+	c.val, ok, err = c.table.LookupInto(c.h, args[1], c.val)
+	switch {
+	case err != nil:
+		c.w.error("ERR " + err.Error())
+	case !ok:
+		c.w.null()
+	default:
+		c.w.bulk(c.val)
+	}
+}
+
+// set stores the value for the key. No options are supported.
+func (c *client) set(args [][]byte) {
+	if len(args) != 3 {
+		c.w.error("ERR syntax error")
+		return
+	}
+	if _, err := c.table.Upsert(c.h, args[1], args[2]); err != nil {
+		c.w.error("ERR " + err.Error())
+		return
+	}
+	c.w.simple("OK")
+}
+
+// del removes the keys and replies with how many existed.
+func (c *client) del(args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		st, err := c.table.Remove(c.h, key)
+		if err != nil {
+			c.w.error("ERR " + err.Error())
+			return
+		}
+		if st == htable.OK {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+// exists replies with how many of the keys exist, counting repeated keys every
+// time.
+func (c *client) exists(args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		ok, err := c.table.View(c.h, key, func([]byte) {})
+		if err != nil {
+			c.w.error("ERR " + err.Error())
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	c.w.integer(n)
+}
+
+// incrby atomically adds to the integer value of the key, treating a missing
+// key as zero, and replies with the result.
+func (c *client) incrby(args [][]byte) {
+	delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.w.error("ERR value is not an integer or out of range")
+		return
+	}
+
+	var (
+		result int64
+		reply  string // an error reply if the value cannot be incremented
+	)
+	_, _, err = c.table.RMW(c.h, args[1], nil, func(old []byte, ok bool) ([]byte, bool) {
+		var cur int64
+		if ok {
+			v, err := strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				reply = "ERR value is not an integer or out of range"
+				return nil, false
+			}
+			cur = v
+		}
+		if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+			reply = "ERR increment or decrement would overflow"
+			return nil, false
+		}
+
+		result, reply = cur+delta, ""
+		c.num = strconv.AppendInt(c.num[:0], result, 10)
+		return c.num, true
+	})
+	switch {
+	case err != nil:
+		c.w.error("ERR " + err.Error())
+	case reply != "":
+		c.w.error(reply)
+	default:
+		c.w.integer(result)
+	}
+}
+
+// mget replies with the values of the keys, or an error if any of them cannot
+// be read.
+func (c *client) mget(args [][]byte) {
+	keys := args[1:]
+	for len(c.results) < len(keys) {
+		c.results = append(c.results, htable.Result{})
+	}
+	results := c.results[:len(keys)]
+	c.table.MultiLookup(c.h, keys, results)
+
+	for _, res := range results {
+		if res.Err != nil {
+			c.w.error("ERR " + res.Err.Error())
+			return
+		}
+	}
+	c.w.array(len(results))
+	for _, res := range results {
+		if res.Found {
+			c.w.bulk(res.Val)
+		} else {
+			c.w.null()
+		}
+	}
+}
+
+// mset stores the values for the keys. Unlike Redis, other clients may observe
+// some of the values being stored before the rest.
+func (c *client) mset(args [][]byte) {
+	if len(args)%2 != 1 {
+		c.wrongArity(args)
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		if _, err := c.table.Upsert(c.h, args[i], args[i+1]); err != nil {
+			c.w.error("ERR " + err.Error())
+			return
+		}
+	}
+	c.w.simple("OK")
+}
+
+// scan replies with the cursor to continue from and the keys of some records
+// starting at the cursor, which is zero to start a new scan. It accepts the
+// MATCH and COUNT options, and has the guarantees of the table's Scan.
+func (c *client) scan(args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+
+	var pattern []byte
+	count := 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.error("ERR syntax error")
+			return
+		}
+		switch opt := string(args[i]); {
+		case strings.EqualFold(opt, "MATCH"):
+			pattern = args[i+1]
+		case strings.EqualFold(opt, "COUNT"):
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				c.w.error("ERR syntax error")
+				return
+			}
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+
+	// the keys are copied out so that nothing is written to the connection
+	// while the handle is protected.
+	c.keys = c.keys[:0]
+	next := c.table.Scan(c.h, cursor, count, func(key, val []byte) {
+		if pattern == nil || match(pattern, key) {
+			c.keys = append(c.keys, append([]byte(nil), key...))
+		}
+	})
+
+	c.num = strconv.AppendUint(c.num[:0], next, 10)
+	c.w.array(2)
+	c.w.bulk(c.num)
+	c.w.array(len(c.keys))
+	for _, key := range c.keys {
+		c.w.bulk(key)
+	}
+}
@@ -0,0 +1,6 @@
+// package server serves an htable.Table over the Redis serialization protocol
+// (RESP), so that clients that speak Redis can use it. Every connection is
+// handled by its own goroutine holding its own epoch handle, and commands sent
+// without waiting for their replies are pipelined, with replies written in
+// order and flushed once no more commands are buffered.
+package server
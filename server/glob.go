@@ -0,0 +1,87 @@
+package server
+
+// match returns true if the glob pattern matches all of s. Like Redis, '*'
+// matches any run of bytes, '?' matches any byte, "[...]" matches a byte in a
+// set that may contain ranges and be negated with '^', and '\' escapes the
+// byte after it.
+func match(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+			continue
+
+		case '[':
+			if rest, matched, ok := class(pattern[1:], s); ok {
+				if !matched {
+					return false
+				}
+				pattern, s = rest, s[1:]
+				continue
+			}
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+
+		if len(s) == 0 || s[0] != pattern[0] {
+			return false
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// class matches the first byte of s against the set at the start of the
+// pattern, which follows its opening '['. It returns the rest of the pattern
+// after the set, and false if the set is not closed, in which case the '[' is
+// matched literally.
+func class(pattern, s []byte) (rest []byte, matched, ok bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		lo := pattern[i]
+		switch {
+		case lo == ']':
+			return pattern[i+1:], len(s) > 0 && matched != negate, true
+		case lo == '\\' && i+1 < len(pattern):
+			i++
+			lo = pattern[i]
+		}
+
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if len(s) > 0 && lo <= s[0] && s[0] <= hi {
+			matched = true
+		}
+	}
+	return nil, false, false
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// errProtocol is returned when a client sends something that is not a command.
+var errProtocol = errors.New("Protocol error")
+
+// limits on the commands a client may send.
+const (
+	maxArgs   = 1 << 20
+	bulkChunk = 64 << 10 // the most of a bulk string read before more arrives
+)
+
+// reader reads commands from a client.
+type reader struct {
+	br   *bufio.Reader
+	max  int    // the most bytes of arguments in a command
+	buf  []byte // holds the arguments of the last command
+	offs []int  // the end of each argument in buf
+	args [][]byte
+}
+
+// newReader constructs a reader of commands from r with at most max bytes of
+// arguments each.
+func newReader(r io.Reader, max int) *reader {
+	return &reader{br: bufio.NewReader(r), max: max}
+}
+
+// buffered returns true if more of the client's input has already been read.
+func (r *reader) buffered() bool { return r.br.Buffered() > 0 }
+
+// command reads the next command, which is either an array of bulk strings or
+// an inline command separated by spaces. The arguments are only valid until the
+// next call. It returns no arguments for an empty command.
+func (r *reader) command() ([][]byte, error) {
+	r.buf, r.offs = r.buf[:0], r.offs[:0]
+
+	line, err := r.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		for _, field := range bytes.Fields(line) {
+			r.buf = append(r.buf, field...)
+			r.offs = append(r.offs, len(r.buf))
+		}
+		return r.split(), nil
+	}
+
+	n, err := r.length(line, maxArgs)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+		}
+		size, err := r.length(line, r.max-len(r.buf))
+		if err != nil {
+			return nil, err
+		}
+		if err := r.bulk(size); err != nil {
+			return nil, err
+		}
+		r.offs = append(r.offs, len(r.buf))
+	}
+	return r.split(), nil
+}
+
+// bulk appends a bulk string of the size to buf. It is read in chunks so that
+// the buffer only grows as the client sends it, rather than by whatever size
+// the client claims.
+func (r *reader) bulk(size int) error {
+	for size > 0 {
+		n := size
+		if n > bulkChunk {
+			n = bulkChunk
+		}
+		start := len(r.buf)
+		r.buf = append(r.buf, make([]byte, n)...)
+		if _, err := io.ReadFull(r.br, r.buf[start:]); err != nil {
+			return err
+		}
+		size -= n
+	}
+
+	end, err := r.br.Peek(2)
+	if err != nil {
+		return err
+	}
+	if end[0] != '\r' || end[1] != '\n' {
+		return fmt.Errorf("%w: invalid bulk string", errProtocol)
+	}
+	_, err = r.br.Discard(2)
+	return err
+}
+
+// split returns the arguments held in buf.
+func (r *reader) split() [][]byte {
+	r.args = r.args[:0]
+	start := 0
+	for _, end := range r.offs {
+		r.args = append(r.args, r.buf[start:end:end])
+		start = end
+	}
+	return r.args
+}
+
+// line reads a line terminated by "\r\n" and returns it without the terminator.
+// It is only valid until the next read.
+func (r *reader) line() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", errProtocol)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: expected '\\r\\n'", errProtocol)
+	}
+	return line[:len(line)-2], nil
+}
+
+// length parses the length following the type byte of the line.
+func (r *reader) length(line []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("%w: invalid length %q", errProtocol, line[1:])
+	}
+	return n, nil
+}
+
+// writer writes replies to a client.
+type writer struct {
+	bw      *bufio.Writer
+	scratch []byte
+}
+
+// newWriter constructs a writer of replies to w.
+func newWriter(w io.Writer) *writer {
+	return &writer{bw: bufio.NewWriter(w)}
+}
+
+// flush writes any buffered replies.
+func (w *writer) flush() error { return w.bw.Flush() }
+
+// simple writes a simple string reply.
+func (w *writer) simple(s string) {
+	w.bw.WriteByte('+')
+	w.bw.WriteString(s)
+	w.bw.WriteString("\r\n")
+}
+
+// error writes an error reply, which must not contain newlines.
+func (w *writer) error(s string) {
+	w.bw.WriteByte('-')
+	w.bw.WriteString(s)
+	w.bw.WriteString("\r\n")
+}
+
+// integer writes an integer reply.
+func (w *writer) integer(n int64) { w.prefixed(':', n) }
+
+// array writes the header of an array reply with n elements.
+func (w *writer) array(n int) { w.prefixed('*', int64(n)) }
+
+// bulk writes a bulk string reply.
+func (w *writer) bulk(b []byte) {
+	w.prefixed('$', int64(len(b)))
+	w.bw.Write(b)
+	w.bw.WriteString("\r\n")
+}
+
+// null writes a null bulk string reply.
+func (w *writer) null() { w.bw.WriteString("$-1\r\n") }
+
+// prefixed writes the type byte followed by the number.
+func (w *writer) prefixed(typ byte, n int64) {
+	w.scratch = append(w.scratch[:0], typ)
+	w.scratch = strconv.AppendInt(w.scratch, n, 10)
+	w.scratch = append(w.scratch, '\r', '\n')
+	w.bw.Write(w.scratch)
+}
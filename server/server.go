@@ -0,0 +1,187 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/htable"
+	"github.com/zeebo/gofaster/internal/machine"
+)
+
+// ErrClosed is returned by Serve once the server is closed.
+var ErrClosed = errors.New("server: closed")
+
+// Config controls a Server.
+type Config struct {
+	// MaxConns is the most connections served at once, each of which holds an
+	// epoch handle while it is open. Further connections wait to be accepted
+	// until another closes. The default is 32, leaving half of the handles for
+	// the rest of the process, and it is limited to one less than the number
+	// of handles so that the rest of the process can always have one. A
+	// connection accepted while every handle is held elsewhere is sent an
+	// error and closed.
+	MaxConns int
+
+	// MaxCommandBytes is the most bytes of arguments a command may have.
+	// Clients sending larger commands are sent a protocol error and
+	// disconnected. The default is 4MB.
+	MaxCommandBytes int
+}
+
+// Server serves a table to clients speaking RESP.
+type Server struct {
+	table *htable.Table
+	cfg   Config
+	slots chan struct{} // holds a token for every connection being served
+
+	mu      sync.Mutex
+	closers map[io.Closer]struct{} // the listeners and connections being served
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// New constructs a server for the table, which must not have a read completion
+// function.
+func New(table *htable.Table, cfg Config) *Server {
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 32
+	}
+	if cfg.MaxConns > machine.MaxThreads-1 {
+		cfg.MaxConns = machine.MaxThreads - 1
+	}
+	if cfg.MaxCommandBytes <= 0 {
+		cfg.MaxCommandBytes = 4 << 20
+	}
+	return &Server{
+		table:   table,
+		cfg:     cfg,
+		slots:   make(chan struct{}, cfg.MaxConns),
+		closers: make(map[io.Closer]struct{}),
+	}
+}
+
+// Serve accepts connections from the listener and serves them until the
+// listener fails or the server is closed, in which case it returns ErrClosed.
+// The listener is closed when it returns.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.track(ln) {
+		_ = ln.Close()
+		return ErrClosed
+	}
+	defer s.untrack(ln)
+	defer ln.Close()
+
+	for {
+		s.slots <- struct{}{}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			<-s.slots
+			if s.isClosed() {
+				return ErrClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			<-s.slots
+			_ = conn.Close()
+			return ErrClosed
+		}
+
+		go func() {
+			defer func() { <-s.slots }()
+			defer s.untrack(conn)
+			defer conn.Close()
+
+			s.serve(conn)
+		}()
+	}
+}
+
+// Close stops every listener, closes every connection, and waits for Serve and
+// the connections to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.closers {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// isClosed returns true if the server has been closed.
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track remembers to close c and wait for it to be untracked when the server
+// is closed, unless it already is, and returns true if it did.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closers[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// untrack forgets c.
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+	s.wg.Done()
+}
+
+// serve reads commands from the connection and writes their replies until the
+// client quits or the connection fails. The epoch handle is acquired by the
+// goroutine serving the connection and released when it is done. If no handle
+// is free, the client is sent an error instead.
+func (s *Server) serve(conn net.Conn) {
+	w := newWriter(conn)
+	h, ok := epoch.TryAcquireHandle()
+	if !ok {
+		w.error("ERR max number of clients reached")
+		_ = w.flush()
+		return
+	}
+	defer epoch.ReleaseHandle(h)
+
+	c := &client{
+		h:     h,
+		table: s.table,
+		r:     newReader(conn, s.cfg.MaxCommandBytes),
+		w:     w,
+	}
+
+	for {
+		args, err := c.r.command()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR " + err.Error())
+				_ = c.w.flush()
+			}
+			return
+		}
+
+		quit := c.execute(args)
+
+		// replies to pipelined commands are written together once every
+		// command the client has sent so far has been executed.
+		if quit || !c.r.buffered() {
+			if err := c.w.flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
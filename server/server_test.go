@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/gofaster/epoch"
+	"github.com/zeebo/gofaster/htable"
+	"github.com/zeebo/gofaster/internal/assert"
+	"github.com/zeebo/gofaster/internal/machine"
+)
+
+// respError is an error reply.
+type respError string
+
+// testConn is a client connection that sends commands and parses replies.
+type testConn struct {
+	t  testing.TB
+	nc net.Conn
+	br *bufio.Reader
+}
+
+// send writes the command without waiting for its reply.
+func (c *testConn) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.write(b.String())
+}
+
+// write writes the raw bytes.
+func (c *testConn) write(raw string) {
+	_, err := io.WriteString(c.nc, raw)
+	assert.NoError(c.t, err)
+}
+
+// do sends the command and returns its reply.
+func (c *testConn) do(args ...string) interface{} {
+	c.send(args...)
+	return c.reply()
+}
+
+// reply reads the next reply, which is a string, respError, int64, nil, string
+// for a bulk string, or []interface{}.
+func (c *testConn) reply() interface{} {
+	line, err := c.br.ReadString('\n')
+	assert.NoError(c.t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return respError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		assert.NoError(c.t, err)
+		return n
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		assert.NoError(c.t, err)
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.br, buf)
+		assert.NoError(c.t, err)
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		assert.NoError(c.t, err)
+		arr := make([]interface{}, n)
+		for i := range arr {
+			arr[i] = c.reply()
+		}
+		return arr
+	}
+	c.t.Fatalf("invalid reply: %q", line)
+	return nil
+}
+
+// closed asserts that the server closed the connection.
+func (c *testConn) closed() {
+	_, err := c.br.ReadByte()
+	assert.Equal(c.t, err, io.EOF)
+}
+
+func TestServer(t *testing.T) {
+	// newServer serves a new table on a loopback address, and returns a
+	// function to dial it.
+	newServer := func(t *testing.T) (*Server, func() *testConn) {
+		srv := New(htable.New(4), Config{})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(ln) }()
+		t.Cleanup(func() {
+			assert.NoError(t, srv.Close())
+			assert.Equal(t, <-done, ErrClosed)
+		})
+
+		return srv, func() *testConn {
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			assert.NoError(t, err)
+			t.Cleanup(func() { _ = nc.Close() })
+			return &testConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+		}
+	}
+
+	t.Run("Commands", func(t *testing.T) {
+		_, dial := newServer(t)
+		c := dial()
+
+		assert.Equal(t, c.do("PING"), "PONG")
+		assert.Equal(t, c.do("ping", "hello"), "hello")
+
+		assert.Equal(t, c.do("SET", "a", "1"), "OK")
+		assert.Equal(t, c.do("GET", "a"), "1")
+		assert.Equal(t, c.do("GET", "b"), nil)
+		assert.Equal(t, c.do("EXISTS", "a", "b", "a"), int64(2))
+
+		assert.Equal(t, c.do("INCRBY", "a", "10"), int64(11))
+		assert.Equal(t, c.do("INCRBY", "n", "-3"), int64(-3))
+		assert.Equal(t, c.do("GET", "n"), "-3")
+
+		assert.Equal(t, c.do("SET", "s", "str"), "OK")
+		assert.Equal(t, c.do("INCRBY", "s", "1"), respError("ERR value is not an integer or out of range"))
+		assert.Equal(t, c.do("INCRBY", "a", "x"), respError("ERR value is not an integer or out of range"))
+		assert.Equal(t, c.do("SET", "big", "9223372036854775807"), "OK")
+		assert.Equal(t, c.do("INCRBY", "big", "1"), respError("ERR increment or decrement would overflow"))
+		assert.Equal(t, c.do("GET", "s"), "str")
+
+		assert.Equal(t, c.do("MSET", "x", "1", "y", "2"), "OK")
+		assert.DeepEqual(t, c.do("MGET", "x", "missing", "y"), []interface{}{"1", nil, "2"})
+
+		assert.Equal(t, c.do("DEL", "x", "y", "missing"), int64(2))
+		assert.Equal(t, c.do("EXISTS", "x"), int64(0))
+
+		assert.Equal(t, c.do("GET"), respError("ERR wrong number of arguments for 'get' command"))
+		assert.Equal(t, c.do("MSET", "x"), respError("ERR wrong number of arguments for 'mset' command"))
+		assert.Equal(t, c.do("MSET", "x", "1", "y"), respError("ERR wrong number of arguments for 'mset' command"))
+		assert.Equal(t, c.do("SET", "x", "1", "EX", "10"), respError("ERR syntax error"))
+		assert.Equal(t, c.do("NOPE"), respError("ERR unknown command 'NOPE'"))
+
+		// values longer than a chunk are read in pieces.
+		large := strings.Repeat("0123456789", 20000)
+		assert.Equal(t, c.do("SET", "large", large), "OK")
+		assert.Equal(t, c.do("GET", "large"), large)
+
+		assert.Equal(t, c.do("QUIT"), "OK")
+		c.closed()
+	})
+
+	t.Run("Inline", func(t *testing.T) {
+		_, dial := newServer(t)
+		c := dial()
+
+		c.write("PING\r\n\r\nSET key  value\r\nGET key\r\n")
+		assert.Equal(t, c.reply(), "PONG")
+		assert.Equal(t, c.reply(), "OK")
+		assert.Equal(t, c.reply(), "value")
+	})
+
+	t.Run("Pipeline", func(t *testing.T) {
+		_, dial := newServer(t)
+		c := dial()
+
+		const n = 1000
+
+		// every command is sent before any reply is read, and the replies
+		// come back in order.
+		go func() {
+			var b strings.Builder
+			for i := 0; i < n; i++ {
+				key, val := fmt.Sprint("key-", i), fmt.Sprint("val-", i)
+				fmt.Fprintf(&b, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(val), val)
+				fmt.Fprintf(&b, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+			}
+			c.write(b.String())
+		}()
+
+		for i := 0; i < n; i++ {
+			assert.Equal(t, c.reply(), "OK")
+			assert.Equal(t, c.reply(), fmt.Sprint("val-", i))
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		_, dial := newServer(t)
+		c := dial()
+
+		const n = 100
+
+		var want []string
+		for i := 0; i < n; i++ {
+			key := fmt.Sprint("k:", i)
+			assert.Equal(t, c.do("SET", key, "v"), "OK")
+			want = append(want, key)
+		}
+		assert.Equal(t, c.do("SET", "other", "v"), "OK")
+
+		var got []string
+		cursor := "0"
+		for {
+			reply := c.do("SCAN", cursor, "MATCH", "k:*", "COUNT", "7").([]interface{})
+			for _, key := range reply[1].([]interface{}) {
+				got = append(got, key.(string))
+			}
+			cursor = reply[0].(string)
+			if cursor == "0" {
+				break
+			}
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		assert.DeepEqual(t, got, want)
+
+		assert.Equal(t, c.do("SCAN", "x"), respError("ERR invalid cursor"))
+		assert.Equal(t, c.do("SCAN", "0", "COUNT"), respError("ERR syntax error"))
+		assert.Equal(t, c.do("SCAN", "0", "COUNT", "0"), respError("ERR syntax error"))
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		_, dial := newServer(t)
+
+		const (
+			clients = 8
+			iters   = 200
+		)
+
+		// every increment is applied atomically.
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			c := dial()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < iters; j++ {
+					c.send("INCRBY", "counter", "1")
+				}
+				for j := 0; j < iters; j++ {
+					_, ok := c.reply().(int64)
+					assert.That(t, ok)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, dial().do("GET", "counter"), fmt.Sprint(clients*iters))
+	})
+
+	t.Run("Protocol", func(t *testing.T) {
+		_, dial := newServer(t)
+
+		c := dial()
+		c.write("*1\r\n$abc\r\n")
+		reply, ok := c.reply().(respError)
+		assert.That(t, ok)
+		assert.That(t, strings.HasPrefix(string(reply), "ERR Protocol error"))
+		c.closed()
+
+		c = dial()
+		c.write("*1\r\n$4\r\nPINGxx")
+		assert.That(t, strings.HasPrefix(string(c.reply().(respError)), "ERR Protocol error"))
+		c.closed()
+	})
+
+	t.Run("Handles", func(t *testing.T) {
+		// connections are limited to the epoch handles.
+		assert.Equal(t, cap(New(htable.New(4), Config{MaxConns: 1000}).slots), machine.MaxThreads-1)
+
+		_, dial := newServer(t)
+
+		// a connection accepted while every handle is held elsewhere is
+		// refused instead of bringing down the server.
+		var hs []epoch.Handle
+		for {
+			h, ok := epoch.TryAcquireHandle()
+			if !ok {
+				break
+			}
+			hs = append(hs, h)
+		}
+		c := dial()
+		assert.Equal(t, c.reply(), respError("ERR max number of clients reached"))
+		c.closed()
+
+		for _, h := range hs {
+			epoch.ReleaseHandle(h)
+		}
+		assert.Equal(t, dial().do("PING"), "PONG")
+	})
+
+	t.Run("MaxCommandBytes", func(t *testing.T) {
+		srv := New(htable.New(4), Config{MaxCommandBytes: 16})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() { _ = srv.Serve(ln) }()
+		defer srv.Close()
+
+		dial := func() *testConn {
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			assert.NoError(t, err)
+			t.Cleanup(func() { _ = nc.Close() })
+			return &testConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+		}
+
+		c := dial()
+		assert.Equal(t, c.do("SET", "key", "0123456789"), "OK")
+		c.send("SET", "key", "0123456789a")
+		assert.That(t, strings.HasPrefix(string(c.reply().(respError)), "ERR Protocol error"))
+		c.closed()
+
+		// a huge length is rejected before any of the string is sent.
+		c = dial()
+		c.write("*1\r\n$536870912\r\n")
+		assert.That(t, strings.HasPrefix(string(c.reply().(respError)), "ERR Protocol error"))
+		c.closed()
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		srv, dial := newServer(t)
+
+		c := dial()
+		assert.Equal(t, c.do("PING"), "PONG")
+		assert.NoError(t, srv.Close())
+		c.closed()
+	})
+
+	t.Run("MaxConns", func(t *testing.T) {
+		srv := New(htable.New(4), Config{MaxConns: 1})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() { _ = srv.Serve(ln) }()
+		defer srv.Close()
+
+		dial := func() *testConn {
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			assert.NoError(t, err)
+			return &testConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+		}
+
+		// the second connection is only served once the first is closed.
+		first, second := dial(), dial()
+		assert.Equal(t, first.do("PING"), "PONG")
+		second.send("PING")
+		assert.Equal(t, first.do("QUIT"), "OK")
+		assert.Equal(t, second.reply(), "PONG")
+		_ = first.nc.Close()
+		_ = second.nc.Close()
+	})
+}
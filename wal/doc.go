@@ -0,0 +1,7 @@
+// package wal provides a write ahead log of opaque records stored in segment
+// files. Records are appended to a buffer in memory, and written and synced in
+// groups by a background goroutine, either periodically or once enough bytes
+// are buffered. Each record carries a checksum, so that a record torn by a
+// crash while it was being written is detected and discarded when the log is
+// opened again.
+package wal
@@ -0,0 +1,125 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a record is its length and the crc of its length and data, little endian,
+// followed by the data. including the length means zeros are never valid.
+const recordHeader = 8
+
+// checksum returns the crc of the record with the header.
+func checksum(hdr, rec []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(hdr[0:4]), crc32.IEEETable, rec)
+}
+
+// appendRecord appends the framed record to the buffer.
+func appendRecord(buf, rec []byte) []byte {
+	var hdr [recordHeader]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(rec)))
+	binary.LittleEndian.PutUint32(hdr[4:8], checksum(hdr[:], rec))
+	return append(append(buf, hdr[:]...), rec...)
+}
+
+// next returns the first record in the buffer and the rest of the buffer, or
+// false if the buffer does not start with a valid record.
+func next(buf []byte) (rec, rest []byte, ok bool) {
+	if len(buf) < recordHeader {
+		return nil, buf, false
+	}
+	n := binary.LittleEndian.Uint32(buf[0:4])
+	if uint64(n) > uint64(len(buf)-recordHeader) {
+		return nil, buf, false
+	}
+	rec = buf[recordHeader : recordHeader+int(n)]
+	if checksum(buf, rec) != binary.LittleEndian.Uint32(buf[4:8]) {
+		return nil, buf, false
+	}
+	return rec, buf[recordHeader+int(n):], true
+}
+
+// segment is a segment file and the size of its valid records.
+type segment struct {
+	num  uint64
+	size int64
+}
+
+// scan finds the segments of the log at the base path in order, validating
+// their records.
+func scan(base string) ([]segment, error) {
+	names, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, name := range names {
+		num, err := strconv.ParseUint(strings.TrimPrefix(name, base+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{num: num})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].num < segments[j].num })
+
+	for i := range segments {
+		data, err := os.ReadFile(fmt.Sprintf("%s.%d", base, segments[i].num))
+		if err != nil {
+			return nil, err
+		}
+
+		rest := data
+		for len(rest) > 0 {
+			var ok bool
+			if _, rest, ok = next(rest); !ok {
+				break
+			}
+		}
+
+		// only the end of the last segment can be torn, since a segment is
+		// synced before the next one is started.
+		if len(rest) > 0 && i < len(segments)-1 {
+			return nil, fmt.Errorf("%w: segment %d at %d", ErrCorrupt, segments[i].num, len(data)-len(rest))
+		}
+		segments[i].size = int64(len(data) - len(rest))
+	}
+
+	return segments, nil
+}
+
+// Replay calls fn with every record that was in the log when it was opened, in
+// the order they were appended. The record must not be retained after fn
+// returns. It stops and returns the first error from fn.
+func (l *Log) Replay(fn func(rec []byte) error) error {
+	for _, seg := range l.segments {
+		fh, err := os.Open(l.name(seg.num))
+		if err != nil {
+			return err
+		}
+		data := make([]byte, seg.size)
+		_, err = fh.ReadAt(data, 0)
+		_ = fh.Close()
+		if err != nil && seg.size > 0 {
+			return err
+		}
+
+		for len(data) > 0 {
+			rec, rest, ok := next(data)
+			if !ok {
+				return fmt.Errorf("%w: segment %d", ErrCorrupt, seg.num)
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+			data = rest
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned when using a log that has been closed.
+	ErrClosed = errors.New("wal: log closed")
+
+	// ErrCorrupt is returned when opening a log with an invalid record that is
+	// not at the end of the last segment.
+	ErrCorrupt = errors.New("wal: corrupt log")
+)
+
+// Config describes how a log groups and stores records.
+type Config struct {
+	// Interval is the longest a record is buffered before it is written and
+	// synced. The default is 10ms.
+	Interval time.Duration
+
+	// Bytes is the number of buffered bytes that causes them to be written and
+	// synced before the interval has passed. The default is 1MB.
+	Bytes int
+
+	// SegmentSize is the size after which a new segment file is started. The
+	// default is 64MB.
+	SegmentSize int64
+}
+
+// normalize fills in the defaults of the config and validates it.
+func (c Config) normalize() (Config, error) {
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Millisecond
+	}
+	if c.Bytes == 0 {
+		c.Bytes = 1 << 20
+	}
+	if c.SegmentSize == 0 {
+		c.SegmentSize = 64 << 20
+	}
+
+	switch {
+	case c.Interval < 0:
+		return c, fmt.Errorf("wal: invalid interval: %v", c.Interval)
+	case c.Bytes < 0:
+		return c, fmt.Errorf("wal: invalid bytes: %d", c.Bytes)
+	case c.SegmentSize < 0:
+		return c, fmt.Errorf("wal: invalid segment size: %d", c.SegmentSize)
+	}
+	return c, nil
+}
+
+// Log is a write ahead log stored in segment files named by the base path
+// followed by a dot and the segment number.
+type Log struct {
+	cfg  Config
+	base string
+
+	segments []segment // the segments that existed when the log was opened
+
+	mu       sync.Mutex
+	synced   *sync.Cond // broadcast whenever written changes
+	buf      []byte     // records appended but not yet written
+	appended uint64     // the number of bytes ever appended
+	written  uint64     // the number of bytes ever written and synced
+	err      error      // the first error writing or syncing
+	closed   bool
+
+	kick chan struct{} // wakes the writer early
+	done chan struct{} // closed when the writer exits
+
+	file *os.File // the segment being appended to, only used by the writer
+	num  uint64   // its number
+	size int64    // its size
+}
+
+// Open opens the log at the base path, creating it if necessary, and starts
+// writing records appended to it. Records in the last segment after the first
+// invalid one were torn by a crash, and are removed.
+func Open(base string, cfg Config) (*Log, error) {
+	cfg, err := cfg.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := scan(base)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		cfg:      cfg,
+		base:     base,
+		segments: segments,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	l.synced = sync.NewCond(&l.mu)
+
+	if n := len(segments); n > 0 {
+		last := segments[n-1]
+		l.num, l.size = last.num, last.size
+	} else {
+		l.num = 1
+	}
+
+	l.file, err = os.OpenFile(l.name(l.num), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.file.Truncate(l.size); err != nil {
+		_ = l.file.Close()
+		return nil, err
+	}
+	if _, err := l.file.Seek(l.size, 0); err != nil {
+		_ = l.file.Close()
+		return nil, err
+	}
+	if err := l.file.Sync(); err != nil {
+		_ = l.file.Close()
+		return nil, err
+	}
+
+	go l.run()
+	return l, nil
+}
+
+// name returns the file name of the segment with the number.
+func (l *Log) name(num uint64) string {
+	return fmt.Sprintf("%s.%d", l.base, num)
+}
+
+// Append adds a copy of the record to the log. It is durable once Sync has
+// returned after Append, or once the configured interval has passed. It
+// returns the first error writing the log, if any.
+func (l *Log) Append(rec []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.closed:
+		return ErrClosed
+	case l.err != nil:
+		return l.err
+	}
+
+	l.buf = appendRecord(l.buf, rec)
+	l.appended += uint64(recordHeader + len(rec))
+
+	if len(l.buf) >= l.cfg.Bytes {
+		l.wake()
+	}
+	return nil
+}
+
+// wake causes the writer to write the buffered records without waiting for
+// the interval.
+func (l *Log) wake() {
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Sync waits until every record appended before it was called is durable, and
+// returns the first error writing the log, if any.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	target := l.appended
+	if l.written < target {
+		l.wake()
+	}
+	for l.written < target && l.err == nil && !l.closed {
+		l.synced.Wait()
+	}
+
+	switch {
+	case l.err != nil:
+		return l.err
+	case l.written < target:
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close writes and syncs every appended record and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	l.wake()
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.synced.Broadcast()
+
+	if err := l.file.Close(); err != nil && l.err == nil {
+		l.err = err
+	}
+	return l.err
+}
+
+// run writes the buffered records whenever the interval passes or it is woken,
+// until the log is closed.
+func (l *Log) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+
+	var buf []byte
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.kick:
+		}
+
+		l.mu.Lock()
+		buf, l.buf = l.buf, buf[:0]
+		closed := l.closed || l.err != nil
+		l.mu.Unlock()
+
+		err := l.write(buf)
+
+		l.mu.Lock()
+		if err != nil && l.err == nil {
+			l.err = err
+		}
+		if l.err == nil {
+			l.written += uint64(len(buf))
+		}
+		l.synced.Broadcast()
+		l.mu.Unlock()
+
+		if closed {
+			return
+		}
+	}
+}
+
+// write writes the records in the buffer to the current segment, starting a
+// new one if it is full, and syncs it.
+func (l *Log) write(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if l.size >= l.cfg.SegmentSize {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(l.name(l.num+1), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		l.file, l.num, l.size = file, l.num+1, 0
+	}
+
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	l.size += int64(len(buf))
+	return l.file.Sync()
+}
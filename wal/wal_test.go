@@ -0,0 +1,144 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/gofaster/internal/assert"
+)
+
+func TestLog(t *testing.T) {
+	// replay returns every record in the log.
+	replay := func(t *testing.T, l *Log) (recs []string) {
+		assert.NoError(t, l.Replay(func(rec []byte) error {
+			recs = append(recs, string(rec))
+			return nil
+		}))
+		return recs
+	}
+
+	t.Run("Basic", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+
+		l, err := Open(base, Config{SegmentSize: 64})
+		assert.NoError(t, err)
+		assert.Equal(t, len(replay(t, l)), 0)
+
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, l.Append([]byte(fmt.Sprint("record-", i))))
+			assert.NoError(t, l.Sync())
+		}
+		assert.NoError(t, l.Append(nil))
+		assert.NoError(t, l.Sync())
+		assert.NoError(t, l.Close())
+		assert.Equal(t, l.Close(), ErrClosed)
+		assert.Equal(t, l.Append(nil), ErrClosed)
+
+		names, err := filepath.Glob(base + ".*")
+		assert.NoError(t, err)
+		assert.That(t, len(names) > 1)
+
+		l, err = Open(base, Config{})
+		assert.NoError(t, err)
+		defer func() { assert.NoError(t, l.Close()) }()
+
+		recs := replay(t, l)
+		assert.Equal(t, len(recs), 21)
+		for i := 0; i < 20; i++ {
+			assert.Equal(t, recs[i], fmt.Sprint("record-", i))
+		}
+		assert.Equal(t, recs[20], "")
+	})
+
+	t.Run("Torn", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+
+		l, err := Open(base, Config{})
+		assert.NoError(t, err)
+		assert.NoError(t, l.Append([]byte("first")))
+		assert.NoError(t, l.Append([]byte("second")))
+		assert.NoError(t, l.Close())
+
+		// cut the last record short, as if the process crashed writing it.
+		info, err := os.Stat(base + ".1")
+		assert.NoError(t, err)
+		assert.NoError(t, os.Truncate(base+".1", info.Size()-2))
+
+		l, err = Open(base, Config{})
+		assert.NoError(t, err)
+		assert.DeepEqual(t, replay(t, l), []string{"first"})
+
+		// appending continues after the valid records.
+		assert.NoError(t, l.Append([]byte("third")))
+		assert.NoError(t, l.Close())
+
+		// a flipped bit is also torn, and zeros are never valid.
+		fh, err := os.OpenFile(base+".1", os.O_WRONLY|os.O_APPEND, 0)
+		assert.NoError(t, err)
+		_, err = fh.Write(make([]byte, 64))
+		assert.NoError(t, err)
+		assert.NoError(t, fh.Close())
+
+		l, err = Open(base, Config{})
+		assert.NoError(t, err)
+		assert.DeepEqual(t, replay(t, l), []string{"first", "third"})
+		assert.NoError(t, l.Close())
+
+		data, err := os.ReadFile(base + ".1")
+		assert.NoError(t, err)
+		data[recordHeader] ^= 1
+		assert.NoError(t, os.WriteFile(base+".1", data, 0644))
+
+		l, err = Open(base, Config{})
+		assert.NoError(t, err)
+		assert.Equal(t, len(replay(t, l)), 0)
+		assert.NoError(t, l.Close())
+
+		// corruption in a segment before the last is not torn.
+		assert.NoError(t, os.WriteFile(base+".1", make([]byte, 64), 0644))
+		assert.NoError(t, os.WriteFile(base+".2", nil, 0644))
+		_, err = Open(base, Config{})
+		assert.That(t, errors.Is(err, ErrCorrupt))
+	})
+
+	t.Run("GroupCommit", func(t *testing.T) {
+		base := filepath.Join(t.TempDir(), "wal")
+
+		l, err := Open(base, Config{Interval: time.Hour, Bytes: 1024})
+		assert.NoError(t, err)
+
+		const (
+			workers = 8
+			iters   = 200
+		)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < iters; j++ {
+					assert.NoError(t, l.Append([]byte(fmt.Sprint(i, "-", j))))
+					if j%50 == 0 {
+						assert.NoError(t, l.Sync())
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.NoError(t, l.Sync())
+
+		// synced records are durable even if the log is never closed.
+		r, err := Open(base, Config{})
+		assert.NoError(t, err)
+		recs := replay(t, r)
+		assert.Equal(t, len(recs), workers*iters)
+		assert.NoError(t, r.Close())
+		assert.NoError(t, l.Close())
+	})
+}